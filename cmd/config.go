@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/arvinsg/cess-fuse/pkg/fs"
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// Configuration for the CESS backend is layered, later sources win:
+//
+//  1. the config file (--config, CESS_CONFIG or ~/.cess-fuse/config.{yaml,toml})
+//  2. CESS_* environment variables
+//  3. command line flags
+//  4. the bucket[:prefix] positional argument
+const (
+	envConfig      = "CESS_CONFIG"
+	envEndpoint    = "CESS_ENDPOINT"
+	envAccount     = "CESS_ACCOUNT"
+	envToken       = "CESS_TOKEN"
+	envBucket      = "CESS_BUCKET"
+	envPrefix      = "CESS_PREFIX"
+	envHTTPTimeout = "CESS_HTTP_TIMEOUT"
+)
+
+// cessFileConfig is the layout of the config file. YAML and TOML use the
+// same keys.
+type cessFileConfig struct {
+	Endpoint    string `yaml:"endpoint" toml:"endpoint"`
+	Account     string `yaml:"account" toml:"account"`
+	Token       string `yaml:"token" toml:"token"`
+	Bucket      string `yaml:"bucket" toml:"bucket"`
+	Prefix      string `yaml:"prefix" toml:"prefix"`
+	HTTPTimeout string `yaml:"http-timeout" toml:"http-timeout"`
+}
+
+// configSource remembers where a value came from so validation errors can
+// point the user at the right knob.
+type configSource map[string]string
+
+func (s configSource) describe(key, flag, env string) string {
+	if src, ok := s[key]; ok {
+		return src
+	}
+	return fmt.Sprintf("set --%v, %v or %q in the config file", flag, env, key)
+}
+
+func defaultConfigPaths() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	dir := filepath.Join(home, ".cess-fuse")
+	return []string{
+		filepath.Join(dir, "config.yaml"),
+		filepath.Join(dir, "config.yml"),
+		filepath.Join(dir, "config.toml"),
+	}
+}
+
+// findConfigFile returns the config file to load, or "" if there is none.
+// An explicitly requested file must exist.
+func findConfigFile(c *cli.Context) (string, error) {
+	path := c.String("config")
+	if path == "" {
+		path = os.Getenv(envConfig)
+	}
+	if path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("unable to read config file %v: %v", path, err)
+		}
+		return path, nil
+	}
+
+	for _, p := range defaultConfigPaths() {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", nil
+}
+
+func loadConfigFile(path string) (cfg cessFileConfig, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		_, err = toml.Decode(string(data), &cfg)
+	case ".yaml", ".yml", "":
+		err = yaml.UnmarshalStrict(data, &cfg)
+	default:
+		err = fmt.Errorf("unknown config format %v, use .yaml or .toml",
+			filepath.Ext(path))
+	}
+	if err != nil {
+		err = fmt.Errorf("unable to parse config file %v: %v", path, err)
+	}
+	return
+}
+
+// parseBucketSpec splits bucket[:prefix]. The returned prefix is either
+// empty or ends with a /, which is what the root inode expects.
+func parseBucketSpec(spec string) (bucket string, prefix string) {
+	bucket = spec
+	if colon := strings.Index(spec, ":"); colon != -1 {
+		bucket = spec[:colon]
+		prefix = spec[colon+1:]
+	}
+	return bucket, normalizePrefix(prefix)
+}
+
+func normalizePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// ParseCESSConfig merges the config file, environment and command line
+// into a CessConfig, validates it, and records the resolved bucket,
+// prefix, endpoint and timeout back into flags.
+func ParseCESSConfig(c *cli.Context, flags *fs.Flags) (*storage.CessConfig, error) {
+	var (
+		cfg     storage.CessConfig
+		prefix  string
+		timeout string
+		src     = configSource{}
+	)
+
+	set := func(dst *string, value, key, from string) {
+		if value != "" {
+			*dst = value
+			src[key] = from
+		}
+	}
+
+	path, err := findConfigFile(c)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		file, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		from := "from config file " + path
+		set(&cfg.Endpoint, file.Endpoint, "endpoint", from)
+		set(&cfg.Account, file.Account, "account", from)
+		set(&cfg.Token, file.Token, "token", from)
+		set(&cfg.Bucket, file.Bucket, "bucket", from)
+		set(&prefix, file.Prefix, "prefix", from)
+		set(&timeout, file.HTTPTimeout, "http-timeout", from)
+	}
+
+	for _, e := range []struct {
+		dst *string
+		env string
+		key string
+	}{
+		{&cfg.Endpoint, envEndpoint, "endpoint"},
+		{&cfg.Account, envAccount, "account"},
+		{&cfg.Token, envToken, "token"},
+		{&cfg.Bucket, envBucket, "bucket"},
+		{&prefix, envPrefix, "prefix"},
+		{&timeout, envHTTPTimeout, "http-timeout"},
+	} {
+		set(e.dst, os.Getenv(e.env), e.key, "from "+e.env)
+	}
+
+	for _, f := range []struct {
+		dst  *string
+		flag string
+	}{
+		{&cfg.Endpoint, "endpoint"},
+		{&cfg.Account, "account"},
+		{&cfg.Token, "token"},
+		{&cfg.Bucket, "bucket"},
+		{&prefix, "prefix"},
+	} {
+		if c.IsSet(f.flag) {
+			set(f.dst, c.String(f.flag), f.flag, "from --"+f.flag)
+		}
+	}
+
+	if flags.Bucket != "" {
+		// bucket[:prefix] given as the first argument
+		set(&cfg.Bucket, flags.Bucket, "bucket", "from the command line argument")
+		if flags.Prefix != "" {
+			set(&prefix, flags.Prefix, "prefix", "from the command line argument")
+		}
+	} else if strings.Contains(cfg.Bucket, ":") {
+		// bucket:prefix is accepted wherever a bucket is
+		var p string
+		cfg.Bucket, p = parseBucketSpec(cfg.Bucket)
+		if p != "" {
+			prefix = p
+		}
+	}
+
+	cfg.HTTPTimeout = flags.HTTPTimeout
+	if timeout != "" && !c.IsSet("http-timeout") {
+		cfg.HTTPTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http-timeout %q (%v): %v",
+				timeout, src["http-timeout"], err)
+		}
+	}
+
+	err = validateCESSConfig(&cfg, src)
+	if err != nil {
+		return nil, err
+	}
+
+	flags.Endpoint = cfg.Endpoint
+	flags.Bucket = cfg.Bucket
+	flags.Prefix = normalizePrefix(prefix)
+	flags.HTTPTimeout = cfg.HTTPTimeout
+
+	return &cfg, nil
+}
+
+func validateCESSConfig(cfg *storage.CessConfig, src configSource) error {
+	var problems []string
+
+	if cfg.Endpoint == "" {
+		problems = append(problems, "gateway endpoint is not set: "+
+			src.describe("endpoint", "endpoint", envEndpoint))
+	} else if u, err := url.Parse(cfg.Endpoint); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problems = append(problems, fmt.Sprintf(
+			"gateway endpoint %q (%v) must look like http(s)://host[:port]",
+			cfg.Endpoint, src["endpoint"]))
+	}
+
+	if cfg.Bucket == "" {
+		problems = append(problems, "bucket is not set: pass bucket[:prefix] "+
+			"before the mountpoint or "+src.describe("bucket", "bucket", envBucket))
+	} else if strings.Contains(cfg.Bucket, "/") {
+		problems = append(problems, fmt.Sprintf(
+			"bucket %q (%v) must not contain '/', use bucket:prefix to mount a sub-tree",
+			cfg.Bucket, src["bucket"]))
+	}
+
+	if cfg.Account == "" {
+		problems = append(problems, "account is not set: "+
+			src.describe("account", "account", envAccount))
+	}
+
+	if cfg.HTTPTimeout <= 0 {
+		problems = append(problems, fmt.Sprintf(
+			"http timeout must be positive, got %v", cfg.HTTPTimeout))
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid CESS configuration:\n  - %v",
+			strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// validateLimits rejects negative sizes and counts, which would otherwise
+// wrap around to an unlimited one
+func validateLimits(c *cli.Context) error {
+	var problems []string
+
+	for _, name := range []string{"staging-limit-mb", "cache-size-mb", "small-file-kb",
+		"small-file-cache-mb", "max-inodes", "retries"} {
+		if v := c.Int(name); v < 0 {
+			problems = append(problems, fmt.Sprintf(
+				"--%v must not be negative, got %v", name, v))
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("invalid options:\n  - %v",
+			strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
+
+// ParseS3Config builds the config of the s3 backend. Credentials are not
+// taken from the command line, the AWS SDK finds them in AWS_* variables,
+// the shared credentials file (see --profile) or the instance role.
+func ParseS3Config(c *cli.Context, flags *fs.Flags) (*storage.S3Config, error) {
+	cfg := &storage.S3Config{
+		Endpoint:     c.String("endpoint"),
+		Region:       c.String("region"),
+		Profile:      c.String("profile"),
+		Subdomain:    c.Bool("subdomain"),
+		StorageClass: c.String("storage-class"),
+		HTTPTimeout:  flags.HTTPTimeout,
+	}
+
+	prefix := flags.Prefix
+	cfg.Bucket = flags.Bucket
+	if cfg.Bucket == "" {
+		cfg.Bucket, prefix = parseBucketSpec(c.String("bucket"))
+	}
+	if prefix == "" {
+		prefix = c.String("prefix")
+	}
+
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("bucket is not set: pass bucket[:prefix] before the mountpoint or set --bucket")
+	}
+	if cfg.HTTPTimeout <= 0 {
+		return nil, fmt.Errorf("http timeout must be positive, got %v", cfg.HTTPTimeout)
+	}
+
+	flags.Endpoint = cfg.Endpoint
+	flags.Bucket = cfg.Bucket
+	flags.Prefix = normalizePrefix(prefix)
+
+	return cfg, nil
+}
@@ -2,14 +2,15 @@ package main
 
 import (
 	"io"
+	"math"
 	"os"
+	"path/filepath"
 	"strings"
 	"text/tabwriter"
 	"text/template"
 	"time"
 
 	"github.com/arvinsg/cess-fuse/pkg/fs"
-	"github.com/arvinsg/cess-fuse/pkg/storage"
 	"github.com/arvinsg/cess-fuse/pkg/utils"
 	"github.com/urfave/cli"
 )
@@ -31,7 +32,7 @@ func init() {
    {{.Name}} - {{.Usage}}
 
 USAGE:
-   {{.Name}} {{if .Flags}}[global options]{{end}} mountpoint
+   {{.Name}} {{if .Flags}}[global options]{{end}} [bucket[:prefix]] mountpoint
    {{if .Version}}
 VERSION:
    {{.Version}}
@@ -45,6 +46,12 @@ COMMANDS:
 GLOBAL OPTIONS:
    {{range category .Flags ""}}{{.}}
    {{end}}
+CESS OPTIONS:
+   {{range category .Flags "CESS"}}{{.}}
+   {{end}}
+S3 OPTIONS:
+   {{range category .Flags "S3"}}{{.}}
+   {{end}}
 TUNING OPTIONS:
    {{range category .Flags "tuning"}}{{.}}
    {{end}}
@@ -60,6 +67,11 @@ COPYRIGHT:
 func NewApp() (app *cli.App) {
 	uid, gid := utils.MyUserAndGroup()
 
+	var journalDir string
+	if dir, err := os.UserCacheDir(); err == nil {
+		journalDir = filepath.Join(dir, "cess-fuse", "journal")
+	}
+
 	app = &cli.App{
 		Name:     "CESS-Fuse",
 		Usage:    "Mount cloud storage locally",
@@ -109,6 +121,66 @@ func NewApp() (app *cli.App) {
 			// CESS Storage config
 			/////////////////////////
 
+			cli.StringFlag{
+				Name:  "backend",
+				Value: "cess",
+				Usage: "Where to store data: cess, s3 for an S3 compatible endpoint, mem for a " +
+					"scratch mount that is lost on unmount, or posix to keep objects in the " +
+					"local directory given instead of a bucket.",
+			},
+
+			cli.StringFlag{
+				Name: "config",
+				Usage: "Config file (YAML or TOML) with endpoint, account, token, bucket and prefix. " +
+					"(default: $CESS_CONFIG or ~/.cess-fuse/config.yaml)",
+			},
+
+			cli.StringFlag{
+				Name:  "endpoint",
+				Usage: "The CESS gateway to connect to, ex: http://127.0.0.1:8080 ($CESS_ENDPOINT)",
+			},
+
+			cli.StringFlag{
+				Name:  "account",
+				Usage: "The CESS account to access the gateway with. ($CESS_ACCOUNT)",
+			},
+
+			cli.StringFlag{
+				Name:  "token",
+				Usage: "The access token for the gateway. Prefer $CESS_TOKEN or the config file.",
+			},
+
+			cli.StringFlag{
+				Name:  "bucket",
+				Usage: "Bucket to mount, accepts bucket:prefix. Overridden by the bucket argument. ($CESS_BUCKET)",
+			},
+
+			cli.StringFlag{
+				Name:  "prefix",
+				Usage: "Only mount this sub-tree of the bucket. ($CESS_PREFIX)",
+			},
+
+			cli.StringFlag{
+				Name:  "region",
+				Value: "us-east-1",
+				Usage: "The region to connect to with --backend s3.",
+			},
+
+			cli.StringFlag{
+				Name:  "profile",
+				Usage: "Use a named profile from $HOME/.aws/credentials instead of \"default\"",
+			},
+
+			cli.BoolFlag{
+				Name:  "subdomain",
+				Usage: "Address the bucket as bucket.endpoint instead of endpoint/bucket.",
+			},
+
+			cli.StringFlag{
+				Name:  "storage-class",
+				Usage: "The storage class to use for new objects with --backend s3.",
+			},
+
 			cli.BoolFlag{
 				Name:  "use-content-type",
 				Usage: "Set Content-Type according to file extension and /etc/mime.types (default: off)",
@@ -136,10 +208,146 @@ func NewApp() (app *cli.App) {
 					"inodes.",
 			},
 
+			cli.DurationFlag{
+				Name:  "negative-cache-ttl",
+				Value: 5 * time.Second,
+				Usage: "How long to remember that a name doesn't exist, 0 disables it. " +
+					"Files created elsewhere may stay hidden that long.",
+			},
+
 			cli.DurationFlag{
 				Name:  "http-timeout",
 				Value: 30 * time.Second,
-				Usage: "Set the timeout on HTTP requests to S3",
+				Usage: "Set the timeout on HTTP requests to the backend",
+			},
+
+			cli.IntFlag{
+				Name:  "retries",
+				Value: 3,
+				Usage: "How many times to retry a backend request that failed with a " +
+					"transient error, with exponential backoff within --http-timeout. 0 disables retries.",
+			},
+
+			cli.StringFlag{
+				Name:  "metrics-addr",
+				Usage: "Serve Prometheus metrics on this address, ex: :9100 or 127.0.0.1:9100 (default: off)",
+			},
+
+			cli.StringFlag{
+				Name: "staging-dir",
+				Usage: "Support random writes by copying files written out of order to this " +
+					"directory until they are flushed (default: off, only sequential writes)",
+			},
+
+			cli.IntFlag{
+				Name:  "staging-limit-mb",
+				Value: 10240,
+				Usage: "Disk space --staging-dir may use in MiB, writes fail with ENOSPC beyond it. 0 is unlimited.",
+			},
+
+			cli.BoolFlag{
+				Name: "durable-fsync",
+				Usage: "Make fsync upload what was written so far, the file can still be " +
+					"written to afterwards (default: fsync is a no-op and data is uploaded on close)",
+			},
+
+			cli.StringFlag{
+				Name:  "cache-dir",
+				Usage: "Keep file data read from the backend in this directory, across mounts (default: off)",
+			},
+
+			cli.IntFlag{
+				Name:  "cache-size-mb",
+				Value: 10240,
+				Usage: "Disk space --cache-dir may use in MiB, the least recently used data is removed beyond it. 0 is unlimited.",
+			},
+
+			cli.IntFlag{
+				Name:  "readahead-min-mb",
+				Value: int(fs.MinReadHead / 1024 / 1024),
+				Usage: "Read ahead once a file was read this far in order, and start with a window this big.",
+			},
+
+			cli.IntFlag{
+				Name:  "readahead-max-mb",
+				Value: int(fs.MaxReadHead / 1024 / 1024),
+				Usage: "Most a file is read ahead, the window doubles up to this while reads stay in order.",
+			},
+
+			cli.IntFlag{
+				Name:  "readahead-chunk-mb",
+				Value: int(fs.ReadHeadChunk / 1024 / 1024),
+				Usage: "Size of one readahead request.",
+			},
+
+			cli.IntFlag{
+				Name:  "small-file-kb",
+				Value: 128,
+				Usage: "Read files up to this size whole when they are opened and keep them in memory. 0 disables it.",
+			},
+
+			cli.IntFlag{
+				Name:  "small-file-cache-mb",
+				Value: 64,
+				Usage: "Memory used to keep small files, the least recently opened are dropped beyond it.",
+			},
+
+			cli.BoolFlag{
+				Name: "writeback-cache",
+				Usage: "Let the kernel buffer small writes and send them in bigger ones, " +
+					"needs --staging-dir (default: off, every write goes to cess-fuse)",
+			},
+
+			cli.StringFlag{
+				Name:  "page-cache",
+				Value: fs.PageCacheAuto,
+				Usage: "When files opened again may be read from the kernel page cache: " +
+					"none, keep, or auto to drop it if the file changed",
+			},
+
+			cli.IntFlag{
+				Name:  "max-inodes",
+				Value: 1000000,
+				Usage: "Most inodes to keep in memory, the least recently used files that aren't " +
+					"open are dropped beyond it and looked up again when needed. 0 is unlimited.",
+			},
+
+			cli.BoolFlag{
+				Name: "stable-inodes",
+				Usage: "Derive inode numbers from the object names so that they stay the same " +
+					"across mounts, for backups and NFS exports. A renamed file gets a new one " +
+					"on the next mount, and the rare names whose hashes collide get theirs in lookup " +
+					"order. (default: off, inode numbers are assigned in lookup order)",
+			},
+
+			cli.StringFlag{
+				Name: "metadata-snapshot",
+				Usage: "Save the directory tree to this file and load it on the next mount, so that " +
+					"directories aren't listed again until --type-cache-ttl is over (default: off)",
+			},
+
+			cli.DurationFlag{
+				Name:  "metadata-snapshot-interval",
+				Value: 10 * time.Minute,
+				Usage: "How often to save --metadata-snapshot, besides at unmount. 0 only saves it at unmount.",
+			},
+
+			cli.DurationFlag{
+				Name: "poll-interval",
+				Usage: "List the mount this often to find objects changed by others and make the " +
+					"kernel drop what it cached of them (default: off, changes are seen after --stat-cache-ttl)",
+			},
+
+			cli.StringSliceFlag{
+				Name:  "poll-prefix",
+				Usage: "Only poll this directory of the mount for changes, can be repeated (default: the whole mount)",
+			},
+
+			cli.StringFlag{
+				Name:  "journal-dir",
+				Value: journalDir,
+				Usage: "Record directory renames here until they finish, so that one cut short " +
+					"by a crash is completed on the next mount or by fsck. Empty disables the journal.",
 			},
 
 			/////////////////////////
@@ -150,6 +358,16 @@ func NewApp() (app *cli.App) {
 				Name:  "debug_fuse",
 				Usage: "Enable fuse-related debugging output.",
 			},
+
+			cli.StringFlag{
+				Name: "debug-faults",
+				Usage: "Inject backend failures for testing, ex: " +
+					"\"method=GetBlob,key=dir/*,p=0.1,err=EIO;method=MultipartBlobAdd,after=2,count=1,drop\". " +
+					"Also accepts latency=<duration>, truncate=<bytes> and seed=<n>.",
+			},
+		},
+		Commands: []cli.Command{
+			fsckCommand,
 		},
 	}
 
@@ -160,22 +378,26 @@ func NewApp() (app *cli.App) {
 
 	flagCategories = map[string]string{}
 
-	for _, f := range []string{"region"} {
+	for _, f := range []string{"backend", "config", "endpoint", "account", "token", "bucket", "prefix"} {
 		flagCategories[f] = "CESS"
 	}
 
-	for _, f := range []string{"no-implicit-dir", "stat-cache-ttl", "type-cache-ttl", "http-timeout"} {
+	for _, f := range []string{"region", "profile", "subdomain", "storage-class"} {
+		flagCategories[f] = "S3"
+	}
+
+	for _, f := range []string{"no-implicit-dir", "stat-cache-ttl", "type-cache-ttl", "negative-cache-ttl", "http-timeout", "retries", "metrics-addr", "staging-dir", "staging-limit-mb", "durable-fsync", "cache-dir", "cache-size-mb", "readahead-min-mb", "readahead-max-mb", "readahead-chunk-mb", "small-file-kb", "small-file-cache-mb", "writeback-cache", "page-cache", "max-inodes", "stable-inodes", "metadata-snapshot", "metadata-snapshot-interval", "poll-interval", "poll-prefix", "journal-dir"} {
 		flagCategories[f] = "tuning"
 	}
 
-	for _, f := range []string{"help, h", "debug_fuse", "version, v"} {
+	for _, f := range []string{"help, h", "debug_fuse", "debug-faults", "version, v"} {
 		flagCategories[f] = "misc"
 	}
 
 	cli.HelpPrinter = func(w io.Writer, templ string, data interface{}) {
 		w = tabwriter.NewWriter(w, 1, 8, 2, ' ', 0)
 		var tmplGet = template.Must(template.New("help").Funcs(funcMap).Parse(templ))
-		tmplGet.Execute(w, app)
+		tmplGet.Execute(w, data)
 	}
 
 	return
@@ -207,6 +429,34 @@ func parseOptions(m map[string]string, s string) {
 // PopulateFlags adds the flags accepted by run to the supplied flag set, returning the
 // variables into which the flags will parse.
 func PopulateFlags(c *cli.Context) *fs.Flags {
+	flags := newFlags(c)
+
+	switch c.NArg() {
+	case 1:
+		flags.MountPointArg = c.Args()[0]
+	case 2:
+		flags.Bucket, flags.Prefix = parseBucketSpec(c.Args()[0])
+		flags.MountPointArg = c.Args()[1]
+	default:
+		return nil
+	}
+	flags.MountPoint = flags.MountPointArg
+
+	return flags
+}
+
+func megabytes32(mb int) uint32 {
+	if mb <= 0 {
+		return 0
+	}
+	if mb >= 4096 {
+		return math.MaxUint32
+	}
+	return uint32(mb) * 1024 * 1024
+}
+
+// newFlags reads the options, without the bucket and mountpoint
+func newFlags(c *cli.Context) *fs.Flags {
 	flags := &fs.Flags{
 		// File system
 		MountOptions: make(map[string]string),
@@ -216,16 +466,45 @@ func PopulateFlags(c *cli.Context) *fs.Flags {
 		Gid:          uint32(c.Int("gid")),
 
 		// Tuning,
-		ExplicitDir:  c.Bool("no-implicit-dir"),
-		StatCacheTTL: c.Duration("stat-cache-ttl"),
-		TypeCacheTTL: c.Duration("type-cache-ttl"),
-		HTTPTimeout:  c.Duration("http-timeout"),
+		ExplicitDir:      c.Bool("no-implicit-dir"),
+		StatCacheTTL:     c.Duration("stat-cache-ttl"),
+		TypeCacheTTL:     c.Duration("type-cache-ttl"),
+		NegativeCacheTTL: c.Duration("negative-cache-ttl"),
+		HTTPTimeout:      c.Duration("http-timeout"),
+		Retries:          c.Int("retries"),
+		MetricsAddr:      c.String("metrics-addr"),
+		StagingDir:       c.String("staging-dir"),
+		StagingLimit:     uint64(c.Int("staging-limit-mb")) * 1024 * 1024,
+		DurableSync:      c.Bool("durable-fsync"),
+		JournalDir:       c.String("journal-dir"),
+		CacheDir:         c.String("cache-dir"),
+		CacheLimit:       uint64(c.Int("cache-size-mb")) * 1024 * 1024,
+
+		ReadAheadMin:   megabytes32(c.Int("readahead-min-mb")),
+		ReadAheadMax:   megabytes32(c.Int("readahead-max-mb")),
+		ReadAheadChunk: megabytes32(c.Int("readahead-chunk-mb")),
+
+		SmallFileSize:       uint64(c.Int("small-file-kb")) * 1024,
+		SmallFileCacheLimit: uint64(c.Int("small-file-cache-mb")) * 1024 * 1024,
+
+		WritebackCache: c.Bool("writeback-cache"),
+		PageCache:      c.String("page-cache"),
+		StableInodes:   c.Bool("stable-inodes"),
+		MaxInodes:      uint64(c.Int("max-inodes")),
+
+		MetadataSnapshot:         c.String("metadata-snapshot"),
+		MetadataSnapshotInterval: c.Duration("metadata-snapshot-interval"),
+
+		PollInterval: c.Duration("poll-interval"),
+		PollPrefixes: c.StringSlice("poll-prefix"),
 
 		// Common Backend Flags
+		Backend:        c.String("backend"),
 		UseContentType: c.Bool("use-content-type"),
 
 		// Debugging,
-		DebugFuse: c.Bool("debug_fuse"),
+		DebugFuse:   c.Bool("debug_fuse"),
+		DebugFaults: c.String("debug-faults"),
 	}
 
 	// Handle the repeated "-o" flag.
@@ -233,13 +512,5 @@ func PopulateFlags(c *cli.Context) *fs.Flags {
 		parseOptions(flags.MountOptions, o)
 	}
 
-	flags.MountPointArg = c.Args()[1]
-	flags.MountPoint = flags.MountPointArg
-
 	return flags
 }
-
-// TODO
-func ParseCESSConfig(c *fs.Flags) *storage.CessConfig {
-	return nil
-}
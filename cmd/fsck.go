@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/arvinsg/cess-fuse/pkg/fs"
+	"github.com/urfave/cli"
+)
+
+// fsckCommand finishes the directory renames that a crash interrupted,
+// the same recovery a mount does but without mounting. It takes the
+// global options, ex:
+//
+//	cess-fuse --backend cess --endpoint ... fsck [--rollback] bucket[:prefix]
+var fsckCommand = cli.Command{
+	Name:      "fsck",
+	Usage:     "Complete or roll back directory renames that were interrupted",
+	ArgsUsage: "[bucket[:prefix]]",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "rollback",
+			Usage: "Move the objects back to where they were before the rename instead",
+		},
+	},
+	Action: func(c *cli.Context) (err error) {
+		global := c.Parent()
+		flags := newFlags(global)
+		switch c.NArg() {
+		case 0:
+		case 1:
+			flags.Bucket, flags.Prefix = parseBucketSpec(c.Args()[0])
+		default:
+			return cli.ShowCommandHelp(global, c.Command.Name)
+		}
+		defer flags.Cleanup()
+
+		cloud, err := NewCloud(global, flags, nil)
+		if err != nil {
+			return
+		}
+
+		err = fs.Fsck(context.Background(), cloud, flags, c.Bool("rollback"))
+		if err != nil {
+			return
+		}
+		fmt.Fprintln(os.Stdout, "Rename journal is clean.")
+		return
+	},
+}
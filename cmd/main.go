@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -10,6 +12,8 @@ import (
 
 	"github.com/arvinsg/cess-fuse/pkg/fs"
 	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli"
 )
 
@@ -26,19 +30,50 @@ func main() {
 			cli.ShowAppHelp(c)
 			return
 		}
+		err = validateLimits(c)
+		if err != nil {
+			return
+		}
 
 		defer func() {
 			time.Sleep(time.Second)
 			flags.Cleanup()
 		}()
-		cloud, err := storage.NewCessStorage(ParseCESSConfig(flags))
+		var (
+			reg             *prometheus.Registry
+			metricsListener net.Listener
+		)
+		if flags.MetricsAddr != "" {
+			// opened before mounting, so that a bad address fails
+			// the mount instead of leaving it behind
+			metricsListener, err = net.Listen("tcp", flags.MetricsAddr)
+			if err != nil {
+				return fmt.Errorf("unable to serve metrics on %v: %v", flags.MetricsAddr, err)
+			}
+			reg = prometheus.NewRegistry()
+			reg.MustRegister(prometheus.NewGoCollector(),
+				prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+		}
+
+		cloud, err := NewCloud(c, flags, reg)
+		if err != nil {
+			return
+		}
+
+		fileSystem, mfs, err := fs.MountFS(context.Background(), cloud, flags)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "create cess storage fail, err: %v\n", err)
 			return
 		}
+		registerSigINTHandler(fileSystem, flags.MountPoint)
 
-		fs, mfs, err := fs.MountFS(context.Background(), cloud, flags)
-		registerSigINTHandler(fs, flags.MountPoint)
+		if reg != nil {
+			err = fileSystem.RegisterMetrics(reg)
+			if err != nil {
+				fs.TryUnmountFS(flags.MountPoint)
+				return
+			}
+			serveMetrics(metricsListener, reg)
+		}
 		fmt.Fprintln(os.Stdout, "File system has been successfully mounted.")
 
 		// Wait for the file system to be unmounted.
@@ -57,6 +92,16 @@ func main() {
 	}
 }
 
+// serveMetrics exposes reg on /metrics of l
+func serveMetrics(l net.Listener, reg *prometheus.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		err := http.Serve(l, mux)
+		fmt.Fprintf(os.Stderr, "metrics listener on %v stopped: %v\n", l.Addr(), err)
+	}()
+}
+
 func registerSigINTHandler(f *fs.FileSystem, mountPoint string) {
 	// Register for SIGINT.
 	signalChan := make(chan os.Signal, 1)
@@ -80,3 +125,78 @@ func registerSigINTHandler(f *fs.FileSystem, mountPoint string) {
 		}
 	}()
 }
+
+// NewCloud creates the backend and wraps it for fault injection, metrics
+// when reg is set and retries, then checks that it can be reached.
+func NewCloud(c *cli.Context, flags *fs.Flags, reg *prometheus.Registry) (cloud storage.ObjectBackend, err error) {
+	cloud, err = NewBackend(c, flags)
+	if err != nil {
+		return
+	}
+	if flags.DebugFaults != "" {
+		rules, seed, err := storage.ParseFaultRules(flags.DebugFaults)
+		if err != nil {
+			return nil, err
+		}
+		cloud = storage.NewFaultInjector(cloud, seed, rules...)
+	}
+
+	if reg != nil {
+		cloud, err = storage.NewObjectBackendMetricsWrapper(cloud, reg)
+		if err != nil {
+			return
+		}
+	}
+	if flags.Retries > 0 {
+		cloud = storage.NewObjectBackendRetryWrapper(cloud, storage.RetryConfig{
+			MaxRetries: flags.Retries,
+			Deadline:   flags.HTTPTimeout,
+		})
+	}
+
+	// fail early on a wrong endpoint or credentials instead of
+	// on the first file system operation
+	err = cloud.Init(fs.RandStringBytesMaskImprSrc(32))
+	return
+}
+
+// NewBackend creates the ObjectBackend selected by --backend.
+func NewBackend(c *cli.Context, flags *fs.Flags) (storage.ObjectBackend, error) {
+	switch flags.Backend {
+	case "cess":
+		config, err := ParseCESSConfig(c, flags)
+		if err != nil {
+			return nil, err
+		}
+
+		cloud, err := storage.NewCessStorage(config)
+		if err != nil {
+			return nil, fmt.Errorf("create cess storage fail, err: %v", err)
+		}
+		return cloud, nil
+	case "s3":
+		config, err := ParseS3Config(c, flags)
+		if err != nil {
+			return nil, err
+		}
+
+		cloud, err := storage.NewS3Storage(config)
+		if err != nil {
+			return nil, fmt.Errorf("create s3 storage fail, err: %v", err)
+		}
+		return cloud, nil
+	case "mem":
+		if flags.Bucket == "" {
+			flags.Bucket = "mem"
+		}
+		return storage.NewMemStorage(flags.Bucket), nil
+	case "posix":
+		if flags.Bucket == "" {
+			return nil, fmt.Errorf("posix backend needs a directory: " +
+				"--backend posix /path/to/dir[:prefix] mountpoint")
+		}
+		return storage.NewPosixStorage(flags.Bucket)
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expecting cess, s3, mem or posix", flags.Backend)
+	}
+}
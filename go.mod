@@ -3,15 +3,32 @@ module github.com/arvinsg/cess-fuse
 go 1.17
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/aws/aws-sdk-go v1.38.7
 	github.com/jacobsa/fuse v0.0.0-20201216155545-e0296dec955f
-	github.com/kr/pretty v0.1.1-0.20190720101428-71e7e4993750 // indirect
-	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/prometheus/client_golang v1.12.2
 	github.com/shirou/gopsutil v0.0.0-20190731134726-d80c43f9c984
-	github.com/sirupsen/logrus v1.4.3-0.20190807103436-de736cf91b92
+	github.com/sirupsen/logrus v1.6.0
 	github.com/urfave/cli v1.21.1-0.20190807111034-521735b7608a
-	golang.org/x/sys v0.0.0-20200930185726-fdedc70b468f
-	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	golang.org/x/sys v0.0.0-20220114195835-da31bd327af9
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/StackExchange/wmi v0.0.0-20180116203802-5d049714c4a6 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/go-ole/go-ole v1.2.1 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
+	github.com/kr/pretty v0.1.1-0.20190720101428-71e7e4993750 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.32.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	github.com/shirou/w32 v0.0.0-20160930032740-bb4de0191aa4 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
 )
 
-replace github.com/jacobsa/fuse => github.com/kahing/fusego v0.0.0-20200327063725-ca77844c7bcc
+replace github.com/jacobsa/fuse => ./third_party/fusego
@@ -0,0 +1,294 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// chmod, chown and utimes are kept in the object metadata under the same
+// names s3fs uses: mode is the decimal st_mode including the file type,
+// uid and gid are decimal and atime and mtime are seconds since the
+// epoch. Fractional seconds are written when there are any, the way
+// rclone does, and an octal mode with a leading 0 is accepted as well.
+const (
+	metaMode  = "mode"
+	metaUid   = "uid"
+	metaGid   = "gid"
+	metaAtime = "atime"
+	metaMtime = "mtime"
+
+	// the target of a symlink, the object holds it too
+	metaSymlink = "symlink"
+)
+
+func formatMetaMode(mode os.FileMode, isDir bool) string {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= syscall.S_ISVTX
+	}
+	if isDir {
+		m |= syscall.S_IFDIR
+	} else {
+		m |= syscall.S_IFREG
+	}
+	return strconv.FormatUint(uint64(m), 10)
+}
+
+// parseMetaMode returns the permission bits of a mode from the metadata
+func parseMetaMode(s string) (mode os.FileMode, err error) {
+	base := 10
+	if len(s) > 1 && s[0] == '0' {
+		base = 8
+	}
+	m, err := strconv.ParseUint(s, base, 32)
+	if err != nil {
+		return
+	}
+
+	mode = os.FileMode(m & 0777)
+	if m&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return
+}
+
+func formatMetaTime(t time.Time) string {
+	if t.Nanosecond() == 0 {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func parseMetaTime(s string) (t time.Time, err error) {
+	sec, frac := s, ""
+	if dot := strings.IndexByte(s, '.'); dot != -1 {
+		sec, frac = s[:dot], s[dot+1:]
+	}
+
+	secs, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return
+	}
+
+	var nsecs int64
+	if frac != "" {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		nsecs, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if err != nil {
+			return
+		}
+	}
+	return time.Unix(secs, nsecs), nil
+}
+
+// attrsFromMetadata sets the attributes stored in the object metadata,
+// values that are missing or can't be parsed fall back to the mount
+// defaults
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) attrsFromMetadata() {
+	attrs := &inode.Attributes
+	attrs.Mode, attrs.Uid, attrs.Gid, attrs.Atime, attrs.Utime = nil, nil, nil, nil, nil
+
+	for k, v := range inode.userMetadata {
+		var err error
+		switch k {
+		case metaMode:
+			var mode os.FileMode
+			if mode, err = parseMetaMode(string(v)); err == nil {
+				attrs.Mode = &mode
+			}
+		case metaUid, metaGid:
+			var id uint64
+			if id, err = strconv.ParseUint(string(v), 10, 32); err == nil {
+				id32 := uint32(id)
+				if k == metaUid {
+					attrs.Uid = &id32
+				} else {
+					attrs.Gid = &id32
+				}
+			}
+		case metaAtime, metaMtime:
+			var t time.Time
+			if t, err = parseMetaTime(string(v)); err == nil {
+				if k == metaAtime {
+					attrs.Atime = &t
+				} else {
+					attrs.Utime = &t
+				}
+			}
+		}
+		if err != nil {
+			inode.errFuse("invalid metadata", k, string(v))
+		}
+	}
+
+	if _, ok := inode.userMetadata[metaSymlink]; ok {
+		mode := os.ModeSymlink | 0777
+		attrs.Mode = &mode
+	}
+}
+
+// isSymlink is only as good as the metadata we have. Listings don't tell
+// symlinks from files, so one created elsewhere is a file until its
+// metadata is fetched, when the stat cache expires or when something
+// else needs it.
+func (inode *Inode) isSymlink() bool {
+	mode := inode.Attributes.Mode
+	return mode != nil && *mode&os.ModeSymlink != 0
+}
+
+// rememberSymlink records what the metadata of the object said, so
+// that listings of it can be told apart from files without a HEAD
+func (fs *FileSystem) rememberSymlink(key string, etag string, symlink bool) {
+	fs.symlinksMu.Lock()
+	defer fs.symlinksMu.Unlock()
+
+	if symlink {
+		fs.symlinks[key] = etag
+	} else {
+		delete(fs.symlinks, key)
+	}
+}
+
+func (fs *FileSystem) knownSymlink(key string, etag string) bool {
+	fs.symlinksMu.Lock()
+	defer fs.symlinksMu.Unlock()
+
+	known, ok := fs.symlinks[key]
+	return ok && known == etag
+}
+
+func (inode *Inode) ReadSymlink() (target string, err error) {
+	inode.logFuse("ReadSymlink")
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	err = inode.fillXattr()
+	if err != nil {
+		return
+	}
+
+	v, ok := inode.userMetadata[metaSymlink]
+	if !ok {
+		return "", syscall.EINVAL
+	}
+	return string(v), nil
+}
+
+// clearUtime forgets the mtime set by utimes once the data changes
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) clearUtime() {
+	delete(inode.userMetadata, metaMtime)
+	inode.Attributes.Utime = nil
+}
+
+// uploadMetadata is the metadata to write along with new content
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) uploadMetadata() map[string]*string {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if inode.userMetadata == nil {
+		return nil
+	}
+	return convertMetadata(inode.userMetadata)
+}
+
+// SetAttributes persists chmod, chown and utimes in the object metadata.
+// A file that hasn't been uploaded yet gets them on flush, an implicit
+// directory has nowhere to keep them so they only last until the inode
+// is forgotten.
+func (inode *Inode) SetAttributes(mode *os.FileMode, uid *uint32, gid *uint32,
+	atime *time.Time, mtime *time.Time) (err error) {
+
+	if mode == nil && uid == nil && gid == nil && atime == nil && mtime == nil {
+		return
+	}
+
+	inode.logFuse("SetAttributes", mode, uid, gid, atime, mtime)
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	err = inode.fillXattr()
+	if err != nil {
+		return
+	}
+
+	// the inode only takes the new values once they are stored
+	meta := make(map[string][]byte, len(inode.userMetadata)+5)
+	for k, v := range inode.userMetadata {
+		meta[k] = v
+	}
+	if mode != nil {
+		meta[metaMode] = []byte(formatMetaMode(*mode, inode.isDir()))
+	}
+	if uid != nil {
+		meta[metaUid] = []byte(strconv.FormatUint(uint64(*uid), 10))
+	}
+	if gid != nil {
+		meta[metaGid] = []byte(strconv.FormatUint(uint64(*gid), 10))
+	}
+	if atime != nil {
+		meta[metaAtime] = []byte(formatMetaTime(*atime))
+	}
+	if mtime != nil {
+		meta[metaMtime] = []byte(formatMetaTime(*mtime))
+	} else if _, ok := meta[metaMtime]; !ok && !inode.isDir() {
+		// updating the metadata rewrites the object, don't let
+		// chmod look like a change to the content
+		meta[metaMtime] = []byte(formatMetaTime(inode.Attributes.Mtime))
+	}
+
+	old := inode.userMetadata
+	inode.userMetadata = meta
+	// an unlinked file has no object left, ex: the kernel sets the
+	// mtime with writeback caching after the file was removed
+	if inode.Id != fuseops.RootInodeID && !inode.ImplicitDir && inode.Parent != nil &&
+		(inode.isDir() || inode.KnownSize != nil) {
+		err = inode.updateXattr()
+		if err != nil {
+			inode.userMetadata = old
+			return
+		}
+	}
+	inode.attrsFromMetadata()
+	return
+}
+
+// blobKey is the key of the object that holds the inode's metadata, for
+// a directory that's the directory blob
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) blobKey() (cloud storage.ObjectBackend, key string) {
+	cloud, key = inode.cloud()
+	if inode.isDir() && !cloud.Capabilities().DirBlob {
+		key += "/"
+	}
+	return
+}
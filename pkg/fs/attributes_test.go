@@ -0,0 +1,182 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestMetaMode(t *testing.T) {
+	for _, c := range []struct {
+		mode  os.FileMode
+		isDir bool
+		meta  string
+	}{
+		{0644, false, "33188"},
+		{0755, true, "16877"},
+		{0600 | os.ModeSetuid, false, "35200"},
+		{0777 | os.ModeSticky, true, "17407"},
+	} {
+		meta := formatMetaMode(c.mode, c.isDir)
+		if meta != c.meta {
+			t.Errorf("formatMetaMode(%v, %v) = %v, expecting %v", c.mode, c.isDir, meta, c.meta)
+		}
+		mode, err := parseMetaMode(meta)
+		if err != nil || mode != c.mode {
+			t.Errorf("parseMetaMode(%v) = %v, %v, expecting %v", meta, mode, err, c.mode)
+		}
+	}
+
+	// octal, the way some tools write it
+	if mode, err := parseMetaMode("0640"); err != nil || mode != 0640 {
+		t.Errorf("parseMetaMode(0640) = %v, %v", mode, err)
+	}
+}
+
+func TestMetaTime(t *testing.T) {
+	for _, c := range []struct {
+		meta     string
+		expected time.Time
+	}{
+		{"1600000000", time.Unix(1600000000, 0)},
+		{"1600000000.5", time.Unix(1600000000, 500000000)},
+		{"1600000000.000000001", time.Unix(1600000000, 1)},
+		{"1600000000.1234567891", time.Unix(1600000000, 123456789)},
+	} {
+		parsed, err := parseMetaTime(c.meta)
+		if err != nil || !parsed.Equal(c.expected) {
+			t.Errorf("parseMetaTime(%v) = %v, %v, expecting %v", c.meta, parsed, err, c.expected)
+		}
+	}
+
+	for _, s := range []string{"", "x", "1.x"} {
+		if _, err := parseMetaTime(s); err == nil {
+			t.Errorf("parseMetaTime(%q) succeeded", s)
+		}
+	}
+
+	now := time.Unix(1600000000, 250)
+	if parsed, _ := parseMetaTime(formatMetaTime(now)); !parsed.Equal(now) {
+		t.Errorf("%v doesn't round trip: %v", now, formatMetaTime(now))
+	}
+}
+
+func TestSetAttributes(t *testing.T) {
+	uid, gid := uint32(1234), uint32(5678)
+	atime := time.Unix(1500000000, 0)
+	mtime := time.Unix(1600000000, 123456789)
+
+	check := func(t *testing.T, what string, attrs fuseops.InodeAttributes, mode os.FileMode) {
+		t.Helper()
+		if attrs.Mode.Perm() != mode {
+			t.Errorf("mode of %v = %v, expecting %v", what, attrs.Mode, mode)
+		}
+		if attrs.Uid != uid || attrs.Gid != gid {
+			t.Errorf("owner of %v = %v:%v, expecting %v:%v", what, attrs.Uid, attrs.Gid, uid, gid)
+		}
+		if !attrs.Atime.Equal(atime) || !attrs.Mtime.Equal(mtime) {
+			t.Errorf("times of %v = %v %v, expecting %v %v", what, attrs.Atime, attrs.Mtime, atime, mtime)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		make func(fs *FileSystem) fuseops.InodeID
+		mode os.FileMode
+	}{
+		{"file", func(fs *FileSystem) fuseops.InodeID {
+			return createFile(t, fs, fuseops.RootInodeID, "file", "data")
+		}, 0600},
+		{"dir", func(fs *FileSystem) fuseops.InodeID {
+			return mkDir(t, fs, fuseops.RootInodeID, "file")
+		}, 0700},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fs := newTestFS(t, nil, nil)
+			id := c.make(fs)
+
+			mode := c.mode
+			op := &fuseops.SetInodeAttributesOp{
+				Inode: id, Mode: &mode, Uid: &uid, Gid: &gid, Atime: &atime, Mtime: &mtime,
+			}
+			err := fs.SetInodeAttributes(context.Background(), op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, "the inode", op.Attributes, mode)
+
+			// the next mount reads them back from the metadata
+			other := newTestFS(t, fs.cloud, nil)
+			id = mustLookUp(t, other, fuseops.RootInodeID, "file")
+			check(t, "the object", getAttributes(t, other, id), mode)
+
+			// a chmod alone keeps the rest
+			mode = 0640
+			op = &fuseops.SetInodeAttributesOp{Inode: id, Mode: &mode}
+			err = other.SetInodeAttributes(context.Background(), op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, "the object after chmod", op.Attributes, 0640)
+		})
+	}
+
+	t.Run("data", func(t *testing.T) {
+		fs := newTestFS(t, nil, nil)
+		id := createFile(t, fs, fuseops.RootInodeID, "file", "data")
+		mode := os.FileMode(0600)
+		err := fs.SetInodeAttributes(context.Background(), &fuseops.SetInodeAttributesOp{
+			Inode: id, Mode: &mode,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data := readFile(t, fs, id); data != "data" {
+			t.Errorf("read after chmod = %q", data)
+		}
+	})
+}
+
+// a metadata update that fails leaves the attributes as they were
+func TestSetAttributesFailure(t *testing.T) {
+	cloud := storage.NewFaultInjector(storage.NewMemStorage("test"), 0)
+	fs := newTestFS(t, cloud, nil)
+	id := createFile(t, fs, fuseops.RootInodeID, "file", "data")
+	before := getAttributes(t, fs, id)
+
+	cloud.AddRule(&storage.FaultRule{Method: "CopyBlob", Err: syscall.EIO})
+	mode := os.FileMode(0600)
+	uid := uint32(1234)
+	err := fs.SetInodeAttributes(context.Background(), &fuseops.SetInodeAttributesOp{
+		Inode: id, Mode: &mode, Uid: &uid,
+	})
+	if err == nil {
+		t.Fatal("chmod succeeded without a metadata update")
+	}
+
+	after := getAttributes(t, fs, id)
+	if after.Mode != before.Mode || after.Uid != before.Uid {
+		t.Errorf("attributes after a failed chmod = %v %v, expecting %v %v",
+			after.Mode, after.Uid, before.Mode, before.Uid)
+	}
+
+	// and the next attempt writes them all
+	cloud.ClearRules()
+	err = fs.SetInodeAttributes(context.Background(), &fuseops.SetInodeAttributesOp{
+		Inode: id, Mode: &mode,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestFS(t, cloud, nil)
+	attrs := getAttributes(t, other, mustLookUp(t, other, fuseops.RootInodeID, "file"))
+	if attrs.Mode.Perm() != 0600 || attrs.Uid != before.Uid {
+		t.Errorf("attributes of the object = %v %v, expecting %v %v",
+			attrs.Mode, attrs.Uid, os.FileMode(0600), before.Uid)
+	}
+}
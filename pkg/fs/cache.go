@@ -0,0 +1,340 @@
+package fs
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With --cache-dir, file data is kept on disk in blocks of
+// cacheBlockSize so that it's read from the backend once even across
+// mounts. The blocks of an object live in a directory named after the
+// bucket and key, and each block file is named after the ETag it was
+// read from, so a block of an object that was since replaced is never
+// used. Those are removed when LookUpInode sees the new ETag, or else
+// when they are the least recently used and the cache is full.
+//
+// Reads that are all in the cache are served from it, the others go
+// through readahead like without a cache and the blocks they cover are
+// written out in the background as they are completed.
+const cacheBlockSize = 1024 * 1024
+
+// the mtime of a block keeps the lru order across mounts, reads only
+// update it this often
+const cacheTouchInterval = time.Minute
+
+type DiskCache struct {
+	dir    string
+	bucket string
+	max    uint64
+
+	mu   sync.Mutex
+	used uint64
+	// least recently used at the back
+	lru    *list.List
+	blocks map[string]*list.Element
+}
+
+type cacheBlock struct {
+	path string
+	size uint64
+	// the mtime we last gave it
+	touched time.Time
+}
+
+// cacheFill is a block being put together from reads
+type cacheFill struct {
+	key   string
+	etag  string
+	block uint64
+	data  []byte
+}
+
+// NewDiskCache opens the cache in dir, keeping what a previous mount
+// left there. max is the size limit in bytes, 0 is unlimited.
+func NewDiskCache(dir string, bucket string, max uint64) (*DiskCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &DiskCache{
+		dir:    dir,
+		bucket: bucket,
+		max:    max,
+		lru:    list.New(),
+		blocks: make(map[string]*list.Element),
+	}
+
+	var blocks []cacheBlock
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".tmp-") {
+			// a block we were writing when we crashed
+			os.Remove(path)
+			return nil
+		}
+		blocks = append(blocks, cacheBlock{path, uint64(fi.Size()), fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the oldest go to the back of the list
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].touched.After(blocks[j].touched) })
+	for i := range blocks {
+		b := &blocks[i]
+		c.blocks[b.path] = c.lru.PushBack(b)
+		c.used += b.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+
+	log.Infof("disk cache %v has %v blocks, %v bytes", dir, c.lru.Len(), c.used)
+	return c, nil
+}
+
+func cacheHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// objectDir holds the blocks of key
+func (c *DiskCache) objectDir(key string) string {
+	h := cacheHash(c.bucket + "\x00" + key)
+	return filepath.Join(c.dir, h[:2], h)
+}
+
+func (c *DiskCache) blockPath(key string, etag string, block uint64) string {
+	return filepath.Join(c.objectDir(key), cacheHash(etag)[:32]+"."+strconv.FormatUint(block, 10))
+}
+
+// ReadAt copies the cached block of key at etag into p, starting at
+// offset within the block. ok is false if the block isn't cached.
+func (c *DiskCache) ReadAt(key string, etag string, block uint64, p []byte, offset int64) (n int, ok bool) {
+	path := c.blockPath(key, etag, block)
+
+	now := time.Now()
+	touch := false
+	c.mu.Lock()
+	e, ok := c.blocks[path]
+	if ok {
+		c.lru.MoveToFront(e)
+		b := e.Value.(*cacheBlock)
+		if now.Sub(b.touched) >= cacheTouchInterval {
+			b.touched = now
+			touch = true
+		}
+	}
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	f, err := os.Open(path)
+	if err == nil {
+		n, err = f.ReadAt(p, offset)
+		f.Close()
+		if n != 0 {
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Errorf("disk cache read %v: %v", path, err)
+		c.remove(path)
+		return 0, false
+	}
+
+	if touch {
+		os.Chtimes(path, now, now)
+	}
+	return n, true
+}
+
+// Put stores a block of key at etag. Errors are logged, the data is
+// still good to return.
+func (c *DiskCache) Put(key string, etag string, block uint64, data []byte) {
+	path := c.blockPath(key, etag, block)
+	size := uint64(len(data))
+	if c.max != 0 && size > c.max {
+		return
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		log.Errorf("disk cache write %v: %v", path, err)
+		return
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		log.Errorf("disk cache write %v: %v", path, err)
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		log.Errorf("disk cache write %v: %v", path, err)
+		os.Remove(f.Name())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.blocks[path]; ok {
+		// someone else read the same block at the same time
+		c.used -= e.Value.(*cacheBlock).size
+		c.lru.Remove(e)
+	}
+	c.blocks[path] = c.lru.PushFront(&cacheBlock{path, size, time.Now()})
+	c.used += size
+	c.evict()
+}
+
+// Invalidate drops the blocks of key that weren't read from etag, all of
+// them if etag is nil
+func (c *DiskCache) Invalidate(key string, etag *string) {
+	dir := c.objectDir(key)
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	var keep string
+	if etag != nil {
+		keep = cacheHash(*etag)[:32] + "."
+	}
+	for _, fi := range names {
+		if keep == "" || !strings.HasPrefix(fi.Name(), keep) {
+			c.remove(filepath.Join(dir, fi.Name()))
+		}
+	}
+	if keep == "" {
+		os.Remove(dir)
+	}
+}
+
+func (c *DiskCache) remove(path string) {
+	c.mu.Lock()
+	if e, ok := c.blocks[path]; ok {
+		c.used -= e.Value.(*cacheBlock).size
+		c.lru.Remove(e)
+		delete(c.blocks, path)
+	}
+	c.mu.Unlock()
+
+	os.Remove(path)
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *DiskCache) evict() {
+	for c.max != 0 && c.used > c.max && c.lru.Len() > 1 {
+		b := c.lru.Remove(c.lru.Back()).(*cacheBlock)
+		delete(c.blocks, b.path)
+		c.used -= b.size
+		os.Remove(b.path)
+	}
+}
+
+// cacheETag is the key and ETag to cache the reads of fh under, ok is
+// false if they can't be cached, ex: because the file is being written.
+// The key is the inode's current one, which is what invalidation goes
+// by, not the one the handle was opened with.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) cacheETag() (key string, etag string, size uint64, ok bool) {
+	fh.inode.mu.Lock()
+	v, hasETag := fh.inode.sysMetadata["etag"]
+	size = fh.inode.Attributes.Size
+	_, key = fh.inode.cloud()
+	fh.inode.mu.Unlock()
+	if !hasETag || fh.dirty {
+		return
+	}
+	return key, string(v), size, true
+}
+
+// readCached reads from the disk cache, ok is false unless every block
+// of the read is there
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) readCached(key string, etag string, size uint64, offset int64, buf []byte) (bytesRead int, ok bool) {
+	cache := fh.inode.fs.cache
+
+	end := MinUInt64(uint64(offset)+uint64(len(buf)), size)
+	if uint64(offset) >= end {
+		return
+	}
+	for off := uint64(offset); off < end; {
+		p := buf[bytesRead : end-uint64(offset)]
+		n, hit := cache.ReadAt(key, etag, off/cacheBlockSize, p, int64(off%cacheBlockSize))
+		if !hit || n == 0 {
+			return 0, false
+		}
+		bytesRead += n
+		off += uint64(n)
+	}
+	readBytes.WithLabelValues("cache").Add(float64(bytesRead))
+	return bytesRead, true
+}
+
+// fillCache adds data, read at offset, to the block being put together
+// and has the block written once it's complete, without holding up the
+// read. A read that doesn't carry on from the last one is only used from
+// the next block on.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) fillCache(key string, etag string, size uint64, offset int64, data []byte) {
+	off := uint64(offset)
+	for len(data) != 0 && off < size {
+		f := fh.cacheFill
+		if f == nil || f.key != key || f.etag != etag ||
+			f.block*cacheBlockSize+uint64(len(f.data)) != off {
+			fh.cacheFill = nil
+			if skip := off % cacheBlockSize; skip != 0 {
+				skip = MinUInt64(cacheBlockSize-skip, uint64(len(data)))
+				off += skip
+				data = data[skip:]
+				continue
+			}
+			f = &cacheFill{key: key, etag: etag, block: off / cacheBlockSize}
+			fh.cacheFill = f
+		}
+
+		blockEnd := MinUInt64((f.block+1)*cacheBlockSize, size)
+		if f.data == nil {
+			f.data = make([]byte, 0, blockEnd-f.block*cacheBlockSize)
+		}
+		n := MinUInt64(blockEnd-off, uint64(len(data)))
+		f.data = append(f.data, data[:n]...)
+		off += n
+		data = data[n:]
+
+		if off == blockEnd {
+			// f.data is the block's own, nothing else touches it
+			go fh.inode.fs.cache.Put(key, etag, f.block, f.data)
+			fh.cacheFill = nil
+		}
+	}
+}
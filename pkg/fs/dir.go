@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
 	"strings"
@@ -27,6 +28,8 @@ type DirInodeData struct {
 	DirTime         time.Time
 
 	Children []*Inode
+	// names that weren't found and until when, see addNegative
+	negatives map[string]time.Time
 }
 
 type DirHandleEntry struct {
@@ -542,6 +545,7 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 			// So this is a stale entry that should be removed.
 			childTmp.Parent = nil
 			parent.removeChildUnlocked(childTmp)
+			fs.notifyEntry(parent.Id, *childTmp.Name)
 		} else {
 			// Found a non-stale child inode.
 			child = childTmp
@@ -563,6 +567,8 @@ func (dh *DirHandle) ReadDir(offset fuseops.DirOffset) (en *DirHandleEntry, err
 	}
 	if child.isDir() {
 		en.Type = fuseutil.DT_Directory
+	} else if child.isSymlink() {
+		en.Type = fuseutil.DT_Link
 	} else {
 		en.Type = fuseutil.DT_File
 	}
@@ -577,12 +583,29 @@ func (dh *DirHandle) CloseDir() error {
 	return nil
 }
 
+// DeleteBlobs is capped to 1000 keys on aws
+const maxDeleteBlobs = 1000
+
+// renameChildren moves everything under prefix to newPrefix, one listing
+// page at a time: the page is copied with up to fs.replicators copies in
+// flight and then deleted. If a copy fails the copies made for that page
+// are deleted again, so every object is in exactly one of the two places
+// and renaming the rest later picks up where this left off.
+//
 // prefix and newPrefix should include the trailing /
-// return all the renamed objects
 func (dir *Inode) renameChildren(cloud storage.ObjectBackend, prefix string,
 	newParent *Inode, newPrefix string) (err error) {
-	var copied []string
 	var res *storage.ListBlobsOutput
+	var moved int
+
+	defer func() {
+		if err != nil && moved != 0 {
+			log.Errorf("rename %v to %v failed after moving %v objects: %v",
+				prefix, newPrefix, moved, err)
+		} else if moved > maxDeleteBlobs {
+			log.Infof("rename %v to %v moved %v objects", prefix, newPrefix, moved)
+		}
+	}()
 
 	for {
 		param := storage.ListBlobsInput{
@@ -603,49 +626,106 @@ func (dir *Inode) renameChildren(cloud storage.ObjectBackend, prefix string,
 			return
 		}
 
-		if copied == nil {
-			copied = make([]string, 0, len(res.Items))
+		err = dir.renamePage(cloud, prefix, newPrefix, res.Items)
+		if err != nil {
+			return
 		}
+		moved += len(res.Items)
 
-		// after the server side copy, we want to delete all the files
-		// using multi-delete, which is capped to 1000 on aws. If we
-		// are going to make an arbitrary limit that sounds like a
-		// good one (and we want to have an arbitrary limit because we
-		// don't want to rename a million objects here)
-		total := len(copied) + len(res.Items)
-		if total > 1000 || total == 1000 && res.IsTruncated {
-			return syscall.E2BIG
+		if !res.IsTruncated {
+			break
 		}
+		log.Infof("rename %v to %v: moved %v objects so far", prefix, newPrefix, moved)
+	}
 
-		// say dir is "/a/dir" and it has "1", "2", "3", and we are
-		// moving it to "/b/" items will be a/dir/1, a/dir/2, a/dir/3,
-		// and we will copy them to b/1, b/2, b/3 respectively
-		for _, i := range res.Items {
-			key := (*i.Key)[len(prefix):]
-
-			// TODO: coordinate with underlining copy and do this in parallel
-			_, err = cloud.CopyBlob(&storage.CopyBlobInput{
-				Source:       *i.Key,
-				Destination:  newPrefix + key,
-				Size:         &i.Size,
-				ETag:         i.ETag,
-				StorageClass: i.StorageClass,
+	return
+}
+
+// renamePage copies items to newPrefix and deletes them, or deletes the
+// copies again if one of them fails
+func (dir *Inode) renamePage(cloud storage.ObjectBackend, prefix string, newPrefix string,
+	items []storage.BlobItemOutput) (err error) {
+	fs := dir.fs
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sources := make([]string, 0, len(items))
+	copied := make([]string, 0, len(items))
+
+	// say dir is "/a/dir" and it has "1", "2", "3", and we are
+	// moving it to "/b/" items will be a/dir/1, a/dir/2, a/dir/3,
+	// and we will copy them to b/1, b/2, b/3 respectively
+	for i := range items {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+
+		item := &items[i]
+		dest := newPrefix + (*item.Key)[len(prefix):]
+
+		fs.replicators.Take(1, true)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer fs.replicators.Return(1)
+
+			_, err := cloud.CopyBlob(&storage.CopyBlobInput{
+				Source:       *item.Key,
+				Destination:  dest,
+				Size:         &item.Size,
+				ETag:         item.ETag,
+				StorageClass: item.StorageClass,
 			})
+
+			mu.Lock()
+			defer mu.Unlock()
 			if err != nil {
-				return err
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
 			}
+			sources = append(sources, *item.Key)
+			copied = append(copied, dest)
+		}()
+	}
+	wg.Wait()
 
-			copied = append(copied, *i.Key)
+	if firstErr != nil {
+		log.Errorf("rename %v to %v: copy failed, deleting %v copies: %v",
+			prefix, newPrefix, len(copied), firstErr)
+		if err := deleteBlobs(cloud, copied); err != nil {
+			log.Errorf("rename %v to %v: could not delete copies, objects are in both places: %v",
+				prefix, newPrefix, err)
 		}
+		return firstErr
+	}
 
-		if !res.IsTruncated {
-			break
-		}
+	log.Debugf("rename copied %v", sources)
+	err = deleteBlobs(cloud, sources)
+	if err != nil {
+		log.Errorf("rename %v to %v: could not delete the originals, objects are in both places: %v",
+			prefix, newPrefix, err)
 	}
+	return
+}
 
-	log.Debugf("rename copied %v", copied)
-	_, err = cloud.DeleteBlobs(&storage.DeleteBlobsInput{Items: copied})
-	return err
+func deleteBlobs(cloud storage.ObjectBackend, keys []string) (err error) {
+	for len(keys) != 0 {
+		n := MinInt(len(keys), maxDeleteBlobs)
+		_, err = cloud.DeleteBlobs(&storage.DeleteBlobsInput{Items: keys[:n]})
+		if err != nil {
+			return
+		}
+		keys = keys[n:]
+	}
+	return
 }
 
 // Recursively resets the DirTime for child directories.
@@ -798,6 +878,8 @@ func (parent *Inode) insertChild(inode *Inode) {
 }
 
 func (parent *Inode) insertChildUnlocked(inode *Inode) {
+	delete(parent.dir.negatives, *inode.Name)
+
 	l := len(parent.dir.Children)
 	if l == 0 {
 		parent.dir.Children = []*Inode{inode}
@@ -921,6 +1003,51 @@ func (parent *Inode) MkDir(name string) (inode *Inode, err error) {
 	return
 }
 
+// CreateSymlink stores a symlink as an object holding the target, the
+// metadata marker is what makes it a symlink
+func (parent *Inode) CreateSymlink(name string, target string) (inode *Inode, err error) {
+	parent.logFuse("CreateSymlink", name, target)
+	fs := parent.fs
+
+	cloud, key := parent.cloud()
+	key = appendChildName(key, name)
+
+	metadata := map[string][]byte{metaSymlink: []byte(target)}
+	resp, err := cloud.PutBlob(&storage.PutBlobInput{
+		Key:      key,
+		Metadata: convertMetadata(metadata),
+		Body:     bytes.NewReader([]byte(target)),
+		Size:     PUInt64(uint64(len(target))),
+	})
+	if err != nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	inode = NewInode(fs, parent, &name)
+	size := uint64(len(target))
+	inode.Attributes.Size = size
+	inode.KnownSize = &size
+	inode.touch()
+	if resp.LastModified != nil {
+		inode.Attributes.Mtime = *resp.LastModified
+	}
+	if resp.ETag != nil {
+		inode.sysMetadata["etag"] = []byte(*resp.ETag)
+		inode.knownETag = resp.ETag
+		fs.rememberSymlink(key, *resp.ETag, true)
+	}
+	inode.userMetadata = metadata
+	inode.attrsFromMetadata()
+
+	if parent.Attributes.Mtime.Before(inode.Attributes.Mtime) {
+		parent.Attributes.Mtime = inode.Attributes.Mtime
+	}
+	return
+}
+
 func appendChildName(parent, child string) string {
 	if len(parent) != 0 {
 		parent += "/"
@@ -1059,8 +1186,24 @@ func (parent *Inode) Rename(from string, newParent *Inode, to string) (err error
 	}
 
 	if renameChildren && !fromCloud.Capabilities().DirBlob {
+		var entry *renameEntry
+		if fs.journal != nil {
+			entry, err = fs.journal.begin(fromFullName, toFullName)
+			if err != nil {
+				parent.errFuse("unable to journal rename", fromFullName, toFullName, err)
+				return syscall.EIO
+			}
+		}
+
 		err = parent.renameChildren(fromCloud, fromFullName,
 			newParent, toFullName)
+		if entry != nil {
+			if err == nil {
+				fs.journal.end(entry)
+			} else {
+				fs.journal.abandon(entry)
+			}
+		}
 		if err != nil {
 			return
 		}
@@ -1238,6 +1381,8 @@ func (parent *Inode) readDirFromCache(offset fuseops.DirOffset) (en *DirHandleEn
 		}
 		if child.isDir() {
 			en.Type = fuseutil.DT_Directory
+		} else if child.isSymlink() {
+			en.Type = fuseutil.DT_Link
 		} else {
 			en.Type = fuseutil.DT_File
 		}
@@ -1289,6 +1434,9 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 
 	checking := 3
 	var checkErr [3]error
+	// a dir blob found by the listing, waiting for its HEAD which
+	// has the metadata
+	var listed *Inode
 
 	cloud, _ := parent.cloud()
 	if cloud == nil {
@@ -1339,7 +1487,10 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 					if entry.StorageClass != nil {
 						inode.sysMetadata["storage-class"] = []byte(*entry.StorageClass)
 					}
-
+					if checkErr[1] == nil {
+						listed, inode = inode, nil
+						continue
+					}
 				}
 				return
 			} else {
@@ -1351,6 +1502,9 @@ func (parent *Inode) LookUpInodeMaybeDir(name string, fullName string) (inode *I
 			checkErr[2] = err
 			log.Debugf("LIST %v/ = %v", fullName, err)
 		case err = <-errDirBlobChan:
+			if listed != nil {
+				return listed, nil
+			}
 			checking--
 			checkErr[1] = err
 			log.Debugf("HEAD %v/ = %v", fullName, err)
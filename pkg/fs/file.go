@@ -14,7 +14,9 @@ import (
 	"github.com/jacobsa/fuse/fuseops"
 )
 
+// defaults of the readahead tunables, see Flags
 const (
+	MinReadHead   = uint32(1 * 1024 * 1024)
 	MaxReadHead   = uint32(400 * 1024 * 1024)
 	ReadHeadChunk = uint32(20 * 1024 * 1024)
 )
@@ -39,6 +41,12 @@ type FileHandle struct {
 
 	lastWriteError error
 
+	// set once the handle writes out of order, see startStaging
+	stage *stagingFile
+	// size of the object committed by SyncFile, writing there picks
+	// up where the handle left off, see resumeAfterSync
+	resumeOffset int64
+
 	// read
 	reader        io.ReadCloser
 	readBufOffset int64
@@ -48,6 +56,10 @@ type FileHandle struct {
 	existingReadahead int
 	seqReadAmount     uint64
 	numOOORead        uint64 // number of out of order read
+	// how far to read ahead, 0 until a sequential streak of
+	// ReadAheadMin. It doubles every time a buffer is used up and
+	// shrinks on out of order reads, see readAheadWindow
+	readAheadWindow uint32
 	// User space PID. All threads created by a process will have the same TGID,
 	// but different PIDs[1].
 	// This value can be nil if we fail to get TGID from PID[2].
@@ -56,6 +68,9 @@ type FileHandle struct {
 	Tgid *int32
 
 	keepPageCache bool // the same value we returned to OpenFile
+
+	// the --cache-dir block being read, see fillCache
+	cacheFill *cacheFill
 }
 
 // NewFileHandle returns a new file handle for the given `inode` triggered by fuse
@@ -88,6 +103,7 @@ func (fh *FileHandle) initMPU() {
 	fh.mpuName = &fh.key
 	resp, err := fh.cloud.MultipartBlobBegin(&storage.MultipartBlobBeginInput{
 		Key:         *fh.mpuName,
+		Metadata:    fh.inode.uploadMetadata(),
 		ContentType: fs.flags.GetMimeType(*fh.mpuName),
 	})
 
@@ -228,10 +244,31 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte) (err error) {
 		return fh.lastWriteError
 	}
 
-	if offset != fh.nextWriteOffset {
-		fh.inode.errFuse("WriteFile: only sequential writes supported", fh.nextWriteOffset, offset)
-		fh.lastWriteError = syscall.ENOTSUP
-		return fh.lastWriteError
+	if fh.resumeOffset != 0 {
+		if offset == fh.resumeOffset && fh.stage == nil && !fh.dirty {
+			err = fh.resumeAfterSync()
+			if err != nil {
+				return
+			}
+		}
+		fh.resumeOffset = 0
+	}
+
+	if fh.stage == nil && offset != fh.nextWriteOffset {
+		if fh.inode.fs.staging == nil {
+			fh.inode.errFuse("WriteFile: only sequential writes supported", fh.nextWriteOffset, offset)
+			fh.lastWriteError = syscall.ENOTSUP
+			return fh.lastWriteError
+		}
+
+		err = fh.startStaging()
+		if err != nil {
+			return
+		}
+	}
+
+	if fh.stage != nil {
+		return fh.writeStaged(offset, data)
 	}
 
 	if offset == 0 {
@@ -247,6 +284,7 @@ func (fh *FileHandle) WriteFile(offset int64, data []byte) (err error) {
 		// Goofys.OpenFile about KeepPageCache
 		fh.inode.knownETag = nil
 		fh.inode.invalidateCache = false
+		fh.inode.clearUtime()
 		fh.inode.mu.Unlock()
 	}
 
@@ -284,14 +322,15 @@ func (fh *FileHandle) readAhead(offset uint64, needAtLeast int) (err error) {
 		existingReadahead += b.size
 	}
 
-	readAheadAmount := MaxReadHead
+	readAheadAmount := fh.readAheadWindow
+	chunk := MinUInt32(fh.inode.fs.flags.ReadAheadChunk, readAheadAmount)
 
-	for readAheadAmount-existingReadahead >= ReadHeadChunk {
+	for existingReadahead+chunk <= readAheadAmount {
 		off := offset + uint64(existingReadahead)
 		remaining := fh.inode.Attributes.Size - off
 
 		// only read up to readahead chunk each time
-		size := MinUInt32(readAheadAmount-existingReadahead, ReadHeadChunk)
+		size := MinUInt32(readAheadAmount-existingReadahead, chunk)
 		// but don't read past the file
 		size = uint32(MinUInt64(uint64(size), remaining))
 
@@ -302,6 +341,7 @@ func (fh *FileHandle) readAhead(offset uint64, needAtLeast int) (err error) {
 			if readAheadBuf != nil {
 				fh.buffers = append(fh.buffers, readAheadBuf)
 				existingReadahead += size
+				readaheadFetched.Add(float64(size))
 			} else {
 				if existingReadahead != 0 {
 					// don't do more readahead now, but don't fail, cross our
@@ -314,7 +354,7 @@ func (fh *FileHandle) readAhead(offset uint64, needAtLeast int) (err error) {
 			}
 		}
 
-		if size != ReadHeadChunk {
+		if size != chunk {
 			// that was the last remaining chunk to readahead
 			break
 		}
@@ -338,6 +378,53 @@ func (fh *FileHandle) ReadFile(offset int64, buf []byte) (bytesRead int, err err
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
+	if fh.stage == nil && fh.dirty && fh.inode.fs.staging != nil {
+		// what we wrote so far isn't in the backend yet, ex: the
+		// kernel filling in a page around a partial write with
+		// writeback caching
+		err = fh.startStaging()
+		if err != nil {
+			return
+		}
+	}
+
+	if fh.stage != nil {
+		bytesRead, err = fh.stage.ReadAt(fh, buf, offset)
+		return
+	}
+
+	if fh.inode.fs.smallFiles != nil {
+		var ok bool
+		bytesRead, ok = fh.readSmallFile(offset, buf)
+		if ok {
+			return
+		}
+	}
+
+	var key, etag string
+	var size uint64
+	var cacheable bool
+	if fh.inode.fs.cache != nil {
+		key, etag, size, cacheable = fh.cacheETag()
+	}
+	if cacheable {
+		if fh.readBufOffset != offset {
+			fh.seekRead(offset)
+		}
+		// what readahead already fetches for this offset is read
+		// from there, a hit moves the read position on like any
+		// other read so the next miss carries on the streak
+		if len(fh.buffers) == 0 && fh.reader == nil {
+			var ok bool
+			bytesRead, ok = fh.readCached(key, etag, size, offset, buf)
+			if ok {
+				fh.readBufOffset += int64(bytesRead)
+				fh.seqReadAmount += uint64(bytesRead)
+				return
+			}
+		}
+	}
+
 	nwant := len(buf)
 	var nread int
 
@@ -348,6 +435,9 @@ func (fh *FileHandle) ReadFile(offset int64, buf []byte) (bytesRead int, err err
 		}
 	}
 
+	if cacheable {
+		fh.fillCache(key, etag, size, offset, buf[:bytesRead])
+	}
 	return
 }
 
@@ -380,28 +470,14 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 	}
 
 	if fh.readBufOffset != offset {
-		// XXX out of order read, maybe disable prefetching
-		fh.inode.logFuse("out of order read", offset, fh.readBufOffset)
-
-		fh.readBufOffset = offset
-		fh.seqReadAmount = 0
-		if fh.reader != nil {
-			fh.reader.Close()
-			fh.reader = nil
-		}
-
-		if fh.buffers != nil {
-			// we misdetected
-			fh.numOOORead++
-		}
+		fh.seekRead(offset)
+	}
 
-		for _, b := range fh.buffers {
-			b.buf.Close()
-		}
-		fh.buffers = nil
+	if fh.readAheadWindow == 0 && fh.seqReadAmount >= uint64(fs.flags.ReadAheadMin) {
+		fh.readAheadWindow = fs.flags.ReadAheadMin
 	}
 
-	if fh.seqReadAmount >= uint64(ReadHeadChunk) && fh.numOOORead < 3 {
+	if fh.readAheadWindow != 0 {
 		if fh.reader != nil {
 			fh.inode.logFuse("cutover to the parallel algorithm")
 			fh.reader.Close()
@@ -411,29 +487,50 @@ func (fh *FileHandle) readFile(offset int64, buf []byte) (bytesRead int, err err
 		err = fh.readAhead(uint64(offset), len(buf))
 		if err == nil {
 			bytesRead, err = fh.readFromReadAhead(uint64(offset), buf)
+			readBytes.WithLabelValues("readahead").Add(float64(bytesRead))
 			return
 		} else {
 			// fall back to read serially
 			fh.inode.logFuse("not enough memory, fallback to serial read")
 			fh.seqReadAmount = 0
-			for _, b := range fh.buffers {
-				b.buf.Close()
-			}
-			fh.buffers = nil
+			fh.readAheadWindow = 0
+			fh.discardReadAhead()
 		}
 	}
 
 	bytesRead, err = fh.readFromStream(offset, buf)
+	readBytes.WithLabelValues("stream").Add(float64(bytesRead))
 
 	return
 }
 
+// seekRead moves the read position to offset, dropping what was read
+// ahead of the old one
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) seekRead(offset int64) {
+	fh.inode.logFuse("out of order read", offset, fh.readBufOffset)
+
+	fh.readBufOffset = offset
+	fh.seqReadAmount = 0
+	fh.numOOORead++
+	if fh.reader != nil {
+		fh.reader.Close()
+		fh.reader = nil
+	}
+
+	fh.shrinkReadAhead()
+	fh.discardReadAhead()
+}
+
 func (fh *FileHandle) Release() {
-	// read buffers
-	for _, b := range fh.buffers {
-		b.buf.Close()
+	if fh.stage != nil {
+		fh.stage.Close()
+		fh.stage = nil
 	}
-	fh.buffers = nil
+
+	// read buffers
+	fh.discardReadAhead()
 
 	if fh.reader != nil {
 		fh.reader.Close()
@@ -476,6 +573,7 @@ func (fh *FileHandle) readFromStream(offset int64, buf []byte) (bytesRead int, e
 		resp, err := fh.cloud.GetBlob(&storage.GetBlobInput{
 			Key:   fh.key,
 			Start: uint64(offset),
+			Count: fh.streamCount(uint64(offset), len(buf)),
 		})
 		if err != nil {
 			return bytesRead, err
@@ -517,6 +615,7 @@ func (fh *FileHandle) flushSmallFile() (err error) {
 	_, key := fh.inode.cloud()
 	resp, err := fh.cloud.PutBlob(&storage.PutBlobInput{
 		Key:         key,
+		Metadata:    fh.inode.uploadMetadata(),
 		Body:        buf,
 		Size:        PUInt64(uint64(buf.Len())),
 		ContentType: fs.flags.GetMimeType(*fh.inode.FullName()),
@@ -569,6 +668,14 @@ func (fh *FileHandle) FlushFile() (err error) {
 
 	fh.inode.logFuse("FlushFile")
 
+	if fh.stage != nil {
+		return fh.flushStaged()
+	}
+	return fh.flushLocked()
+}
+
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) flushLocked() (err error) {
 	if !fh.dirty || fh.lastWriteError != nil {
 		if fh.lastWriteError != nil {
 			err = fh.lastWriteError
@@ -695,6 +802,7 @@ func (fh *FileHandle) readFromReadAhead(offset uint64, buf []byte) (bytesRead in
 			// we've exhausted the first buffer
 			readAheadBuf.buf.Close()
 			fh.buffers = fh.buffers[1:]
+			fh.growReadAhead()
 		}
 
 		buf = buf[nread:]
@@ -21,27 +21,102 @@ type Flags struct {
 	MountPointArg     string
 	MountPointCreated string
 
-	Cache    []string
 	DirMode  os.FileMode
 	FileMode os.FileMode
 	Uid      uint32
 	Gid      uint32
 
 	// Common Backend Flags
+	Backend        string
 	UseContentType bool
 	Endpoint       string
+	Bucket         string
+	// Prefix is the sub-tree of the bucket that is mounted, it is
+	// either empty or ends with a /
+	Prefix string
 
 	// Tuning
 	ExplicitDir  bool
 	StatCacheTTL time.Duration
 	TypeCacheTTL time.Duration
-	HTTPTimeout  time.Duration
+	// NegativeCacheTTL is how long a name that wasn't found is
+	// remembered not to exist, 0 disables it
+	NegativeCacheTTL time.Duration
+	HTTPTimeout      time.Duration
+	// MetricsAddr is where to serve Prometheus metrics, ex: :9100.
+	// Empty disables the listener.
+	MetricsAddr string
+	// Retries is how often a backend call that failed with a transient
+	// error is retried, 0 disables retrying
+	Retries int
+	// StagingDir holds local copies of files that are written out of
+	// order, empty disables random writes
+	StagingDir string
+	// StagingLimit caps the bytes kept in StagingDir, 0 is unlimited
+	StagingLimit uint64
+	// DurableSync makes fsync commit what was written so far instead
+	// of waiting for close
+	DurableSync bool
+	// JournalDir is where directory renames are recorded until they
+	// finish, empty disables the journal
+	JournalDir string
+	// CacheDir keeps file data read from the backend across mounts,
+	// empty disables the disk cache
+	CacheDir string
+	// CacheLimit caps the bytes kept in CacheDir, 0 is unlimited
+	CacheLimit uint64
+	// ReadAheadMin is the sequential streak that turns readahead on
+	// and the window it starts with, ReadAheadMax the most it grows
+	// to and ReadAheadChunk the size of one request
+	ReadAheadMin   uint32
+	ReadAheadMax   uint32
+	ReadAheadChunk uint32
+	// files up to SmallFileSize are read whole on open and kept in
+	// memory, up to SmallFileCacheLimit bytes of them
+	SmallFileSize       uint64
+	SmallFileCacheLimit uint64
+	// WritebackCache lets the kernel buffer writes and send them in
+	// bigger batches, possibly out of order, so it needs StagingDir
+	WritebackCache bool
+	// MaxInodes is how many inodes to keep before the least recently
+	// used unreferenced files are dropped, 0 is unlimited
+	MaxInodes uint64
+	// StableInodes derives inode numbers from the object keys instead
+	// of counting up, so that they stay the same across lookups and
+	// mounts
+	StableInodes bool
+	// MetadataSnapshot is where the directory tree is saved every
+	// MetadataSnapshotInterval and at unmount, and loaded from at
+	// mount, empty disables it. An interval of 0 only saves it at
+	// unmount.
+	MetadataSnapshot         string
+	MetadataSnapshotInterval time.Duration
+	// PollInterval is how often PollPrefixes, directories relative to
+	// the mount, are listed to find objects changed by others. 0
+	// disables polling, no PollPrefixes polls the whole mount.
+	PollInterval time.Duration
+	PollPrefixes []string
+	// PageCache is when the kernel may keep file data it read before,
+	// one of PageCacheNone, PageCacheKeep or PageCacheAuto
+	PageCache string
 
 	// Debugging
 	DebugFuse  bool
 	Foreground bool
+	// DebugFaults are storage.ParseFaultRules rules to inject backend
+	// failures with
+	DebugFaults string
 }
 
+const (
+	// drop the page cache every time a file is opened
+	PageCacheNone = "none"
+	// keep it, even if the object changed in the backend
+	PageCacheKeep = "keep"
+	// keep it unless the file's attributes or ETag changed since
+	PageCacheAuto = "auto"
+)
+
 func (c *Flags) GetMimeType(fileName string) (retMime *string) {
 	if !c.UseContentType {
 		return nil
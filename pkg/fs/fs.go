@@ -2,9 +2,10 @@ package fs
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
-	"net/http"
 	"net/url"
 	"runtime/debug"
 	"strings"
@@ -42,7 +43,8 @@ type FileSystem struct {
 
 	// The next inode ID to hand out. We assume that this will never overflow,
 	// since even if we were handing out inode IDs at 4 GHz, it would still take
-	// over a century to do so.
+	// over a century to do so. Unused with --stable-inodes, see
+	// stableInodeId.
 	//
 	// GUARDED_BY(mu)
 	nextInodeID fuseops.InodeID
@@ -50,7 +52,8 @@ type FileSystem struct {
 	// The collection of live inodes, keyed by inode ID. No ID less than
 	// fuseops.RootInodeID is ever used.
 	//
-	// INVARIANT: For all keys k, fuseops.RootInodeID <= k < nextInodeID
+	// INVARIANT: For all keys k, fuseops.RootInodeID <= k
+	// INVARIANT: For all keys k, k < nextInodeID unless flags.StableInodes
 	// INVARIANT: For all keys k, inodes[k].ID() == k
 	// INVARIANT: inodes[fuseops.RootInodeID] is missing or of type inode.DirInode
 	// INVARIANT: For all v, if IsDirName(v.Name()) then v is inode.DirInode
@@ -66,15 +69,35 @@ type FileSystem struct {
 	replicators *Ticket
 	restorers   *Ticket
 
+	// nil unless random writes are enabled
+	staging *StagingArea
+	// nil if --journal-dir is empty
+	journal *RenameJournal
+	// nil if --cache-dir is empty
+	cache *DiskCache
+	// nil if --small-file-kb or --small-file-cache-mb is 0
+	smallFiles *SmallFileCache
+	// *fuse.Connection once mounted, see notifyServer
+	conn atomic.Value
+	// least recently used files, evicted beyond --max-inodes
+	lru *inodeLRU
+	// one --metadata-snapshot is written at a time
+	snapshotMu sync.Mutex
+	// ETags of the objects found to be symlinks, by key, see
+	// knownSymlink
+	symlinksMu sync.Mutex
+	symlinks   map[string]string
+
 	forgotCnt uint32
 }
 
 func NewFileSystem(ctx context.Context, cloud storage.ObjectBackend, flags *Flags) *FileSystem {
 	// Set up the basic struct.
 	fs := &FileSystem{
-		flags: flags,
-		umask: 0122,
-		cloud: cloud,
+		flags:    flags,
+		umask:    0122,
+		cloud:    cloud,
+		symlinks: make(map[string]string),
 	}
 
 	now := time.Now()
@@ -90,6 +113,7 @@ func NewFileSystem(ctx context.Context, cloud storage.ObjectBackend, flags *Flag
 	root.Id = fuseops.RootInodeID
 	root.ToDir()
 	root.dir.cloud = cloud
+	root.dir.mountPrefix = flags.Prefix
 	root.Attributes.Mtime = fs.rootAttrs.Mtime
 
 	fs.inodes[fuseops.RootInodeID] = root
@@ -100,9 +124,66 @@ func NewFileSystem(ctx context.Context, cloud storage.ObjectBackend, flags *Flag
 
 	fs.fileHandles = make(map[fuseops.HandleID]*FileHandle)
 
+	if flags.SmallFileSize != 0 && flags.SmallFileCacheLimit != 0 {
+		fs.smallFiles = NewSmallFileCache(flags.SmallFileCacheLimit)
+	}
+
+	if flags.ReadAheadChunk == 0 {
+		flags.ReadAheadChunk = ReadHeadChunk
+	}
+	if flags.ReadAheadMax < flags.ReadAheadMin {
+		flags.ReadAheadMax = flags.ReadAheadMin
+	}
+
+	fs.lru = newInodeLRU()
+	if flags.MetadataSnapshot != "" {
+		err := fs.loadSnapshot()
+		if err != nil {
+			log.Errorf("Unable to load metadata snapshot %v: %v", flags.MetadataSnapshot, err)
+		}
+	}
+
 	fs.replicators = Ticket{Total: 16}.Init()
 	fs.restorers = Ticket{Total: 20}.Init()
 
+	if flags.StagingDir != "" {
+		var err error
+		fs.staging, err = NewStagingArea(flags.StagingDir, flags.StagingLimit)
+		if err != nil {
+			log.Errorf("Unable to use staging dir %v: %v", flags.StagingDir, err)
+			return nil
+		}
+	}
+
+	if flags.JournalDir != "" {
+		var err error
+		fs.journal, err = NewRenameJournal(flags.JournalDir, bucketID(flags))
+		if err != nil {
+			log.Errorf("Unable to use journal dir %v: %v", flags.JournalDir, err)
+			return nil
+		}
+	}
+
+	if flags.CacheDir != "" {
+		var err error
+		fs.cache, err = NewDiskCache(flags.CacheDir, bucketID(flags), flags.CacheLimit)
+		if err != nil {
+			log.Errorf("Unable to use cache dir %v: %v", flags.CacheDir, err)
+			return nil
+		}
+	}
+
+	// started last so that a failed setup leaves nothing running
+	if flags.MetadataSnapshot != "" && flags.MetadataSnapshotInterval != 0 {
+		go fs.saveSnapshots()
+	}
+	if flags.MaxInodes != 0 {
+		go fs.evictInodes()
+	}
+	if flags.PollInterval != 0 {
+		go fs.pollChanges()
+	}
+
 	return fs
 }
 
@@ -138,9 +219,31 @@ func (fs *FileSystem) SigUsr1() {
 	log.Infof("forgot %v inodes", fs.forgotCnt)
 	log.Infof("%v inodes", len(fs.inodes))
 	fs.mu.RUnlock()
+
+	s := fs.InodeCacheStats()
+	var hitRate float64
+	if s.Hits+s.Misses != 0 {
+		hitRate = float64(s.Hits) * 100 / float64(s.Hits+s.Misses)
+	}
+	log.Infof("inode cache: %v hits, %v misses (%.1f%% hit rate), %v evictions, limit %v",
+		s.Hits, s.Misses, hitRate, s.Evictions, fs.flags.MaxInodes)
+
+	if r, ok := fs.cloud.(*storage.ObjectBackendRetryWrapper); ok {
+		log.Infof("backend: %v", r.Stats())
+	}
 	debug.FreeOSMemory()
 }
 
+// Destroy is called once the file system is unmounted
+func (fs *FileSystem) Destroy() {
+	if fs.flags.MetadataSnapshot != "" {
+		err := fs.SaveSnapshot()
+		if err != nil {
+			log.Errorf("unable to save metadata snapshot %v: %v", fs.flags.MetadataSnapshot, err)
+		}
+	}
+}
+
 // Find the given inode. Panic if it doesn't exist.
 //
 // RLOCKS_REQUIRED(fs.mu)
@@ -382,29 +485,6 @@ func (fs *FileSystem) SetXattr(ctx context.Context,
 	return
 }
 
-func mapHttpError(status int) error {
-	switch status {
-	case 400:
-		return fuse.EINVAL
-	case 401:
-		return syscall.EACCES
-	case 403:
-		return syscall.EACCES
-	case 404:
-		return fuse.ENOENT
-	case 405:
-		return syscall.ENOTSUP
-	case http.StatusConflict:
-		return syscall.EINTR
-	case 429:
-		return syscall.EAGAIN
-	case 500:
-		return syscall.EAGAIN
-	default:
-		return nil
-	}
-}
-
 func mapStorageError(err error) error {
 	if err == nil {
 		return nil
@@ -426,12 +506,44 @@ func pathEscape(path string) string {
 	return u.EscapedPath()
 }
 
-func (fs *FileSystem) allocateInodeId() (id fuseops.InodeID) {
+// LOCKS_REQUIRED(fs.mu)
+func (fs *FileSystem) allocateInodeId(inode *Inode) (id fuseops.InodeID) {
+	if fs.flags.StableInodes {
+		return fs.stableInodeId(inode)
+	}
+
 	id = fs.nextInodeID
 	fs.nextInodeID++
 	return
 }
 
+// stableInodeId derives the ID from the object key, so that an object has
+// the same inode number every time it's looked up, by any mount of the
+// bucket. If the ID is taken by a live inode, ex: a file that was renamed
+// or removed while open, the key is hashed again with a counter. The
+// candidates only depend on the key, so two keys don't trade IDs
+// depending on which was looked up first unless their hashes collide.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *FileSystem) stableInodeId(inode *Inode) (id fuseops.InodeID) {
+	_, key := inode.cloud()
+	if inode.isDir() {
+		// a file and a directory can have the same name
+		key += "/"
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	id = fuseops.InodeID(h.Sum64())
+	for i := uint64(1); id <= fuseops.RootInodeID || fs.inodes[id] != nil; i++ {
+		var salt [8]byte
+		binary.BigEndian.PutUint64(salt[:], i)
+		h.Write(salt[:])
+		id = fuseops.InodeID(h.Sum64())
+	}
+	return
+}
+
 func expired(cache time.Time, ttl time.Duration) bool {
 	now := time.Now()
 	if cache.After(now) {
@@ -444,14 +556,31 @@ func (fs *FileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 
 	var inode *Inode
 	var ok bool
+	var negative time.Time
 	defer func() { fuseLog.Debugf("<-- LookUpInode %v %v %v", op.Parent, op.Name, err) }()
 
 	fs.mu.RLock()
 	parent := fs.getInodeOrDie(op.Parent)
 	fs.mu.RUnlock()
 
+	// a zero child tells the kernel to cache that the name doesn't
+	// exist, for as long as we do
+	defer func() {
+		if err == nil && !negative.IsZero() {
+			op.Entry.Child = 0
+			op.Entry.EntryExpiration = negative
+		}
+	}()
+
 	parent.mu.Lock()
 	inode = parent.findChildUnlocked(op.Name)
+	if inode == nil {
+		negative, ok = parent.negativeExpiry(op.Name)
+		if ok {
+			parent.mu.Unlock()
+			return
+		}
+	}
 	if inode != nil {
 		ok = true
 		inode.Ref()
@@ -474,6 +603,12 @@ func (fs *FileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 	}
 	parent.mu.Unlock()
 
+	if ok {
+		atomic.AddUint64(&fs.lru.hits, 1)
+	} else {
+		atomic.AddUint64(&fs.lru.misses, 1)
+	}
+
 	if !ok {
 		var newInode *Inode
 
@@ -484,6 +619,9 @@ func (fs *FileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 			// just pretend this dir is still around
 			err = nil
 		} else if err != nil {
+			if err == fuse.ENOENT && fs.flags.NegativeCacheTTL != 0 {
+				negative = parent.addNegative(op.Name)
+			}
 			if inode != nil {
 				// just kidding! pretend we didn't up the ref
 				fs.mu.Lock()
@@ -492,9 +630,13 @@ func (fs *FileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 				stale := inode.DeRef(1)
 				if stale {
 					delete(fs.inodes, inode.Id)
+					fs.forgetInodeLRU(inode)
 					parent.removeChild(inode)
 				}
 			}
+			if !negative.IsZero() {
+				return nil
+			}
 			return err
 		}
 
@@ -519,6 +661,7 @@ func (fs *FileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 				if !inode.Attributes.Equal(newInode.Attributes) {
 					inode.logFuse("invalidate cache because attributes changed", inode.Attributes, newInode.Attributes)
 					inode.invalidateCache = true
+					fs.notifyInode(inode.Id)
 				} else if inode.knownETag != nil &&
 					newInode.knownETag != nil &&
 					*inode.knownETag != *newInode.knownETag {
@@ -529,6 +672,14 @@ func (fs *FileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 					// data
 					inode.logFuse("invalidate cache because etag changed", *inode.knownETag, *newInode.knownETag)
 					inode.invalidateCache = true
+					fs.notifyInode(inode.Id)
+				}
+
+				if fs.cache != nil && newInode.knownETag != nil {
+					if etag, ok := inode.sysMetadata["etag"]; ok && string(etag) != *newInode.knownETag {
+						_, key := inode.cloud()
+						go fs.cache.Invalidate(key, newInode.knownETag)
+					}
 				}
 
 				if newInode.Attributes.Mtime.IsZero() {
@@ -539,6 +690,8 @@ func (fs *FileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 				}
 				inode.Attributes = newInode.Attributes
 				inode.knownETag = newInode.knownETag
+				inode.sysMetadata = newInode.sysMetadata
+				inode.userMetadata = newInode.userMetadata
 			}
 			inode.AttrTime = time.Now()
 
@@ -546,6 +699,8 @@ func (fs *FileSystem) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp
 		}
 	}
 
+	fs.touchInode(inode)
+
 	op.Entry.Child = inode.Id
 	op.Entry.Attributes = inode.InflateAttributes()
 	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
@@ -569,12 +724,19 @@ func (fs *FileSystem) insertInode(parent *Inode, inode *Inode) {
 		if inode.Id != 0 {
 			panic(fmt.Sprintf("inode id is set: %v %v", *inode.Name, inode.Id))
 		}
-		inode.Id = fs.allocateInodeId()
+		inode.Id = fs.allocateInodeId(inode)
 		addInode = true
 	}
 	parent.insertChildUnlocked(inode)
 	if addInode {
 		fs.inodes[inode.Id] = inode
+		fs.touchInode(inode)
+		if fs.overInodeBudget() {
+			select {
+			case fs.lru.wake <- struct{}{}:
+			default:
+			}
+		}
 
 		// if we are inserting a new directory, also create
 		// the child . and ..
@@ -613,8 +775,13 @@ func (fs *FileSystem) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp
 		defer fs.mu.Unlock()
 
 		delete(fs.inodes, op.Inode)
+		fs.forgetInodeLRU(inode)
 		fs.forgotCnt += 1
 
+		if fs.smallFiles != nil {
+			fs.smallFiles.remove(op.Inode)
+		}
+
 		if inode.Parent != nil {
 			inode.Parent.removeChildUnlocked(inode)
 		}
@@ -634,6 +801,7 @@ func (fs *FileSystem) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) (err e
 
 	// XXX/is this a dir?
 	dh := in.OpenDir()
+	atomic.AddInt32(&in.dirHandles, 1)
 
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -703,6 +871,7 @@ func (fs *FileSystem) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseD
 
 	dh := fs.dirHandles[op.Handle]
 	dh.CloseDir()
+	atomic.AddInt32(&dh.inode.dirHandles, -1)
 
 	fuseLog.Debugln("ReleaseDirHandle", *dh.inode.FullName())
 
@@ -721,6 +890,12 @@ func (fs *FileSystem) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err
 		return
 	}
 
+	// the data of a file that is only written or truncated is never
+	// read
+	if fs.smallFiles != nil && !op.OpenFlags.IsWriteOnly() && op.OpenFlags&syscall.O_TRUNC == 0 {
+		in.prefetchSmallFile()
+	}
+
 	fs.mu.Lock()
 
 	handleID := fs.nextHandleID
@@ -747,7 +922,14 @@ func (fs *FileSystem) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) (err
 	//
 	// see tests TestReadNewFileWithExternalChangesFuse and
 	// TestReadMyOwnWrite*Fuse
-	op.KeepPageCache = !in.invalidateCache
+	switch fs.flags.PageCache {
+	case PageCacheNone:
+		op.KeepPageCache = false
+	case PageCacheKeep:
+		op.KeepPageCache = true
+	default:
+		op.KeepPageCache = !in.invalidateCache
+	}
 	fh.keepPageCache = op.KeepPageCache
 	in.invalidateCache = false
 
@@ -767,8 +949,23 @@ func (fs *FileSystem) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) (err
 
 func (fs *FileSystem) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) (err error) {
 
-	// intentionally ignored, so that write()/sync()/write() works
-	// see https://github.com/kahing/FileSystem/issues/154
+	if !fs.flags.DurableSync {
+		// intentionally ignored, so that write()/sync()/write() works
+		// see https://github.com/kahing/FileSystem/issues/154
+		return
+	}
+
+	fs.mu.RLock()
+	fh := fs.fileHandles[op.Handle]
+	fs.mu.RUnlock()
+
+	// fsync on a directory
+	if fh == nil {
+		return
+	}
+
+	err = fh.SyncFile()
+	fh.inode.logFuse("<-- SyncFile", err, op.Handle, op.Inode)
 	return
 }
 
@@ -802,16 +999,23 @@ func (fs *FileSystem) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) (e
 	if err != nil {
 		// if we returned success from creat() earlier
 		// linux may think this file exists even when it doesn't,
-		// until TypeCacheTTL is over
-		// TODO: figure out a way to make the kernel forget this inode
+		// until TypeCacheTTL is over, unless we tell it otherwise.
 		// see TestWriteAnonymousFuse
 		fs.mu.RLock()
 		inode := fs.getInodeOrDie(op.Inode)
 		fs.mu.RUnlock()
 
+		// what the kernel cached was never uploaded
+		fs.notifyInode(inode.Id)
+
+		inode.mu.Lock()
 		if inode.KnownSize == nil {
 			inode.AttrTime = time.Time{}
+			if inode.Parent != nil {
+				fs.notifyEntry(inode.Parent.Id, *inode.Name)
+			}
 		}
+		inode.mu.Unlock()
 
 	}
 	fh.inode.logFuse("<-- FlushFile", err, op.Handle, op.Inode)
@@ -895,6 +1099,41 @@ func (fs *FileSystem) MkDir(ctx context.Context, op *fuseops.MkDirOp) (err error
 	return
 }
 
+func (fs *FileSystem) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) (err error) {
+	fs.mu.RLock()
+	parent := fs.getInodeOrDie(op.Parent)
+	fs.mu.RUnlock()
+
+	inode, err := parent.CreateSymlink(op.Name, op.Target)
+	if err != nil {
+		return err
+	}
+
+	parent.mu.Lock()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.insertInode(parent, inode)
+
+	parent.mu.Unlock()
+
+	op.Entry.Child = inode.Id
+	op.Entry.Attributes = inode.InflateAttributes()
+	op.Entry.AttributesExpiration = time.Now().Add(fs.flags.StatCacheTTL)
+	op.Entry.EntryExpiration = time.Now().Add(fs.flags.TypeCacheTTL)
+
+	return
+}
+
+func (fs *FileSystem) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) (err error) {
+	fs.mu.RLock()
+	inode := fs.getInodeOrDie(op.Inode)
+	fs.mu.RUnlock()
+
+	op.Target, err = inode.ReadSymlink()
+	return
+}
+
 func (fs *FileSystem) RmDir(ctx context.Context, op *fuseops.RmDirOp) (err error) {
 
 	fs.mu.RLock()
@@ -910,8 +1149,24 @@ func (fs *FileSystem) SetInodeAttributes(ctx context.Context, op *fuseops.SetIno
 
 	fs.mu.RLock()
 	inode := fs.getInodeOrDie(op.Inode)
+	var fh *FileHandle
+	if op.Handle != nil {
+		fh = fs.fileHandles[*op.Handle]
+	}
 	fs.mu.RUnlock()
 
+	if op.Size != nil {
+		err = inode.Truncate(fh, *op.Size)
+		if err != nil {
+			return
+		}
+	}
+
+	err = inode.SetAttributes(op.Mode, op.Uid, op.Gid, op.Atime, op.Mtime)
+	if err != nil {
+		return
+	}
+
 	attr, err := inode.GetAttributes()
 	if err == nil {
 		op.Attributes = *attr
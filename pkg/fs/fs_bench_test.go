@@ -0,0 +1,154 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse"
+)
+
+// The benchmarks mount a memory backend, so they need /dev/fuse and the
+// right to mount, and are skipped without them. Compare the modes with
+//
+//	go test ./pkg/fs -run '^$' -bench . -benchtime 20x
+
+// benchMount mounts a memory backed file system with flags on top of
+// the defaults of the command line, and unmounts it when b is done
+func benchMount(b *testing.B, set func(flags *Flags)) (dir string) {
+	b.Helper()
+	dir = b.TempDir()
+	flags := &Flags{
+		MountOptions:   map[string]string{},
+		MountPoint:     dir,
+		DirMode:        0755,
+		FileMode:       0644,
+		Uid:            uint32(os.Getuid()),
+		Gid:            uint32(os.Getgid()),
+		Backend:        "mem",
+		Bucket:         "bench",
+		StatCacheTTL:   time.Minute,
+		TypeCacheTTL:   time.Minute,
+		ReadAheadMin:   MinReadHead,
+		ReadAheadMax:   MaxReadHead,
+		ReadAheadChunk: ReadHeadChunk,
+		PageCache:      PageCacheAuto,
+	}
+	if set != nil {
+		set(flags)
+	}
+
+	_, mfs, err := MountFS(context.Background(), storage.NewMemStorage(flags.Bucket), flags)
+	if err != nil {
+		b.Skipf("unable to mount: %v", err)
+	}
+	b.Cleanup(func() {
+		err := fuse.Unmount(dir)
+		if err != nil {
+			// root can do without fusermount
+			err = syscall.Unmount(dir, 0)
+		}
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		mfs.Join(context.Background())
+	})
+	return
+}
+
+// openFile opens a file of the mount without registering it with the
+// runtime poller, whose poll of a FUSE file waits for the server in this
+// very process and deadlocks when there is a single P to run it on
+func openFile(b *testing.B, path string, flag int) *os.File {
+	b.Helper()
+	fd, err := syscall.Open(path, flag|syscall.O_CLOEXEC, 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return os.NewFile(uintptr(fd), path)
+}
+
+// the kernel sends small writes one by one unless it may cache them
+func BenchmarkSmallWrites(b *testing.B) {
+	const size = 4 * 1024 * 1024
+	chunk := bytes.Repeat([]byte{'x'}, 512)
+
+	for _, c := range []struct {
+		name      string
+		writeback bool
+	}{
+		{"writeback=false", false},
+		{"writeback=true", true},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			dir := benchMount(b, func(flags *Flags) {
+				flags.WritebackCache = c.writeback
+				if c.writeback {
+					flags.StagingDir = b.TempDir()
+				}
+			})
+			path := filepath.Join(dir, "file")
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f := openFile(b, path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+				for n := 0; n < size; n += len(chunk) {
+					_, err := f.Write(chunk)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				err := f.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// rereading an unchanged file comes from the page cache unless it's
+// dropped on open
+func BenchmarkReread(b *testing.B) {
+	const size = 16 * 1024 * 1024
+
+	for _, mode := range []string{PageCacheNone, PageCacheKeep, PageCacheAuto} {
+		b.Run("page-cache="+mode, func(b *testing.B) {
+			dir := benchMount(b, func(flags *Flags) {
+				flags.PageCache = mode
+			})
+			path := filepath.Join(dir, "file")
+			f := openFile(b, path, os.O_WRONLY|os.O_CREATE)
+			_, err := f.Write(bytes.Repeat([]byte{'x'}, size))
+			if err == nil {
+				err = f.Close()
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f := openFile(b, path, os.O_RDONLY)
+				n, err := io.Copy(ioutil.Discard, f)
+				f.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != size {
+					b.Fatalf("read %v bytes, expecting %v", n, size)
+				}
+			}
+		})
+	}
+}
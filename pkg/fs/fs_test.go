@@ -0,0 +1,280 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The tests call the FUSE operations of a FileSystem on top of a
+// memory backend directly, without mounting it, the way the kernel
+// would call them.
+
+// newTestFS returns a file system on cloud with flags on top of the
+// defaults of the command line
+func newTestFS(t *testing.T, cloud storage.ObjectBackend, set func(flags *Flags)) *FileSystem {
+	t.Helper()
+	if cloud == nil {
+		cloud = storage.NewMemStorage("test")
+	}
+	flags := &Flags{
+		MountOptions:   map[string]string{},
+		MountPoint:     "/mnt",
+		DirMode:        0755,
+		FileMode:       0644,
+		Uid:            uint32(os.Getuid()),
+		Gid:            uint32(os.Getgid()),
+		Backend:        "mem",
+		Bucket:         "test",
+		StatCacheTTL:   time.Minute,
+		TypeCacheTTL:   time.Minute,
+		ReadAheadMin:   MinReadHead,
+		ReadAheadMax:   MaxReadHead,
+		ReadAheadChunk: ReadHeadChunk,
+		PageCache:      PageCacheAuto,
+	}
+	if set != nil {
+		set(flags)
+	}
+
+	fs := NewFileSystem(context.Background(), cloud, flags)
+	if fs == nil {
+		t.Fatal("unable to set up the file system")
+	}
+	return fs
+}
+
+// the pid of the test, so that flushes aren't ignored as coming from
+// another process
+func testMetadata() fuseops.OpMetadata {
+	return fuseops.OpMetadata{Pid: uint32(os.Getpid())}
+}
+
+func lookUp(t *testing.T, fs *FileSystem, parent fuseops.InodeID, name string) (fuseops.ChildInodeEntry, error) {
+	t.Helper()
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	err := fs.LookUpInode(context.Background(), op)
+	return op.Entry, err
+}
+
+func mustLookUp(t *testing.T, fs *FileSystem, parent fuseops.InodeID, name string) fuseops.InodeID {
+	t.Helper()
+	entry, err := lookUp(t, fs, parent, name)
+	if err != nil {
+		t.Fatalf("lookup %v: %v", name, err)
+	}
+	if entry.Child == 0 {
+		t.Fatalf("lookup %v: not found", name)
+	}
+	return entry.Child
+}
+
+// forgetAll drops every reference the kernel has to the inode
+func forgetAll(t *testing.T, fs *FileSystem, id fuseops.InodeID) {
+	t.Helper()
+	fs.mu.RLock()
+	n := fs.getInodeOrDie(id).refcnt
+	fs.mu.RUnlock()
+
+	err := fs.ForgetInode(context.Background(), &fuseops.ForgetInodeOp{Inode: id, N: n})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mkDir(t *testing.T, fs *FileSystem, parent fuseops.InodeID, name string) fuseops.InodeID {
+	t.Helper()
+	op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: os.ModeDir | 0755}
+	err := fs.MkDir(context.Background(), op)
+	if err != nil {
+		t.Fatalf("mkdir %v: %v", name, err)
+	}
+	return op.Entry.Child
+}
+
+// createFile creates name with data and closes it
+func createFile(t *testing.T, fs *FileSystem, parent fuseops.InodeID, name string, data string) fuseops.InodeID {
+	t.Helper()
+	op := &fuseops.CreateFileOp{Parent: parent, Name: name, Mode: 0644, Metadata: testMetadata()}
+	err := fs.CreateFile(context.Background(), op)
+	if err != nil {
+		t.Fatalf("create %v: %v", name, err)
+	}
+	if data != "" {
+		writeFile(t, fs, op.Entry.Child, op.Handle, 0, data)
+	}
+	closeFile(t, fs, op.Entry.Child, op.Handle)
+	return op.Entry.Child
+}
+
+func openHandle(t *testing.T, fs *FileSystem, id fuseops.InodeID) fuseops.HandleID {
+	t.Helper()
+	op := &fuseops.OpenFileOp{Inode: id, Metadata: testMetadata()}
+	err := fs.OpenFile(context.Background(), op)
+	if err != nil {
+		t.Fatalf("open %v: %v", id, err)
+	}
+	return op.Handle
+}
+
+func writeFile(t *testing.T, fs *FileSystem, id fuseops.InodeID, fh fuseops.HandleID, off int64, data string) {
+	t.Helper()
+	err := fs.WriteFile(context.Background(), &fuseops.WriteFileOp{
+		Inode: id, Handle: fh, Offset: off, Data: []byte(data),
+	})
+	if err != nil {
+		t.Fatalf("write %v at %v: %v", id, off, err)
+	}
+}
+
+// closeFile flushes and releases the handle like close(2)
+func closeFile(t *testing.T, fs *FileSystem, id fuseops.InodeID, fh fuseops.HandleID) {
+	t.Helper()
+	err := fs.FlushFile(context.Background(), &fuseops.FlushFileOp{
+		Inode: id, Handle: fh, Metadata: testMetadata(),
+	})
+	if err != nil {
+		t.Fatalf("flush %v: %v", id, err)
+	}
+	err = fs.ReleaseFileHandle(context.Background(), &fuseops.ReleaseFileHandleOp{Handle: fh})
+	if err != nil {
+		t.Fatalf("release %v: %v", id, err)
+	}
+}
+
+// readFile returns the whole content of the file from a new handle
+func readFile(t *testing.T, fs *FileSystem, id fuseops.InodeID) string {
+	t.Helper()
+	fh := openHandle(t, fs, id)
+	defer fs.ReleaseFileHandle(context.Background(), &fuseops.ReleaseFileHandleOp{Handle: fh})
+
+	var data []byte
+	buf := make([]byte, 64*1024)
+	for {
+		op := &fuseops.ReadFileOp{Inode: id, Handle: fh, Offset: int64(len(data)), Dst: buf}
+		err := fs.ReadFile(context.Background(), op)
+		if err != nil {
+			t.Fatalf("read %v at %v: %v", id, len(data), err)
+		}
+		if op.BytesRead == 0 {
+			return string(data)
+		}
+		data = append(data, buf[:op.BytesRead]...)
+	}
+}
+
+func getAttributes(t *testing.T, fs *FileSystem, id fuseops.InodeID) fuseops.InodeAttributes {
+	t.Helper()
+	op := &fuseops.GetInodeAttributesOp{Inode: id}
+	err := fs.GetInodeAttributes(context.Background(), op)
+	if err != nil {
+		t.Fatalf("getattr %v: %v", id, err)
+	}
+	return op.Attributes
+}
+
+func openDir(t *testing.T, fs *FileSystem, id fuseops.InodeID) fuseops.HandleID {
+	t.Helper()
+	op := &fuseops.OpenDirOp{Inode: id}
+	err := fs.OpenDir(context.Background(), op)
+	if err != nil {
+		t.Fatalf("opendir %v: %v", id, err)
+	}
+	return op.Handle
+}
+
+func releaseDir(t *testing.T, fs *FileSystem, dh fuseops.HandleID) {
+	t.Helper()
+	err := fs.ReleaseDirHandle(context.Background(), &fuseops.ReleaseDirHandleOp{Handle: dh})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readDir lists the directory the way readdir(3) does, without . and ..
+func readDir(t *testing.T, fs *FileSystem, id fuseops.InodeID) (dirents []fuseutil.Dirent) {
+	t.Helper()
+	dh := openDir(t, fs, id)
+	defer releaseDir(t, fs, dh)
+
+	var offset fuseops.DirOffset
+	for {
+		op := &fuseops.ReadDirOp{Inode: id, Handle: dh, Offset: offset, Dst: make([]byte, 4096)}
+		err := fs.ReadDir(context.Background(), op)
+		if err != nil {
+			t.Fatalf("readdir %v: %v", id, err)
+		}
+		if op.BytesRead == 0 {
+			return
+		}
+		for _, d := range parseDirents(op.Dst[:op.BytesRead]) {
+			if d.Name != "." && d.Name != ".." {
+				dirents = append(dirents, d)
+			}
+			offset = d.Offset
+		}
+	}
+}
+
+// readDirNames returns the sorted names in the directory
+func readDirNames(t *testing.T, fs *FileSystem, id fuseops.InodeID) (names []string) {
+	t.Helper()
+	for _, d := range readDir(t, fs, id) {
+		names = append(names, d.Name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// parseDirents reads back what fuseutil.WriteDirent wrote
+func parseDirents(buf []byte) (dirents []fuseutil.Dirent) {
+	le := func(b []byte) (v uint64) {
+		for i := len(b) - 1; i >= 0; i-- {
+			v = v<<8 | uint64(b[i])
+		}
+		return
+	}
+	for len(buf) >= 24 {
+		nameLen := int(le(buf[16:20]))
+		dirents = append(dirents, fuseutil.Dirent{
+			Inode:  fuseops.InodeID(le(buf[0:8])),
+			Offset: fuseops.DirOffset(le(buf[8:16])),
+			Type:   fuseutil.DirentType(le(buf[20:24])),
+			Name:   string(bytes.TrimRight(buf[24:24+nameLen], "\x00")),
+		})
+		// entries are padded to 8 bytes
+		size := (24 + nameLen + 7) &^ 7
+		if size > len(buf) {
+			break
+		}
+		buf = buf[size:]
+	}
+	return
+}
+
+// keys lists every object in cloud
+func keys(t *testing.T, cloud storage.ObjectBackend) []string {
+	t.Helper()
+	var all []string
+	var token *string
+	for {
+		res, err := cloud.ListBlobs(&storage.ListBlobsInput{ContinuationToken: token})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range res.Items {
+			all = append(all, *item.Key)
+		}
+		if !res.IsTruncated {
+			return all
+		}
+		token = res.NextContinuationToken
+	}
+}
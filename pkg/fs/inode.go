@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"container/list"
 	"fmt"
 	"net/url"
 	"os"
@@ -20,6 +21,14 @@ import (
 type InodeAttributes struct {
 	Size  uint64
 	Mtime time.Time
+
+	// from the object metadata, nil means the mount default applies
+	Mode  *os.FileMode
+	Uid   *uint32
+	Gid   *uint32
+	Atime *time.Time
+	// mtime set by utimes, Mtime is when the object was written
+	Utime *time.Time
 }
 
 func (i InodeAttributes) Equal(other InodeAttributes) bool {
@@ -55,6 +64,11 @@ type Inode struct {
 	ImplicitDir bool
 
 	fileHandles int32
+	// open directory handles, children aren't evicted while the
+	// directory is read
+	dirHandles int32
+	// GUARDED_BY(fs.lru.mu)
+	lruElem *list.Element
 
 	userMetadata map[string][]byte
 	sysMetadata  map[string][]byte
@@ -124,8 +138,21 @@ func (inode *Inode) SetFromBlobItem(item *storage.BlobItemOutput) {
 		inode.Attributes.Mtime = inode.fs.rootAttrs.Mtime
 	}
 	if item.ETag != nil {
+		if etag, ok := inode.sysMetadata["etag"]; ok && string(etag) != *itemcopy.ETag {
+			// the object was replaced, listings don't have
+			// metadata so look it up again when needed
+			inode.userMetadata = nil
+			inode.attrsFromMetadata()
+			inode.fs.notifyInode(inode.Id)
+		}
 		inode.sysMetadata["etag"] = []byte(*itemcopy.ETag)
 		inode.knownETag = itemcopy.ETag
+		if inode.userMetadata == nil && item.Key != nil &&
+			inode.fs.knownSymlink(*item.Key, *item.ETag) {
+			// the target is fetched by ReadSymlink
+			mode := os.ModeSymlink | 0777
+			inode.Attributes.Mode = &mode
+		}
 	} else {
 		delete(inode.sysMetadata, "etag")
 	}
@@ -192,6 +219,15 @@ func (inode *Inode) cloud() (cloud storage.ObjectBackend, path string) {
 	return
 }
 
+// isUploaded is false if the file is new or being written to, the
+// backend doesn't have what we know of it
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) isUploaded() bool {
+	_, hasETag := inode.sysMetadata["etag"]
+	return hasETag && inode.KnownSize != nil && *inode.KnownSize == inode.Attributes.Size
+}
+
 func (inode *Inode) FullName() *string {
 	if inode.Parent == nil {
 		return inode.Name
@@ -206,20 +242,36 @@ func (inode *Inode) touch() {
 }
 
 func (inode *Inode) InflateAttributes() (attr fuseops.InodeAttributes) {
-	mtime := inode.Attributes.Mtime
+	attrs := inode.Attributes
+
+	mtime := attrs.Mtime
 	if mtime.IsZero() {
 		mtime = inode.fs.rootAttrs.Mtime
 	}
+	ctime := mtime
+	if attrs.Utime != nil {
+		mtime = *attrs.Utime
+	}
+	atime := mtime
+	if attrs.Atime != nil {
+		atime = *attrs.Atime
+	}
 
 	attr = fuseops.InodeAttributes{
-		Size:   inode.Attributes.Size,
-		Atime:  mtime,
+		Size:   attrs.Size,
+		Atime:  atime,
 		Mtime:  mtime,
-		Ctime:  mtime,
-		Crtime: mtime,
+		Ctime:  ctime,
+		Crtime: ctime,
 		Uid:    inode.fs.flags.Uid,
 		Gid:    inode.fs.flags.Gid,
 	}
+	if attrs.Uid != nil {
+		attr.Uid = *attrs.Uid
+	}
+	if attrs.Gid != nil {
+		attr.Gid = *attrs.Gid
+	}
 
 	if inode.dir != nil {
 		attr.Nlink = 2
@@ -228,6 +280,9 @@ func (inode *Inode) InflateAttributes() (attr fuseops.InodeAttributes) {
 		attr.Nlink = 1
 		attr.Mode = inode.fs.flags.FileMode
 	}
+	if attrs.Mode != nil {
+		attr.Mode = attr.Mode&os.ModeType | *attrs.Mode
+	}
 	return
 }
 
@@ -288,6 +343,7 @@ func (inode *Inode) isDir() bool {
 
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) fillXattrFromHead(resp *storage.HeadBlobOutput) {
+	wasSymlink := inode.isSymlink()
 	inode.userMetadata = make(map[string][]byte)
 
 	if resp.ETag != nil {
@@ -307,17 +363,23 @@ func (inode *Inode) fillXattrFromHead(resp *storage.HeadBlobOutput) {
 		}
 		inode.userMetadata[k] = []byte(value)
 	}
+	inode.attrsFromMetadata()
+
+	if resp.Key != nil && resp.ETag != nil {
+		inode.fs.rememberSymlink(*resp.Key, *resp.ETag, inode.isSymlink())
+	}
+	if inode.isSymlink() != wasSymlink && inode.Id != 0 && inode.Parent != nil {
+		// the kernel can't change the type of an inode it
+		// has, it has to look it up again
+		inode.logFuse("symlink marker changed")
+		inode.fs.notifyEntry(inode.Parent.Id, *inode.Name)
+	}
 }
 
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) fillXattr() (err error) {
 	if !inode.ImplicitDir && inode.userMetadata == nil {
-		fullName := *inode.FullName()
-		if inode.isDir() {
-			fullName += "/"
-		}
-
-		cloud, key := inode.cloud()
+		cloud, key := inode.blobKey()
 		params := &storage.HeadBlobInput{Key: key}
 		resp, err := cloud.HeadBlob(params)
 		if err != nil {
@@ -385,14 +447,39 @@ func convertMetadata(meta map[string][]byte) (metadata map[string]*string) {
 
 // LOCKS_REQUIRED(inode.mu)
 func (inode *Inode) updateXattr() (err error) {
-	cloud, key := inode.cloud()
+	cloud, key := inode.blobKey()
+	var etag *string
+	if v, ok := inode.sysMetadata["etag"]; ok {
+		etag = stringRef(string(v))
+	}
+	var size *uint64
+	if !inode.isDir() {
+		size = &inode.Attributes.Size
+	}
+
 	_, err = cloud.CopyBlob(&storage.CopyBlobInput{
 		Source:      key,
 		Destination: key,
-		Size:        &inode.Attributes.Size,
-		ETag:        stringRef(string(inode.sysMetadata["etag"])),
+		Size:        size,
+		ETag:        etag,
 		Metadata:    convertMetadata(inode.userMetadata),
 	})
+	if err != nil {
+		return
+	}
+
+	// the copy may have a new ETag, which the next update has to match
+	resp, err := cloud.HeadBlob(&storage.HeadBlobInput{Key: key})
+	if err != nil {
+		return mapStorageError(err)
+	}
+	if resp.ETag != nil {
+		inode.sysMetadata["etag"] = []byte(*resp.ETag)
+		inode.knownETag = resp.ETag
+	}
+	if resp.LastModified != nil && !inode.isDir() {
+		inode.Attributes.Mtime = *resp.LastModified
+	}
 	return
 }
 
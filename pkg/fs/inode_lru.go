@@ -0,0 +1,161 @@
+package fs
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Listing a directory adds an inode for every entry, and those stay
+// until the directory is listed again without them, the kernel doesn't
+// know about them so it never forgets them. With --max-inodes, once
+// there are more inodes than that, the least recently looked up files
+// that the kernel doesn't hold and that aren't open are dropped, and
+// their directory is listed from the backend the next time. Directories
+// themselves are kept, they are few compared to files.
+
+type inodeLRU struct {
+	mu sync.Mutex
+	// files, most recently used at the front
+	list *list.List
+
+	wake chan struct{}
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// InodeCacheStats counts lookups that were answered from the inodes we
+// have and those that went to the backend, and inodes dropped to stay
+// within --max-inodes
+type InodeCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+func newInodeLRU() *inodeLRU {
+	return &inodeLRU{
+		list: list.New(),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (fs *FileSystem) InodeCacheStats() InodeCacheStats {
+	return InodeCacheStats{
+		Hits:      atomic.LoadUint64(&fs.lru.hits),
+		Misses:    atomic.LoadUint64(&fs.lru.misses),
+		Evictions: atomic.LoadUint64(&fs.lru.evictions),
+	}
+}
+
+// touchInode marks the inode as just used
+func (fs *FileSystem) touchInode(inode *Inode) {
+	if inode.isDir() {
+		return
+	}
+
+	fs.lru.mu.Lock()
+	if inode.lruElem == nil {
+		inode.lruElem = fs.lru.list.PushFront(inode)
+	} else {
+		fs.lru.list.MoveToFront(inode.lruElem)
+	}
+	fs.lru.mu.Unlock()
+}
+
+// forgetInodeLRU is called when the inode is removed from fs.inodes
+func (fs *FileSystem) forgetInodeLRU(inode *Inode) {
+	fs.lru.mu.Lock()
+	if inode.lruElem != nil {
+		fs.lru.list.Remove(inode.lruElem)
+		inode.lruElem = nil
+	}
+	fs.lru.mu.Unlock()
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *FileSystem) overInodeBudget() bool {
+	return fs.flags.MaxInodes != 0 && uint64(len(fs.inodes)) > fs.flags.MaxInodes
+}
+
+// evictInodes runs for the life of the file system and drops inodes
+// whenever insertInode finds that there are too many
+func (fs *FileSystem) evictInodes() {
+	for range fs.lru.wake {
+		// go a bit below the budget so that we don't wake up
+		// for every new inode
+		target := fs.flags.MaxInodes - fs.flags.MaxInodes/10
+
+		fs.mu.RLock()
+		excess := len(fs.inodes) - int(target)
+		fs.mu.RUnlock()
+
+		fs.lru.mu.Lock()
+		scan := fs.lru.list.Len()
+		fs.lru.mu.Unlock()
+
+		for excess > 0 && scan > 0 {
+			var batch []*Inode
+			fs.lru.mu.Lock()
+			for len(batch) < 256 && len(batch) < scan {
+				e := fs.lru.list.Back()
+				if e == nil {
+					break
+				}
+				// whatever we can't evict counts as used
+				fs.lru.list.MoveToFront(e)
+				batch = append(batch, e.Value.(*Inode))
+			}
+			fs.lru.mu.Unlock()
+			if len(batch) == 0 {
+				break
+			}
+			scan -= len(batch)
+
+			for _, inode := range batch {
+				if excess > 0 && fs.evictInode(inode) {
+					excess--
+				}
+			}
+		}
+	}
+}
+
+// evictInode drops the inode if nobody uses it
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *FileSystem) evictInode(inode *Inode) bool {
+	parent := inode.Parent
+	if parent != nil {
+		parent.mu.Lock()
+		defer parent.mu.Unlock()
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.inodes[inode.Id] != inode || inode.Parent != parent || inode.isDir() ||
+		inode.refcnt != 0 || atomic.LoadInt32(&inode.fileHandles) != 0 {
+		return false
+	}
+	if parent != nil {
+		// readdir goes through the children by index
+		if atomic.LoadInt32(&parent.dirHandles) != 0 ||
+			parent.findChildUnlocked(*inode.Name) != inode {
+			return false
+		}
+		parent.removeChildUnlocked(inode)
+		// the cached listing is missing this one now
+		parent.dir.DirTime = time.Time{}
+	}
+
+	delete(fs.inodes, inode.Id)
+	if fs.smallFiles != nil {
+		fs.smallFiles.remove(inode.Id)
+	}
+	fs.forgetInodeLRU(inode)
+	atomic.AddUint64(&fs.lru.evictions, 1)
+	return true
+}
@@ -0,0 +1,146 @@
+package fs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func (fs *FileSystem) hasInode(id fuseops.InodeID) bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.inodes[id] != nil
+}
+
+// childInode returns the inode of name in dir without looking it up,
+// which would take a reference
+func childInode(t *testing.T, fs *FileSystem, dir fuseops.InodeID, name string) *Inode {
+	t.Helper()
+	fs.mu.RLock()
+	parent := fs.getInodeOrDie(dir)
+	fs.mu.RUnlock()
+	inode := parent.findChild(name)
+	if inode == nil {
+		t.Fatalf("%v isn't in %v", name, dir)
+	}
+	return inode
+}
+
+func TestEvictInode(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		use     func(fs *FileSystem, dir fuseops.InodeID) (done func())
+		evicted bool
+	}{
+		{"unused", func(fs *FileSystem, dir fuseops.InodeID) func() {
+			return func() {}
+		}, true},
+		{"looked up", func(fs *FileSystem, dir fuseops.InodeID) func() {
+			id := mustLookUp(t, fs, dir, "0000")
+			return func() { forgetAll(t, fs, id) }
+		}, false},
+		{"open file", func(fs *FileSystem, dir fuseops.InodeID) func() {
+			id := mustLookUp(t, fs, dir, "0000")
+			fh := openHandle(t, fs, id)
+			// only the handle keeps it, the kernel doesn't forget
+			// an inode that is open but it's not ours to rely on
+			fs.mu.Lock()
+			fs.inodes[id].refcnt = 0
+			fs.mu.Unlock()
+			return func() { closeFile(t, fs, id, fh) }
+		}, false},
+		{"open dir", func(fs *FileSystem, dir fuseops.InodeID) func() {
+			dh := openDir(t, fs, dir)
+			return func() { releaseDir(t, fs, dh) }
+		}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cloud := storage.NewMemStorage("test")
+			putObjects(t, cloud, "dir/", 1)
+			fs := newTestFS(t, cloud, nil)
+			dir := mustLookUp(t, fs, fuseops.RootInodeID, "dir")
+			// listed, the kernel doesn't hold it
+			readDir(t, fs, dir)
+
+			done := c.use(fs, dir)
+			inode := childInode(t, fs, dir, "0000")
+			if evicted := fs.evictInode(inode); evicted != c.evicted {
+				t.Errorf("evicted = %v, expecting %v", evicted, c.evicted)
+			}
+			done()
+
+			// forgetting it drops it as well
+			if fs.hasInode(inode.Id) && !fs.evictInode(inode) {
+				t.Errorf("not evicted once unused")
+			}
+			// and the next lookup finds it again
+			mustLookUp(t, fs, dir, "0000")
+		})
+	}
+}
+
+// the evictor keeps the inodes under --max-inodes but never drops those
+// that are in use
+func TestEvictInodes(t *testing.T) {
+	const maxInodes = 20
+	cloud := storage.NewMemStorage("test")
+	putObjects(t, cloud, "open/", 5)
+	putObjects(t, cloud, "listing/", 5)
+	putObjects(t, cloud, "many/", 100)
+	fs := newTestFS(t, cloud, func(flags *Flags) {
+		flags.MaxInodes = maxInodes
+	})
+
+	// the least recently used ones
+	openDirID := mustLookUp(t, fs, fuseops.RootInodeID, "open")
+	file := mustLookUp(t, fs, openDirID, "0000")
+	fh := openHandle(t, fs, file)
+
+	listing := mustLookUp(t, fs, fuseops.RootInodeID, "listing")
+	readDir(t, fs, listing)
+	dh := openDir(t, fs, listing)
+	var listed []fuseops.InodeID
+	for i := 0; i < 5; i++ {
+		listed = append(listed, childInode(t, fs, listing, fmt.Sprintf("%04d", i)).Id)
+	}
+
+	many := mustLookUp(t, fs, fuseops.RootInodeID, "many")
+	if names := readDirNames(t, fs, many); len(names) != 100 {
+		t.Fatalf("many has %v entries", len(names))
+	}
+
+	inodes := func() int {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		return len(fs.inodes)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for inodes() > maxInodes && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := inodes(); n > maxInodes {
+		t.Fatalf("%v inodes, expecting at most %v", n, maxInodes)
+	}
+
+	if !fs.hasInode(file) {
+		t.Errorf("open file %v was evicted", file)
+	}
+	for _, id := range listed {
+		if !fs.hasInode(id) {
+			t.Errorf("%v was evicted while its directory is open", id)
+		}
+	}
+
+	// the evicted ones are listed again
+	if names := readDirNames(t, fs, many); len(names) != 100 {
+		t.Errorf("many has %v entries after eviction", len(names))
+	}
+	if data := readFile(t, fs, file); data != "open/0000" {
+		t.Errorf("open file = %q", data)
+	}
+	closeFile(t, fs, file, fh)
+	releaseDir(t, fs, dh)
+}
@@ -0,0 +1,271 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A directory rename copies every object under the old prefix and then
+// deletes the originals, so a crash in the middle leaves the directory
+// split between the two prefixes. Before it starts, the rename writes
+// its intent to a file in --journal-dir and holds a lock on it until it
+// is done. A journal entry that nobody holds a lock on belongs to a
+// rename that didn't finish, the next mount (or fsck) of the same bucket
+// completes it, or with fsck --rollback moves the objects back.
+//
+// The destination of a directory rename is always empty to begin with,
+// so rolling either way is another rename of whatever is left: objects
+// that were copied but not deleted yet are just copied again.
+type RenameJournal struct {
+	dir    string
+	bucket string
+}
+
+type renameEntry struct {
+	Bucket  string    `json:"bucket"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Pid     int       `json:"pid"`
+	Started time.Time `json:"started"`
+
+	path string
+	file *os.File
+}
+
+const renameJournalPrefix = "rename-"
+
+// NewRenameJournal keeps the renames of bucket in dir, bucket tells the
+// entries of different mounts apart
+func NewRenameJournal(dir string, bucket string) (*RenameJournal, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &RenameJournal{dir: dir, bucket: bucket}, nil
+}
+
+func bucketID(flags *Flags) string {
+	return flags.Backend + ":" + flags.Endpoint + "/" + flags.Bucket
+}
+
+// begin records that from is about to be renamed to to. The entry is
+// written and synced under a temporary name and locked before it's
+// renamed into place, so recovery never sees one that is half written
+// or one that is still in use.
+func (j *RenameJournal) begin(from string, to string) (e *renameEntry, err error) {
+	e = &renameEntry{
+		Bucket:  j.bucket,
+		From:    from,
+		To:      to,
+		Pid:     os.Getpid(),
+		Started: time.Now(),
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile(j.dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+			f.Close()
+		}
+	}()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return
+	}
+
+	e.path = filepath.Join(j.dir, fmt.Sprintf("%v%v-%v.json",
+		renameJournalPrefix, e.Started.UnixNano(), e.Pid))
+	err = os.Rename(f.Name(), e.path)
+	if err != nil {
+		return
+	}
+	err = syncDir(j.dir)
+	if err != nil {
+		os.Remove(e.path)
+		return
+	}
+
+	e.file = f
+	return e, nil
+}
+
+// end forgets a rename that finished
+func (j *RenameJournal) end(e *renameEntry) {
+	err := os.Remove(e.path)
+	if err != nil {
+		log.Errorf("unable to remove rename journal %v: %v", e.path, err)
+	} else {
+		syncDir(j.dir)
+	}
+	e.file.Close()
+}
+
+// abandon leaves the entry of a rename that failed to be recovered
+func (j *RenameJournal) abandon(e *renameEntry) {
+	log.Errorf("rename %v to %v did not finish, it will be completed on the next mount "+
+		"or by fsck, journal: %v", e.From, e.To, e.path)
+	e.file.Close()
+}
+
+// pending returns the entries of unfinished renames of our bucket, each
+// locked so that nobody else recovers it at the same time
+func (j *RenameJournal) pending() (entries []*renameEntry, err error) {
+	names, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return
+	}
+
+	for _, fi := range names {
+		if !strings.HasPrefix(fi.Name(), renameJournalPrefix) {
+			continue
+		}
+
+		path := filepath.Join(j.dir, fi.Name())
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return entries, err
+		}
+
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			// still going
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				continue
+			}
+			return entries, err
+		}
+
+		var e renameEntry
+		data, err := ioutil.ReadAll(f)
+		if err == nil {
+			err = json.Unmarshal(data, &e)
+		}
+		if err != nil {
+			f.Close()
+			return entries, fmt.Errorf("invalid rename journal %v: %v", path, err)
+		}
+		if e.Bucket != j.bucket {
+			f.Close()
+			continue
+		}
+
+		e.path = path
+		e.file = f
+		entries = append(entries, &e)
+	}
+	return
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// RecoverRenames finishes the directory renames that were interrupted,
+// or undoes them with rollback
+func (fs *FileSystem) RecoverRenames(rollback bool) (err error) {
+	recovered, err := fs.recoverRenames(rollback)
+	if recovered {
+		// a metadata snapshot may have the tree from before
+		fs.expireTree()
+	}
+	return
+}
+
+func (fs *FileSystem) recoverRenames(rollback bool) (recovered bool, err error) {
+	if fs.journal == nil {
+		return
+	}
+
+	entries, err := fs.journal.pending()
+	for _, e := range entries {
+		if err != nil {
+			e.file.Close()
+			continue
+		}
+
+		from, to := e.From, e.To
+		if rollback {
+			from, to = to, from
+		}
+		log.Infof("recovering rename %v to %v from %v, moving %v to %v",
+			e.From, e.To, e.path, from, to)
+
+		fs.mu.RLock()
+		root := fs.getInodeOrDie(fuseops.RootInodeID)
+		fs.mu.RUnlock()
+		err = root.renameChildren(fs.cloud, from, root, to)
+		if err != nil {
+			err = fmt.Errorf("recovering rename %v to %v from %v: %v",
+				e.From, e.To, e.path, err)
+			e.file.Close()
+			continue
+		}
+		fs.journal.end(e)
+		recovered = true
+	}
+	return
+}
+
+// Fsck completes or, with rollback, undoes the directory renames that
+// were interrupted in the bucket of flags
+func Fsck(ctx context.Context, cloud storage.ObjectBackend, flags *Flags, rollback bool) error {
+	// only the journal is needed, nothing that a mount runs in
+	// the background
+	replay := *flags
+	replay.MetadataSnapshot = ""
+	replay.MaxInodes = 0
+	replay.PollInterval = 0
+
+	fs := NewFileSystem(ctx, cloud, &replay)
+	if fs == nil {
+		return fmt.Errorf("initialization file system failed")
+	}
+	if fs.journal == nil {
+		return fmt.Errorf("no rename journal, set --journal-dir")
+	}
+
+	recovered, err := fs.recoverRenames(rollback)
+	if recovered && flags.MetadataSnapshot != "" {
+		// it has the tree from before, the next mount
+		// wouldn't know
+		rmErr := os.Remove(flags.MetadataSnapshot)
+		if rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Errorf("unable to remove metadata snapshot %v: %v", flags.MetadataSnapshot, rmErr)
+		}
+	}
+	return err
+}
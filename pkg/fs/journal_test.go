@@ -0,0 +1,129 @@
+package fs
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func journalEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := filepath.Glob(filepath.Join(dir, renameJournalPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// A rename that stops between copying a page and deleting the originals
+// is finished by the next mount, or undone with rollback
+func TestRenameJournal(t *testing.T) {
+	const n = 2500
+
+	for _, c := range []struct {
+		name     string
+		rollback bool
+		dir      string
+	}{
+		{"replay", false, "b"},
+		{"rollback", true, "a"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			journal := t.TempDir()
+			mem := storage.NewMemStorage("test")
+			putObjects(t, mem, "a/", n)
+			putObjects(t, mem, "a/sub/", 3)
+			cloud := storage.NewFaultInjector(mem, 0)
+			withJournal := func(flags *Flags) {
+				flags.JournalDir = journal
+			}
+
+			// the first page is moved, the second is copied but
+			// still there
+			fs := newTestFS(t, cloud, withJournal)
+			cloud.AddRule(&storage.FaultRule{Method: "DeleteBlobs", Key: "a/*", After: 1, Err: syscall.EIO})
+			err := renameDir(t, fs, "a", "b")
+			if err == nil {
+				t.Fatal("rename succeeded without deleting the originals")
+			}
+			cloud.ClearRules()
+			count := countPrefixes(t, mem)
+			if count["a"] == 0 || count["b"] == 0 || count["a"]+count["b"] <= n+3 {
+				t.Fatalf("objects after the crash = %v, expecting some in both", count)
+			}
+			if entries := journalEntries(t, journal); len(entries) != 1 {
+				t.Fatalf("journal after the crash = %v", entries)
+			}
+
+			next := newTestFS(t, cloud, withJournal)
+			err = next.RecoverRenames(c.rollback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count := countPrefixes(t, mem); count[c.dir] != n+3 || len(count) != 1 {
+				t.Errorf("objects after recovery = %v, expecting %v under %v", count, n+3, c.dir)
+			}
+			if data, err := objectData(t, mem, c.dir+"/1500"); data != "a/1500" || err != nil {
+				t.Errorf("%v/1500 = %q, %v", c.dir, data, err)
+			}
+			if entries := journalEntries(t, journal); len(entries) != 0 {
+				t.Errorf("journal after recovery = %v", entries)
+			}
+
+			id := mustLookUp(t, next, fuseops.RootInodeID, c.dir)
+			if names := readDirNames(t, next, id); len(names) != n+1 {
+				t.Errorf("%v has %v entries, expecting %v", c.dir, len(names), n+1)
+			}
+		})
+	}
+}
+
+// entries of renames that are still going or of other buckets are left
+// alone
+func TestRenameJournalPending(t *testing.T) {
+	dir := t.TempDir()
+	mem := storage.NewMemStorage("test")
+	putObjects(t, mem, "a/", 3)
+
+	j, err := NewRenameJournal(dir, "mem:/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := j.begin("a/", "b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRenameJournal(dir, "mem:/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := other.begin("a/", "c/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if it crashed
+	e.file.Close()
+
+	fs := newTestFS(t, mem, func(flags *Flags) {
+		flags.JournalDir = dir
+	})
+	if bucketID(fs.flags) != "mem:/test" {
+		t.Fatalf("bucket of the test mount = %v", bucketID(fs.flags))
+	}
+	recovered, err := fs.recoverRenames(false)
+	if recovered || err != nil {
+		t.Errorf("recover = %v, %v, expecting nothing to do", recovered, err)
+	}
+	if count := countPrefixes(t, mem); count["a"] != 3 || len(count) != 1 {
+		t.Errorf("objects after recovery = %v", count)
+	}
+
+	// once it's done
+	j.end(running)
+	if entries := journalEntries(t, dir); len(entries) != 1 {
+		t.Errorf("journal = %v, expecting the entry of the other bucket", entries)
+	}
+}
@@ -0,0 +1,174 @@
+package fs
+
+import (
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// These are updated whether or not metrics are exported, counting is
+// cheap enough.
+var (
+	fuseOps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cessfuse",
+		Subsystem: "fuse",
+		Name:      "ops_total",
+		Help:      "FUSE operations handled, by operation.",
+	}, []string{"op"})
+
+	fuseOpErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cessfuse",
+		Subsystem: "fuse",
+		Name:      "op_errors_total",
+		Help:      "FUSE operations that returned an error, by operation.",
+	}, []string{"op"})
+
+	fuseOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cessfuse",
+		Subsystem: "fuse",
+		Name:      "op_duration_seconds",
+		Help:      "Time spent handling FUSE operations, by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"op"})
+
+	// bytes returned by ReadFile, from readahead buffers or read serially
+	// from the backend. The share of the former is the readahead hit ratio.
+	readBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cessfuse",
+		Subsystem: "read",
+		Name:      "bytes_total",
+		Help:      "Bytes read from files, by source (readahead, stream, cache or memory).",
+	}, []string{"source"})
+
+	readaheadDiscarded = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cessfuse",
+		Subsystem: "read",
+		Name:      "readahead_discarded_bytes_total",
+		Help:      "Bytes read ahead and thrown away because of out of order reads or close.",
+	})
+
+	readaheadFetched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cessfuse",
+		Subsystem: "read",
+		Name:      "readahead_fetched_bytes_total",
+		Help:      "Bytes requested from the backend for readahead.",
+	})
+
+	kernelInvalidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cessfuse",
+		Subsystem: "fuse",
+		Name:      "invalidations_total",
+		Help:      "Kernel cache invalidations sent, by kind (inode or entry).",
+	}, []string{"kind"})
+
+	polledChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cessfuse",
+		Subsystem: "poll",
+		Name:      "changes_total",
+		Help:      "Changes made by others found by --poll-interval, by kind (created, modified or removed).",
+	}, []string{"kind"})
+)
+
+// observeFuseOp is deferred before LogPanic so it sees the error a panic
+// was turned into
+func observeFuseOp(op string, start time.Time, err *error) {
+	fuseOps.WithLabelValues(op).Inc()
+	fuseOpDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		fuseOpErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// RegisterMetrics exports the file system metrics to reg: FUSE ops,
+// reads, buffer pool usage, handles and inodes, and the backend retry
+// counters if retries are enabled.
+func (fs *FileSystem) RegisterMetrics(reg prometheus.Registerer) error {
+	gauge := func(name string, help string, f func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "cessfuse",
+			Name:      name,
+			Help:      help,
+		}, f)
+	}
+
+	fsLocked := func(f func() int) func() float64 {
+		return func() float64 {
+			fs.mu.RLock()
+			defer fs.mu.RUnlock()
+			return float64(f())
+		}
+	}
+
+	poolLocked := func(f func() uint64) func() float64 {
+		return func() float64 {
+			fs.bufferPool.mu.Lock()
+			defer fs.bufferPool.mu.Unlock()
+			return float64(f())
+		}
+	}
+
+	collectors := []prometheus.Collector{
+		fuseOps,
+		fuseOpErrors,
+		fuseOpDuration,
+		readBytes,
+		readaheadDiscarded,
+		readaheadFetched,
+		kernelInvalidations,
+		polledChanges,
+		gauge("inodes", "Inodes known to the file system.",
+			fsLocked(func() int { return len(fs.inodes) })),
+		gauge("open_file_handles", "Open file handles.",
+			fsLocked(func() int { return len(fs.fileHandles) })),
+		gauge("open_dir_handles", "Open directory handles.",
+			fsLocked(func() int { return len(fs.dirHandles) })),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "cessfuse",
+			Name:      "inode_cache_hits_total",
+			Help:      "Lookups answered from the inodes in memory.",
+		}, func() float64 { return float64(fs.InodeCacheStats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "cessfuse",
+			Name:      "inode_cache_misses_total",
+			Help:      "Lookups that went to the backend.",
+		}, func() float64 { return float64(fs.InodeCacheStats().Misses) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "cessfuse",
+			Name:      "inode_cache_evictions_total",
+			Help:      "Inodes dropped to stay within --max-inodes.",
+		}, func() float64 { return float64(fs.InodeCacheStats().Evictions) }),
+		gauge("buffer_pool_buffers", "Buffers in use from the buffer pool.",
+			poolLocked(func() uint64 { return fs.bufferPool.numBuffers })),
+		gauge("buffer_pool_max_buffers", "Buffers the pool is allowed to hand out.",
+			poolLocked(func() uint64 { return fs.bufferPool.computedMaxbuffers })),
+		gauge("buffer_pool_buffer_bytes", "Size of one buffer.",
+			func() float64 { return BuffSize }),
+	}
+
+	if r, ok := fs.cloud.(*storage.ObjectBackendRetryWrapper); ok {
+		counter := func(name string, help string, f func(storage.RetryStats) uint64) prometheus.Collector {
+			return prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: "cessfuse",
+				Subsystem: "backend",
+				Name:      name,
+				Help:      help,
+			}, func() float64 { return float64(f(r.Stats())) })
+		}
+
+		collectors = append(collectors,
+			counter("retries_total", "Backend requests retried after a transient error.",
+				func(s storage.RetryStats) uint64 { return s.Retries }),
+			counter("retries_recovered_total", "Backend calls that succeeded after retrying.",
+				func(s storage.RetryStats) uint64 { return s.Recovered }),
+			counter("retries_exhausted_total", "Backend calls that failed after retrying.",
+				func(s storage.RetryStats) uint64 { return s.GaveUp }))
+	}
+
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
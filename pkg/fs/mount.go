@@ -18,7 +18,20 @@ func MountFS(ctx context.Context, cloud storage.ObjectBackend, flags *Flags) (*F
 		FSName:                  "CESS",
 		Options:                 flags.MountOptions,
 		ErrorLogger:             utils.GetStdLogger(utils.NewLogger("fuse"), logrus.ErrorLevel),
-		DisableWritebackCaching: true,
+		DisableWritebackCaching: !flags.WritebackCache,
+	}
+
+	switch flags.PageCache {
+	case PageCacheNone, PageCacheKeep, PageCacheAuto:
+	default:
+		return nil, nil, fmt.Errorf("unknown page cache mode %q, expecting %v, %v or %v",
+			flags.PageCache, PageCacheNone, PageCacheKeep, PageCacheAuto)
+	}
+	if flags.WritebackCache && flags.StagingDir == "" {
+		// the kernel writes back dirty pages in whatever order
+		// it likes and reads around partial page writes, which
+		// only a staging file can take
+		return nil, nil, fmt.Errorf("writeback cache needs a staging dir")
 	}
 
 	if flags.DebugFuse {
@@ -33,8 +46,15 @@ func MountFS(ctx context.Context, cloud storage.ObjectBackend, flags *Flags) (*F
 		return nil, nil, fmt.Errorf("initialization file system failed")
 	}
 
-	server := fuseutil.NewFileSystemServer(FusePanicLogger{fs})
-	mfs, err := fuse.Mount(flags.MountPoint, server, mountCfg)
+	// don't show a directory that is half renamed
+	err := fs.RecoverRenames(false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v, fix it with fsck or remove the journal entry", err)
+	}
+
+	var mfs *fuse.MountedFileSystem
+	server := notifyServer{fuseutil.NewFileSystemServer(FusePanicLogger{fs}), fs}
+	mfs, err = fuse.Mount(flags.MountPoint, server, mountCfg)
 	if err != nil {
 		err = fmt.Errorf("mount fail,  err: %v", err)
 		return nil, nil, err
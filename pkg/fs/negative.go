@@ -0,0 +1,56 @@
+package fs
+
+import (
+	"time"
+)
+
+// Looking up a name that doesn't exist costs a HeadBlob and a ListBlobs,
+// and some programs look up a lot of those, ex: a shell searching $PATH.
+// With --negative-cache-ttl, a directory remembers the names it didn't
+// find for that long and the kernel is told to do the same. A name is
+// forgotten as soon as it's added to the directory locally, objects
+// created by someone else show up once the TTL is over.
+
+// most names a directory remembers, the expired ones are dropped beyond
+// that and all of them if that isn't enough
+const maxNegativeEntries = 4096
+
+// negativeExpiry is when the lookup of name that failed stops being
+// cached, ok is false if it isn't
+//
+// LOCKS_REQUIRED(parent.mu)
+func (parent *Inode) negativeExpiry(name string) (expiry time.Time, ok bool) {
+	expiry, ok = parent.dir.negatives[name]
+	if ok && !expiry.After(time.Now()) {
+		delete(parent.dir.negatives, name)
+		return time.Time{}, false
+	}
+	return
+}
+
+// addNegative remembers that name doesn't exist, until the returned time
+//
+// LOCKS_EXCLUDED(parent.mu)
+func (parent *Inode) addNegative(name string) time.Time {
+	now := time.Now()
+	expiry := now.Add(parent.fs.flags.NegativeCacheTTL)
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if len(parent.dir.negatives) >= maxNegativeEntries {
+		for n, e := range parent.dir.negatives {
+			if !e.After(now) {
+				delete(parent.dir.negatives, n)
+			}
+		}
+		if len(parent.dir.negatives) >= maxNegativeEntries {
+			parent.dir.negatives = nil
+		}
+	}
+	if parent.dir.negatives == nil {
+		parent.dir.negatives = make(map[string]time.Time)
+	}
+	parent.dir.negatives[name] = expiry
+	return expiry
+}
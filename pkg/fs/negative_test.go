@@ -0,0 +1,147 @@
+package fs
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func negativeFlags(ttl time.Duration) func(flags *Flags) {
+	return func(flags *Flags) {
+		flags.NegativeCacheTTL = ttl
+	}
+}
+
+// headCounter counts the HEADs that reach the backend
+type headCounter struct {
+	storage.ObjectBackend
+	heads int32
+}
+
+func (c *headCounter) HeadBlob(param *storage.HeadBlobInput) (*storage.HeadBlobOutput, error) {
+	atomic.AddInt32(&c.heads, 1)
+	return c.ObjectBackend.HeadBlob(param)
+}
+
+func TestNegativeLookup(t *testing.T) {
+	cloud := &headCounter{ObjectBackend: storage.NewMemStorage("test")}
+	fs := newTestFS(t, cloud, negativeFlags(time.Minute))
+
+	start := time.Now()
+	entry, err := lookUp(t, fs, fuseops.RootInodeID, "missing")
+	if err != nil || entry.Child != 0 {
+		t.Fatalf("lookup of a missing name = %v, %v, expecting a negative entry", entry.Child, err)
+	}
+	if entry.EntryExpiration.Before(start.Add(time.Minute)) ||
+		entry.EntryExpiration.After(time.Now().Add(time.Minute)) {
+		t.Errorf("negative entry expires at %v, expecting a minute from %v", entry.EntryExpiration, start)
+	}
+
+	heads := atomic.LoadInt32(&cloud.heads)
+	entry, err = lookUp(t, fs, fuseops.RootInodeID, "missing")
+	if err != nil || entry.Child != 0 {
+		t.Errorf("second lookup = %v, %v", entry.Child, err)
+	}
+	if atomic.LoadInt32(&cloud.heads) != heads {
+		t.Errorf("second lookup went to the backend")
+	}
+
+	// without the cache the kernel gets ENOENT
+	fs = newTestFS(t, cloud, nil)
+	if _, err := lookUp(t, fs, fuseops.RootInodeID, "missing"); err != syscall.ENOENT {
+		t.Errorf("lookup without a negative cache = %v", err)
+	}
+}
+
+// a name is forgotten as soon as it's created here
+func TestNegativeLookupCreate(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		create func(fs *FileSystem)
+	}{
+		{"create", func(fs *FileSystem) {
+			createFile(t, fs, fuseops.RootInodeID, "name", "data")
+		}},
+		{"mkdir", func(fs *FileSystem) {
+			mkDir(t, fs, fuseops.RootInodeID, "name")
+		}},
+		{"symlink", func(fs *FileSystem) {
+			err := fs.CreateSymlink(context.Background(), &fuseops.CreateSymlinkOp{
+				Parent: fuseops.RootInodeID, Name: "name", Target: "target",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"rename", func(fs *FileSystem) {
+			createFile(t, fs, fuseops.RootInodeID, "other", "data")
+			err := fs.Rename(context.Background(), &fuseops.RenameOp{
+				OldParent: fuseops.RootInodeID, OldName: "other",
+				NewParent: fuseops.RootInodeID, NewName: "name",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fs := newTestFS(t, nil, negativeFlags(time.Hour))
+			if entry, _ := lookUp(t, fs, fuseops.RootInodeID, "name"); entry.Child != 0 {
+				t.Fatalf("lookup before %v found %v", c.name, entry.Child)
+			}
+
+			c.create(fs)
+			// until the kernel forgets it, the inode answers
+			// lookups by itself
+			forgetAll(t, fs, mustLookUp(t, fs, fuseops.RootInodeID, "name"))
+			if entry, err := lookUp(t, fs, fuseops.RootInodeID, "name"); entry.Child == 0 || err != nil {
+				t.Errorf("lookup after %v = %v, %v", c.name, entry.Child, err)
+			}
+		})
+	}
+}
+
+// objects created by someone else show up once the TTL is over
+func TestNegativeLookupExpiry(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	fs := newTestFS(t, nil, negativeFlags(ttl))
+	if entry, _ := lookUp(t, fs, fuseops.RootInodeID, "name"); entry.Child != 0 {
+		t.Fatalf("lookup found %v", entry.Child)
+	}
+
+	_, err := fs.cloud.PutBlob(&storage.PutBlobInput{Key: "name", Body: strings.NewReader("data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := lookUp(t, fs, fuseops.RootInodeID, "name"); entry.Child != 0 {
+		t.Errorf("lookup within the TTL found %v", entry.Child)
+	}
+
+	time.Sleep(ttl)
+	if entry, err := lookUp(t, fs, fuseops.RootInodeID, "name"); entry.Child == 0 || err != nil {
+		t.Errorf("lookup after the TTL = %v, %v", entry.Child, err)
+	}
+}
+
+func TestNegativeEntriesBounded(t *testing.T) {
+	fs := newTestFS(t, nil, negativeFlags(time.Hour))
+	fs.mu.RLock()
+	root := fs.getInodeOrDie(fuseops.RootInodeID)
+	fs.mu.RUnlock()
+
+	for i := 0; i <= maxNegativeEntries; i++ {
+		root.addNegative(strings.Repeat("x", i+1))
+	}
+	root.mu.Lock()
+	n := len(root.dir.negatives)
+	root.mu.Unlock()
+	if n > maxNegativeEntries {
+		t.Errorf("%v negative entries, expecting at most %v", n, maxNegativeEntries)
+	}
+}
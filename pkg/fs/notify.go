@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The kernel caches attributes, directory entries and file data for as
+// long as we told it to, which is too long once we know that the object
+// changed, went away or failed to upload. Notifications make it forget
+// them right away. They are sent from their own goroutine: the kernel
+// may be holding a lock on the inode until we reply to the op that we
+// are handling, and it takes the same lock to process them.
+
+// notifyServer hands the connection to the file system before serving
+// ops, notifications are sent through it
+type notifyServer struct {
+	fuse.Server
+	fs *FileSystem
+}
+
+func (s notifyServer) ServeOps(c *fuse.Connection) {
+	s.fs.conn.Store(c)
+	s.Server.ServeOps(c)
+}
+
+func (fs *FileSystem) connection() *fuse.Connection {
+	c, _ := fs.conn.Load().(*fuse.Connection)
+	return c
+}
+
+// notifyInode makes the kernel drop the attributes and the page cache of
+// the inode
+func (fs *FileSystem) notifyInode(id fuseops.InodeID) {
+	c := fs.connection()
+	if c == nil {
+		return
+	}
+
+	go func() {
+		err := c.InvalidateInode(id, 0, 0)
+		fs.notified("inode", err)
+	}()
+}
+
+// notifyEntry makes the kernel look up name in parent again
+func (fs *FileSystem) notifyEntry(parent fuseops.InodeID, name string) {
+	c := fs.connection()
+	if c == nil {
+		return
+	}
+
+	go func() {
+		err := c.InvalidateEntry(parent, name)
+		fs.notified("entry", err)
+	}()
+}
+
+func (fs *FileSystem) notified(kind string, err error) {
+	switch err {
+	case nil:
+		kernelInvalidations.WithLabelValues(kind).Inc()
+	case syscall.ENOENT:
+		// the kernel had nothing cached
+	default:
+		fuseLog.Debugf("invalidate %v: %v", kind, err)
+	}
+}
@@ -0,0 +1,259 @@
+package fs
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Objects changed by someone else are only noticed when they are looked
+// up again after --stat-cache-ttl, and the kernel keeps serving what it
+// has until then. With --poll-interval, the directories given by
+// --poll-prefix, or the whole mount, are listed that often and compared
+// with the inodes we have: files with a new ETag take the new
+// attributes, files that are gone are removed and directories with new
+// entries are listed again on the next readdir, and the kernel is told
+// to drop what it cached of them. Only the part of the tree that was
+// looked up is compared, nothing is added to it.
+//
+// None of the backends has a change feed, so a poll lists every object
+// under the prefixes.
+
+// pollEntry is an inode as it was before the listing
+type pollEntry struct {
+	inode *Inode
+	etag  string
+}
+
+// pollChanges runs for the life of the file system
+func (fs *FileSystem) pollChanges() {
+	prefixes := fs.flags.PollPrefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	for range time.Tick(fs.flags.PollInterval) {
+		for _, p := range prefixes {
+			err := fs.pollDir(p)
+			if err != nil {
+				log.Errorf("unable to poll %v for changes: %v", p, err)
+			}
+		}
+	}
+}
+
+// findDir returns the directory at path if it was looked up
+func (fs *FileSystem) findDir(path string) *Inode {
+	fs.mu.RLock()
+	dir := fs.getInodeOrDie(fuseops.RootInodeID)
+	fs.mu.RUnlock()
+
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		dir.mu.Lock()
+		child := dir.findChildUnlocked(name)
+		dir.mu.Unlock()
+		if child == nil || !child.isDir() {
+			return nil
+		}
+		dir = child
+	}
+	return dir
+}
+
+func (fs *FileSystem) pollDir(path string) error {
+	dir := fs.findDir(path)
+	if dir == nil {
+		return nil
+	}
+
+	start := time.Now()
+
+	// by path relative to dir, directories end with /
+	cached := map[string]pollEntry{"": {inode: dir}}
+	var walk func(d *Inode, path string)
+	walk = func(d *Inode, path string) {
+		d.mu.Lock()
+		children := append([]*Inode(nil), d.dir.Children...)
+		d.mu.Unlock()
+
+		for _, child := range children {
+			name := *child.Name
+			if name == "." || name == ".." {
+				continue
+			}
+			if child.isDir() {
+				cached[path+name+"/"] = pollEntry{inode: child}
+				walk(child, path+name+"/")
+				continue
+			}
+
+			child.mu.Lock()
+			if child.isUploaded() {
+				cached[path+name] = pollEntry{child, string(child.sysMetadata["etag"])}
+			}
+			child.mu.Unlock()
+		}
+	}
+	walk(dir, "")
+
+	dir.mu.Lock()
+	cloud, prefix := dir.cloud()
+	dir.mu.Unlock()
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	seen := make(map[string]bool)
+	see := func(rel string) {
+		if seen[rel] {
+			return
+		}
+		seen[rel] = true
+		if _, ok := cached[rel]; !ok {
+			fs.pollCreated(cached, rel)
+		}
+	}
+
+	var token *string
+	for {
+		resp, err := cloud.ListBlobs(&storage.ListBlobsInput{
+			Prefix:            &prefix,
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return err
+		}
+
+		for i := range resp.Items {
+			item := &resp.Items[i]
+			if !strings.HasPrefix(*item.Key, prefix) {
+				continue
+			}
+			rel := (*item.Key)[len(prefix):]
+
+			// the directories it's in, including itself
+			// if it's a directory marker
+			for j := 0; ; {
+				k := strings.Index(rel[j:], "/")
+				if k == -1 {
+					break
+				}
+				j += k + 1
+				see(rel[:j])
+			}
+			if rel == "" || strings.HasSuffix(rel, "/") {
+				continue
+			}
+
+			see(rel)
+			if e, ok := cached[rel]; ok && !e.inode.isDir() {
+				e.pollModified(item)
+			}
+		}
+
+		if !resp.IsTruncated {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+
+	for rel, e := range cached {
+		if rel != "" && !seen[rel] {
+			fs.pollRemoved(e, start)
+		}
+	}
+	return nil
+}
+
+// pollCreated makes the directory that rel appeared in be listed again,
+// if we have it
+func (fs *FileSystem) pollCreated(cached map[string]pollEntry, rel string) {
+	name := strings.TrimSuffix(rel, "/")
+	parentPath := ""
+	if i := strings.LastIndex(name, "/"); i != -1 {
+		parentPath, name = name[:i+1], name[i+1:]
+	}
+	e, ok := cached[parentPath]
+	if !ok || !e.inode.isDir() {
+		return
+	}
+
+	parent := e.inode
+	parent.mu.Lock()
+	listed := !expired(parent.dir.DirTime, fs.flags.TypeCacheTTL)
+	_, negative := parent.dir.negatives[name]
+	parent.dir.DirTime = time.Time{}
+	delete(parent.dir.negatives, name)
+	parent.mu.Unlock()
+	if !listed && !negative {
+		// readdir and lookup go to the backend anyway
+		return
+	}
+
+	polledChanges.WithLabelValues("created").Inc()
+	fs.notifyInode(parent.Id)
+	fs.notifyEntry(parent.Id, name)
+}
+
+// pollModified applies the attributes of item if the object changed,
+// unless the file was changed locally since it was compared
+func (e pollEntry) pollModified(item *storage.BlobItemOutput) {
+	inode := e.inode
+
+	inode.mu.Lock()
+	changed := item.ETag != nil && *item.ETag != e.etag &&
+		inode.isUploaded() && string(inode.sysMetadata["etag"]) == e.etag
+	inode.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	inode.logFuse("changed in the backend", e.etag, *item.ETag)
+	inode.SetFromBlobItem(item)
+	inode.mu.Lock()
+	inode.invalidateCache = true
+	inode.mu.Unlock()
+	polledChanges.WithLabelValues("modified").Inc()
+}
+
+// pollRemoved forgets the file that isn't in the backend anymore, or
+// makes the parent of the directory be listed again. Those that were
+// changed after start are left alone, the listing may predate them.
+func (fs *FileSystem) pollRemoved(e pollEntry, start time.Time) {
+	inode := e.inode
+	parent := inode.Parent
+	if parent == nil || !inode.AttrTime.Before(start) {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if parent.findChildUnlocked(*inode.Name) != inode {
+		return
+	}
+	if inode.isDir() {
+		// nothing is under it anymore, the next readdir
+		// of the parent drops it
+		parent.dir.DirTime = time.Time{}
+	} else {
+		inode.mu.Lock()
+		unchanged := inode.isUploaded() && string(inode.sysMetadata["etag"]) == e.etag
+		inode.mu.Unlock()
+		if !unchanged || atomic.LoadInt32(&inode.fileHandles) != 0 {
+			return
+		}
+		inode.logFuse("removed from the backend")
+		inode.Parent = nil
+		parent.removeChildUnlocked(inode)
+	}
+
+	polledChanges.WithLabelValues("removed").Inc()
+	fs.notifyEntry(parent.Id, *inode.Name)
+}
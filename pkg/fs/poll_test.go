@@ -0,0 +1,98 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestPollDir(t *testing.T) {
+	// the whole mount or the directory
+	for _, prefix := range []string{"", "dir"} {
+		t.Run(fmt.Sprintf("%q", prefix), func(t *testing.T) {
+			mem := storage.NewMemStorage("test")
+			fs := newTestFS(t, mem, func(flags *Flags) {
+				flags.StatCacheTTL = time.Hour
+				flags.TypeCacheTTL = time.Hour
+				flags.NegativeCacheTTL = time.Hour
+			})
+			dir := mkDir(t, fs, fuseops.RootInodeID, "dir")
+			modified := createFile(t, fs, dir, "modified", "old")
+			createFile(t, fs, dir, "removed", "data")
+			open := createFile(t, fs, dir, "open", "data")
+			createFile(t, fs, dir, "same", "data")
+			readDir(t, fs, dir)
+			if entry, _ := lookUp(t, fs, dir, "created"); entry.Child != 0 {
+				t.Fatalf("lookup of created found %v", entry.Child)
+			}
+			fh := openHandle(t, fs, open)
+
+			// someone else changes the bucket
+			for _, c := range []struct {
+				key  string
+				data string
+			}{
+				{"dir/modified", "new data"},
+				{"dir/created", "data"},
+			} {
+				_, err := mem.PutBlob(&storage.PutBlobInput{Key: c.key, Body: strings.NewReader(c.data)})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := mem.DeleteBlobs(&storage.DeleteBlobsInput{Items: []string{"dir/removed", "dir/open"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			before := fmt.Sprint(readDirNames(t, fs, dir))
+			if before != "[modified open removed same]" {
+				t.Fatalf("dir before the poll = %v", before)
+			}
+
+			err = fs.pollDir(prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// open files stay until they are closed
+			if after := fmt.Sprint(readDirNames(t, fs, dir)); after != "[created modified open same]" {
+				t.Errorf("dir after the poll = %v", after)
+			}
+			if entry, err := lookUp(t, fs, dir, "created"); entry.Child == 0 || err != nil {
+				t.Errorf("lookup of created after the poll = %v, %v", entry.Child, err)
+			}
+			if size := getAttributes(t, fs, modified).Size; size != 8 {
+				t.Errorf("size of modified after the poll = %v", size)
+			}
+			if data := readFile(t, fs, modified); data != "new data" {
+				t.Errorf("modified after the poll = %q", data)
+			}
+			closeFile(t, fs, open, fh)
+		})
+	}
+}
+
+// only what was looked up is compared, nothing is added
+func TestPollDirNotLookedUp(t *testing.T) {
+	mem := storage.NewMemStorage("test")
+	putObjects(t, mem, "dir/", 3)
+	fs := newTestFS(t, mem, nil)
+
+	for _, prefix := range []string{"", "dir", "missing/dir"} {
+		err := fs.pollDir(prefix)
+		if err != nil {
+			t.Errorf("poll %q: %v", prefix, err)
+		}
+	}
+	fs.mu.RLock()
+	n := len(fs.inodes)
+	fs.mu.RUnlock()
+	if n != 1 {
+		t.Errorf("%v inodes after the poll, expecting only the root", n)
+	}
+}
@@ -0,0 +1,54 @@
+package fs
+
+// Readahead starts once a handle has read ReadAheadMin bytes in order.
+// The window starts at ReadAheadMin and doubles every time a readahead
+// buffer is used up, up to ReadAheadMax, and is fetched in pieces of up
+// to ReadAheadChunk. An out of order read throws the buffers away and
+// quarters the window, or turns readahead off once it is below
+// ReadAheadMin, so a random access workload soon stops reading data it
+// won't use. Until then reads are streamed, and after out of order
+// reads a stream only asks for ReadAheadMin at a time instead of the
+// rest of the object.
+
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) growReadAhead() {
+	max := fh.inode.fs.flags.ReadAheadMax
+	if fh.readAheadWindow != 0 && fh.readAheadWindow < max {
+		fh.readAheadWindow = MinUInt32(fh.readAheadWindow*2, max)
+	}
+}
+
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) shrinkReadAhead() {
+	fh.readAheadWindow /= 4
+	if fh.readAheadWindow < fh.inode.fs.flags.ReadAheadMin {
+		fh.readAheadWindow = 0
+	}
+}
+
+// discardReadAhead drops the buffers, counting what was never read
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) discardReadAhead() {
+	for _, b := range fh.buffers {
+		readaheadDiscarded.Add(float64(b.size))
+		b.buf.Close()
+	}
+	fh.buffers = nil
+}
+
+// streamCount is how much a stream started at offset should ask for,
+// 0 is the rest of the object
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) streamCount(offset uint64, want int) uint64 {
+	if fh.numOOORead == 0 {
+		return 0
+	}
+
+	count := MaxUInt64(uint64(fh.inode.fs.flags.ReadAheadMin), uint64(want))
+	if size := fh.inode.Attributes.Size; offset+count >= size {
+		return 0
+	}
+	return count
+}
@@ -0,0 +1,111 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// putObjects creates n objects under prefix in cloud
+func putObjects(t *testing.T, cloud storage.ObjectBackend, prefix string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%v%04d", prefix, i)
+		_, err := cloud.PutBlob(&storage.PutBlobInput{Key: key, Body: strings.NewReader(key)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func renameDir(t *testing.T, fs *FileSystem, from string, to string) error {
+	t.Helper()
+	// the kernel looks both up before a rename
+	mustLookUp(t, fs, fuseops.RootInodeID, from)
+	lookUp(t, fs, fuseops.RootInodeID, to)
+	return fs.Rename(context.Background(), &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   from,
+		NewParent: fuseops.RootInodeID,
+		NewName:   to,
+	})
+}
+
+// countPrefixes counts the objects by their first path component
+func countPrefixes(t *testing.T, cloud storage.ObjectBackend) map[string]int {
+	t.Helper()
+	count := make(map[string]int)
+	for _, key := range keys(t, cloud) {
+		count[strings.SplitN(key, "/", 2)[0]]++
+	}
+	return count
+}
+
+func TestRenameDir(t *testing.T) {
+	// more than a listing page and a DeleteBlobs call
+	for _, n := range []int{1, 10, 2500} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			cloud := storage.NewMemStorage("test")
+			putObjects(t, cloud, "a/", n)
+			putObjects(t, cloud, "a/sub/", 3)
+			fs := newTestFS(t, cloud, nil)
+
+			err := renameDir(t, fs, "a", "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			count := countPrefixes(t, cloud)
+			if count["a"] != 0 || count["b"] != n+3 {
+				t.Errorf("objects after rename = %v, expecting %v under b", count, n+3)
+			}
+			if data, err := objectData(t, cloud, "b/sub/0001"); data != "a/sub/0001" || err != nil {
+				t.Errorf("b/sub/0001 = %q, %v", data, err)
+			}
+
+			id := mustLookUp(t, fs, fuseops.RootInodeID, "b")
+			if names := readDirNames(t, fs, id); len(names) != n+1 {
+				t.Errorf("b has %v entries, expecting %v", len(names), n+1)
+			}
+			if _, err := lookUp(t, fs, fuseops.RootInodeID, "a"); err != syscall.ENOENT {
+				t.Errorf("lookup of a after rename = %v", err)
+			}
+		})
+	}
+}
+
+// a copy that fails leaves every object in one place or the other, see
+// TestRenameJournal for finishing it
+func TestRenameDirCopyFailure(t *testing.T) {
+	const n = 2500
+	mem := storage.NewMemStorage("test")
+	putObjects(t, mem, "a/", n)
+	cloud := storage.NewFaultInjector(mem, 0)
+	fs := newTestFS(t, cloud, nil)
+
+	cloud.AddRule(&storage.FaultRule{Method: "CopyBlob", Key: "a/1500", Err: syscall.EIO})
+	err := renameDir(t, fs, "a", "b")
+	if err == nil {
+		t.Fatal("rename succeeded with a failed copy")
+	}
+
+	names := make(map[string]string)
+	for _, key := range keys(t, mem) {
+		name := key[2:]
+		if other, ok := names[name]; ok {
+			t.Errorf("%v is in both %v and %v", name, other, key)
+		}
+		names[name] = key
+	}
+	if len(names) != n {
+		t.Errorf("%v objects after a failed rename, expecting %v", len(names), n)
+	}
+	// the pages before the failure were moved
+	if count := countPrefixes(t, mem); count["b"] != 1000 {
+		t.Errorf("objects after a failed rename = %v, expecting the first page under b", count)
+	}
+}
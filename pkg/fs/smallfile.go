@@ -0,0 +1,163 @@
+package fs
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Files no bigger than --small-file-kb are read whole when they are
+// opened and kept in memory, so that reading them again, from any
+// handle, doesn't go to the backend until the object changes. The
+// content is kept with the ETag it was read at and only used while the
+// inode still has that ETag. The least recently opened files are
+// dropped once the cache is over its size, and an inode's file is
+// dropped when the inode is forgotten.
+type SmallFileCache struct {
+	max uint64
+
+	mu   sync.Mutex
+	used uint64
+	// least recently used at the back
+	lru   *list.List
+	files map[fuseops.InodeID]*list.Element
+}
+
+type smallFile struct {
+	id   fuseops.InodeID
+	etag string
+	data []byte
+}
+
+func NewSmallFileCache(max uint64) *SmallFileCache {
+	return &SmallFileCache{
+		max:   max,
+		lru:   list.New(),
+		files: make(map[fuseops.InodeID]*list.Element),
+	}
+}
+
+func (c *SmallFileCache) get(id fuseops.InodeID, etag string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.files[id]
+	if !ok {
+		return nil
+	}
+	f := e.Value.(*smallFile)
+	if f.etag != etag {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return f.data
+}
+
+func (c *SmallFileCache) put(id fuseops.InodeID, etag string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(id)
+	c.files[id] = c.lru.PushFront(&smallFile{id, etag, data})
+	c.used += uint64(len(data))
+
+	for c.used > c.max && c.lru.Len() > 1 {
+		c.removeLocked(c.lru.Back().Value.(*smallFile).id)
+	}
+}
+
+func (c *SmallFileCache) remove(id fuseops.InodeID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(id)
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *SmallFileCache) removeLocked(id fuseops.InodeID) {
+	if e, ok := c.files[id]; ok {
+		c.used -= uint64(len(e.Value.(*smallFile).data))
+		c.lru.Remove(e)
+		delete(c.files, id)
+	}
+}
+
+// smallFileETag is the ETag to cache the content at, ok is false if the
+// file is too big or its ETag isn't known
+//
+// LOCKS_EXCLUDED(inode.mu)
+func (inode *Inode) smallFileETag() (etag string, size uint64, ok bool) {
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	v, hasETag := inode.sysMetadata["etag"]
+	if !hasETag || inode.KnownSize == nil || inode.isDir() ||
+		inode.Attributes.Size > inode.fs.flags.SmallFileSize {
+		return
+	}
+	return string(v), inode.Attributes.Size, true
+}
+
+// prefetchSmallFile reads the whole file if it's small and isn't
+// cached yet. Errors are only logged, reads will go to the backend.
+func (inode *Inode) prefetchSmallFile() {
+	cache := inode.fs.smallFiles
+
+	etag, size, ok := inode.smallFileETag()
+	if !ok || cache.get(inode.Id, etag) != nil {
+		return
+	}
+
+	cloud, key := inode.cloud()
+	resp, err := cloud.GetBlob(&storage.GetBlobInput{
+		Key:     key,
+		IfMatch: &etag,
+	})
+	if err != nil {
+		inode.errFuse("small file prefetch failed", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(size)+1))
+	if err != nil {
+		inode.errFuse("small file prefetch failed", err)
+		return
+	}
+	if uint64(len(data)) != size {
+		// the size we have is out of date, don't return
+		// something that doesn't match it
+		inode.errFuse("small file prefetch: size changed", size, len(data))
+		return
+	}
+	cache.put(inode.Id, etag, data)
+}
+
+// readSmallFile serves a read from the small file cache, ok is false if
+// the file isn't there
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) readSmallFile(offset int64, buf []byte) (bytesRead int, ok bool) {
+	if fh.dirty {
+		return
+	}
+
+	etag, size, ok := fh.inode.smallFileETag()
+	if !ok {
+		return
+	}
+	data := fh.inode.fs.smallFiles.get(fh.inode.Id, etag)
+	if data == nil || uint64(len(data)) != size {
+		return 0, false
+	}
+
+	if offset < int64(len(data)) {
+		bytesRead = copy(buf, data[offset:])
+	}
+	readBytes.WithLabelValues("memory").Add(float64(bytesRead))
+	return bytesRead, true
+}
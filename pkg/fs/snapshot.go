@@ -0,0 +1,340 @@
+package fs
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// After a mount every directory has to be listed from the backend
+// again, which takes minutes for big trees. With --metadata-snapshot,
+// the directory tree we know (names, sizes, mtimes, ETags and object
+// metadata) is written to that file every
+// --metadata-snapshot-interval and at unmount, and read back by the
+// next mount of the same bucket and prefix. Every entry keeps the time
+// it was last fetched from the backend, so it's used for what is left
+// of --stat-cache-ttl or --type-cache-ttl and then looked up or listed
+// again like any other. Files that are written to while the snapshot
+// is taken are left out, along with the listing of their directory.
+//
+// The file is gzipped JSON: a snapshotHeader followed by one
+// snapshotEntry per inode, every directory before its children.
+
+const snapshotVersion = 1
+
+type snapshotHeader struct {
+	Version int       `json:"version"`
+	Bucket  string    `json:"bucket"`
+	Prefix  string    `json:"prefix"`
+	Saved   time.Time `json:"saved"`
+}
+
+type snapshotEntry struct {
+	// relative to the mount, empty for the root
+	Path     string            `json:"path"`
+	Dir      bool              `json:"dir,omitempty"`
+	Implicit bool              `json:"implicit,omitempty"`
+	Size     uint64            `json:"size,omitempty"`
+	Mtime    time.Time         `json:"mtime"`
+	ETag     string            `json:"etag,omitempty"`
+	Meta     map[string][]byte `json:"meta,omitempty"`
+	AttrTime time.Time         `json:"attr_time"`
+	// zero if the children weren't all listed
+	DirTime time.Time `json:"dir_time"`
+}
+
+// snapshotEntry describes the inode as it's cached, ok is false if it
+// shouldn't be kept
+//
+// LOCKS_REQUIRED(inode.mu)
+func (inode *Inode) snapshotEntry(path string) (e snapshotEntry, ok bool) {
+	if inode.Invalid {
+		return
+	}
+
+	e = snapshotEntry{
+		Path:     path,
+		Mtime:    inode.Attributes.Mtime,
+		AttrTime: inode.AttrTime,
+	}
+	if inode.userMetadata != nil {
+		// encoded after the lock is released
+		e.Meta = make(map[string][]byte, len(inode.userMetadata))
+		for k, v := range inode.userMetadata {
+			e.Meta[k] = v
+		}
+	}
+	if inode.isDir() {
+		e.Dir = true
+		e.Implicit = inode.ImplicitDir
+		e.DirTime = inode.dir.DirTime
+		return e, true
+	}
+
+	if !inode.isUploaded() {
+		return e, false
+	}
+	e.Size = inode.Attributes.Size
+	e.ETag = string(inode.sysMetadata["etag"])
+	return e, true
+}
+
+// SaveSnapshot writes the directory tree to --metadata-snapshot. The
+// file is replaced only once the new one is complete.
+func (fs *FileSystem) SaveSnapshot() (err error) {
+	fs.snapshotMu.Lock()
+	defer fs.snapshotMu.Unlock()
+
+	start := time.Now()
+	path := fs.flags.MetadataSnapshot
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+		f.Close()
+	}()
+
+	buf := bufio.NewWriter(f)
+	zw := gzip.NewWriter(buf)
+	enc := json.NewEncoder(zw)
+	err = enc.Encode(snapshotHeader{
+		Version: snapshotVersion,
+		Bucket:  bucketID(fs.flags),
+		Prefix:  fs.flags.Prefix,
+		Saved:   start,
+	})
+	if err != nil {
+		return
+	}
+
+	fs.mu.RLock()
+	root := fs.getInodeOrDie(fuseops.RootInodeID)
+	fs.mu.RUnlock()
+
+	var count int
+	var walk func(dir *Inode, path string) error
+	walk = func(dir *Inode, path string) error {
+		dir.mu.Lock()
+		e, ok := dir.snapshotEntry(path)
+		children := append([]*Inode(nil), dir.dir.Children...)
+		dir.mu.Unlock()
+		if !ok {
+			return nil
+		}
+
+		var files []snapshotEntry
+		var dirs []*Inode
+		for _, child := range children {
+			if *child.Name == "." || *child.Name == ".." {
+				continue
+			}
+			if child.isDir() {
+				dirs = append(dirs, child)
+				continue
+			}
+
+			child.mu.Lock()
+			ce, ok := child.snapshotEntry(path + *child.Name)
+			child.mu.Unlock()
+			if ok {
+				files = append(files, ce)
+			} else {
+				// the listing would miss it
+				e.DirTime = time.Time{}
+			}
+		}
+
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+		for _, ce := range files {
+			err = enc.Encode(ce)
+			if err != nil {
+				return err
+			}
+		}
+		count += 1 + len(files)
+
+		for _, child := range dirs {
+			err = walk(child, path+*child.Name+"/")
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = walk(root, "")
+	if err != nil {
+		return
+	}
+
+	err = zw.Close()
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		return
+	}
+	syncDir(dir)
+
+	log.Infof("saved %v inodes to metadata snapshot %v in %v", count, path, time.Since(start))
+	return
+}
+
+// loadSnapshot adds the tree saved by a previous mount to the root,
+// before anything else is looked up
+func (fs *FileSystem) loadSnapshot() (err error) {
+	path := fs.flags.MetadataSnapshot
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(zr)
+
+	var h snapshotHeader
+	err = dec.Decode(&h)
+	if err != nil {
+		return
+	}
+	if h.Version != snapshotVersion || h.Bucket != bucketID(fs.flags) || h.Prefix != fs.flags.Prefix {
+		log.Infof("metadata snapshot %v is of %v%v version %v, not using it",
+			path, h.Bucket, h.Prefix, h.Version)
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	root := fs.getInodeOrDie(fuseops.RootInodeID)
+	dirs := map[string]*Inode{"": root}
+	defer func() {
+		if err != nil {
+			// the rest of the file is missing, and with it
+			// children of the directories we have
+			for _, dir := range dirs {
+				dir.dir.DirTime = time.Time{}
+			}
+		}
+	}()
+
+	var count int
+	for {
+		var e snapshotEntry
+		err = dec.Decode(&e)
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return fmt.Errorf("after %v entries: %v", count, err)
+		}
+
+		if e.Path == "" {
+			root.dir.DirTime = e.DirTime
+			continue
+		}
+
+		name := strings.TrimSuffix(e.Path, "/")
+		parentPath := ""
+		if i := strings.LastIndex(name, "/"); i != -1 {
+			parentPath, name = name[:i+1], name[i+1:]
+		}
+		parent := dirs[parentPath]
+		if parent == nil || name == "" || parent.findChildUnlocked(name) != nil {
+			continue
+		}
+
+		inode := NewInode(fs, parent, &name)
+		if e.Dir {
+			inode.ToDir()
+			inode.ImplicitDir = e.Implicit
+			inode.dir.DirTime = e.DirTime
+			dirs[e.Path] = inode
+		} else {
+			inode.Attributes.Size = e.Size
+			size := e.Size
+			inode.KnownSize = &size
+			etag := e.ETag
+			inode.sysMetadata["etag"] = []byte(etag)
+			inode.knownETag = &etag
+		}
+		inode.Attributes.Mtime = e.Mtime
+		if e.Meta != nil {
+			inode.userMetadata = e.Meta
+			inode.attrsFromMetadata()
+		}
+		inode.AttrTime = e.AttrTime
+		// like the entries of a listing, the kernel doesn't
+		// know about them yet
+		inode.refcnt = 0
+		fs.insertInode(parent, inode)
+		count++
+	}
+
+	log.Infof("loaded %v inodes from metadata snapshot %v saved at %v", count, path, h.Saved)
+	return
+}
+
+// saveSnapshots runs for the life of the file system
+func (fs *FileSystem) saveSnapshots() {
+	for range time.Tick(fs.flags.MetadataSnapshotInterval) {
+		err := fs.SaveSnapshot()
+		if err != nil {
+			log.Errorf("unable to save metadata snapshot %v: %v", fs.flags.MetadataSnapshot, err)
+		}
+	}
+}
+
+// expireTree makes everything we know be looked up and listed again,
+// the backend was changed behind it
+func (fs *FileSystem) expireTree() {
+	fs.mu.RLock()
+	inodes := make([]*Inode, 0, len(fs.inodes))
+	for _, inode := range fs.inodes {
+		inodes = append(inodes, inode)
+	}
+	fs.mu.RUnlock()
+
+	for _, inode := range inodes {
+		inode.mu.Lock()
+		inode.AttrTime = time.Time{}
+		if inode.isDir() {
+			inode.dir.DirTime = time.Time{}
+		}
+		inode.mu.Unlock()
+	}
+}
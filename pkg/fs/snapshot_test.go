@@ -0,0 +1,145 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// listCounter counts the HEADs and listings that reach the backend
+type listCounter struct {
+	headCounter
+	lists int32
+}
+
+func (c *listCounter) ListBlobs(param *storage.ListBlobsInput) (*storage.ListBlobsOutput, error) {
+	atomic.AddInt32(&c.lists, 1)
+	return c.ObjectBackend.ListBlobs(param)
+}
+
+func (c *listCounter) calls() int32 {
+	return atomic.LoadInt32(&c.heads) + atomic.LoadInt32(&c.lists)
+}
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	mem := storage.NewMemStorage("test")
+	withSnapshot := func(flags *Flags) {
+		flags.MetadataSnapshot = path
+	}
+
+	fs := newTestFS(t, mem, withSnapshot)
+	dir := mkDir(t, fs, fuseops.RootInodeID, "dir")
+	createFile(t, fs, dir, "a", "aaa")
+	sub := mkDir(t, fs, dir, "sub")
+	createFile(t, fs, sub, "b", "bbbbbb")
+	mode := os.FileMode(0600)
+	err := fs.SetInodeAttributes(context.Background(), &fuseops.SetInodeAttributesOp{
+		Inode: createFile(t, fs, fuseops.RootInodeID, "file", "data"), Mode: &mode,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not uploaded yet
+	busy := mkDir(t, fs, fuseops.RootInodeID, "busy")
+	op := &fuseops.CreateFileOp{Parent: busy, Name: "writing", Mode: 0644, Metadata: testMetadata()}
+	err = fs.CreateFile(context.Background(), op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, op.Entry.Child, op.Handle, 0, "data")
+
+	for _, id := range []fuseops.InodeID{fuseops.RootInodeID, dir, sub} {
+		readDir(t, fs, id)
+	}
+	err = fs.SaveSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeFile(t, fs, op.Entry.Child, op.Handle)
+
+	// the next mount knows the tree without asking the backend
+	cloud := &listCounter{headCounter: headCounter{ObjectBackend: mem}}
+	next := newTestFS(t, cloud, withSnapshot)
+	if names := readDirNames(t, next, fuseops.RootInodeID); len(names) != 3 {
+		t.Errorf("root = %v", names)
+	}
+	nextDir := mustLookUp(t, next, fuseops.RootInodeID, "dir")
+	if names := readDirNames(t, next, nextDir); len(names) != 2 {
+		t.Errorf("dir = %v", names)
+	}
+	nextSub := mustLookUp(t, next, nextDir, "sub")
+	attrs := getAttributes(t, next, mustLookUp(t, next, nextSub, "b"))
+	if attrs.Size != 6 {
+		t.Errorf("size of dir/sub/b = %v", attrs.Size)
+	}
+	attrs = getAttributes(t, next, mustLookUp(t, next, fuseops.RootInodeID, "file"))
+	if attrs.Mode.Perm() != 0600 {
+		t.Errorf("mode of file = %v", attrs.Mode)
+	}
+	if calls := cloud.calls(); calls != 0 {
+		t.Errorf("%v backend calls with a snapshot, expecting none", calls)
+	}
+
+	// the directory of the file being written is listed again
+	nextBusy := mustLookUp(t, next, fuseops.RootInodeID, "busy")
+	if names := readDirNames(t, next, nextBusy); len(names) != 1 || names[0] != "writing" {
+		t.Errorf("busy = %v", names)
+	}
+	if cloud.calls() == 0 {
+		t.Errorf("busy wasn't listed")
+	}
+	if data := readFile(t, next, mustLookUp(t, next, nextSub, "b")); data != "bbbbbb" {
+		t.Errorf("dir/sub/b = %q", data)
+	}
+}
+
+func TestSnapshotExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	mem := storage.NewMemStorage("test")
+	fs := newTestFS(t, mem, func(flags *Flags) {
+		flags.MetadataSnapshot = path
+	})
+	createFile(t, fs, fuseops.RootInodeID, "file", "data")
+	readDir(t, fs, fuseops.RootInodeID)
+	err := fs.SaveSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name  string
+		set   func(flags *Flags)
+		calls bool
+	}{
+		{"fresh", func(flags *Flags) {}, false},
+		{"expired", func(flags *Flags) {
+			flags.StatCacheTTL = time.Nanosecond
+			flags.TypeCacheTTL = time.Nanosecond
+		}, true},
+		{"other bucket", func(flags *Flags) {
+			flags.Bucket = "other"
+		}, true},
+		{"other prefix", func(flags *Flags) {
+			flags.Prefix = "prefix/"
+		}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cloud := &listCounter{headCounter: headCounter{ObjectBackend: mem}}
+			next := newTestFS(t, cloud, func(flags *Flags) {
+				flags.MetadataSnapshot = path
+				c.set(flags)
+			})
+			lookUp(t, next, fuseops.RootInodeID, "file")
+			if calls := cloud.calls() != 0; calls != c.calls {
+				t.Errorf("backend called = %v, expecting %v", calls, c.calls)
+			}
+		})
+	}
+}
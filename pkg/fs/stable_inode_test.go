@@ -0,0 +1,103 @@
+package fs
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// stableCandidates returns the first n IDs stableInodeId tries for key
+func stableCandidates(key string, n int) (ids []fuseops.InodeID) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	ids = append(ids, fuseops.InodeID(h.Sum64()))
+	for i := uint64(1); len(ids) < n; i++ {
+		var salt [8]byte
+		binary.BigEndian.PutUint64(salt[:], i)
+		h.Write(salt[:])
+		ids = append(ids, fuseops.InodeID(h.Sum64()))
+	}
+	return
+}
+
+func stableFlags(flags *Flags) {
+	flags.StableInodes = true
+}
+
+func TestStableInodes(t *testing.T) {
+	fs := newTestFS(t, nil, stableFlags)
+	file := createFile(t, fs, fuseops.RootInodeID, "name", "data")
+	dir := mkDir(t, fs, fuseops.RootInodeID, "dir")
+	sub := createFile(t, fs, dir, "file", "data")
+
+	if file != stableCandidates("name", 1)[0] {
+		t.Errorf("id of name = %v, expecting the hash of its key", file)
+	}
+	if dir != stableCandidates("dir/", 1)[0] {
+		t.Errorf("id of dir = %v, expecting the hash of its key", dir)
+	}
+
+	// the next mount, looking them up in another order
+	other := newTestFS(t, fs.cloud, stableFlags)
+	otherDir := mustLookUp(t, other, fuseops.RootInodeID, "dir")
+	for _, c := range []struct {
+		parent fuseops.InodeID
+		name   string
+		id     fuseops.InodeID
+	}{
+		{otherDir, "file", sub},
+		{fuseops.RootInodeID, "name", file},
+		{fuseops.RootInodeID, "dir", dir},
+	} {
+		if id := mustLookUp(t, other, c.parent, c.name); id != c.id {
+			t.Errorf("id of %v on the next mount = %v, expecting %v", c.name, id, c.id)
+		}
+	}
+}
+
+func TestStableInodeCollision(t *testing.T) {
+	for _, taken := range []int{1, 2, 5} {
+		fs := newTestFS(t, nil, stableFlags)
+		candidates := stableCandidates("file", taken+1)
+
+		// live inodes of other keys, ex: files removed while open
+		fs.mu.Lock()
+		for _, id := range candidates[:taken] {
+			inode := NewInode(fs, nil, PString("other"))
+			inode.Id = id
+			fs.inodes[id] = inode
+		}
+		fs.mu.Unlock()
+
+		id := createFile(t, fs, fuseops.RootInodeID, "file", "data")
+		if id != candidates[taken] {
+			t.Errorf("id of file with %v taken = %v, expecting %v", taken, id, candidates[taken])
+		}
+	}
+}
+
+// a file that is replaced while open keeps its ID, the new one takes the
+// next candidate
+func TestStableInodeReplaced(t *testing.T) {
+	fs := newTestFS(t, nil, stableFlags)
+	old := createFile(t, fs, fuseops.RootInodeID, "file", "old")
+	fh := openHandle(t, fs, old)
+
+	err := fs.Unlink(context.Background(), &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := createFile(t, fs, fuseops.RootInodeID, "file", "new")
+
+	candidates := stableCandidates("file", 2)
+	if old != candidates[0] || id != candidates[1] {
+		t.Errorf("ids = %v and %v, expecting %v", old, id, candidates)
+	}
+	if data := readFile(t, fs, id); data != "new" {
+		t.Errorf("new file = %q", data)
+	}
+	closeFile(t, fs, old, fh)
+}
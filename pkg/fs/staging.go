@@ -0,0 +1,562 @@
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+)
+
+// Files are normally written by streaming sequential writes into a
+// multipart upload, which can't go back. With --staging-dir, a handle
+// that writes out of order switches to a local staging file instead:
+// the file starts out as a sparse copy of the object, ranges are fetched
+// from the backend when they are first read, and FlushFile uploads the
+// whole thing. Parts of a big file that were neither written nor read
+// are copied from the old object on the server instead of being fetched
+// and sent back, so the staging area only ever holds, and is charged
+// for, the ranges that were touched. Purely sequential writers never
+// touch the disk.
+
+const (
+	// missing ranges are fetched in chunks of at least this size
+	stagingFetchSize   = 1024 * 1024
+	stagingMinPartSize = 5 * 1024 * 1024
+)
+
+// StagingArea bounds the disk space used by staging files
+type StagingArea struct {
+	dir string
+	max uint64
+
+	used uint64
+}
+
+func NewStagingArea(dir string, max uint64) (*StagingArea, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &StagingArea{dir: dir, max: max}, nil
+}
+
+// reserve accounts for n more bytes of staged data
+func (a *StagingArea) reserve(n uint64) bool {
+	for {
+		used := atomic.LoadUint64(&a.used)
+		if a.max != 0 && used+n > a.max {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&a.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+func (a *StagingArea) release(n uint64) {
+	atomic.AddUint64(&a.used, ^(n - 1))
+}
+
+// byteRanges is a sorted list of non-overlapping [start, end) ranges
+type byteRanges []byteRange
+
+type byteRange struct {
+	start, end uint64
+}
+
+func (r *byteRanges) add(start, end uint64) {
+	if start >= end {
+		return
+	}
+
+	merged := byteRange{start, end}
+	var out byteRanges
+	for _, c := range *r {
+		if c.end < merged.start || c.start > merged.end {
+			out = append(out, c)
+		} else {
+			merged.start = MinUInt64(merged.start, c.start)
+			merged.end = MaxUInt64(merged.end, c.end)
+		}
+	}
+	out = append(out, merged)
+	sort.Slice(out, func(i, j int) bool { return out[i].start < out[j].start })
+	*r = out
+}
+
+// truncate forgets everything at or after size
+func (r *byteRanges) truncate(size uint64) {
+	out := (*r)[:0]
+	for _, c := range *r {
+		if c.start >= size {
+			break
+		}
+		c.end = MinUInt64(c.end, size)
+		out = append(out, c)
+	}
+	*r = out
+}
+
+// total is how many bytes r covers
+func (r byteRanges) total() (n uint64) {
+	for _, c := range r {
+		n += c.end - c.start
+	}
+	return
+}
+
+// missing returns the parts of [start, end) not covered by r
+func (r byteRanges) missing(start, end uint64) (gaps []byteRange) {
+	for _, c := range r {
+		if start >= end {
+			break
+		}
+		if c.end <= start {
+			continue
+		}
+		if c.start >= end {
+			break
+		}
+		if c.start > start {
+			gaps = append(gaps, byteRange{start, c.start})
+		}
+		start = MaxUInt64(start, c.end)
+	}
+	if start < end {
+		gaps = append(gaps, byteRange{start, end})
+	}
+	return
+}
+
+type stagingFile struct {
+	area *StagingArea
+	file *os.File
+
+	// logical size of the file, the local file is kept at this size
+	size uint64
+	// bytes charged to area, those of present
+	reserved uint64
+
+	// the object we started from: data below baseSize that hasn't been
+	// written or fetched yet is still in the backend
+	baseSize uint64
+	baseETag *string
+	present  byteRanges
+}
+
+// startStaging moves the handle from streaming to a staging file. Data
+// that was already streamed is flushed first, so that the object is
+// once again the base of the file.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) startStaging() (err error) {
+	inode := fh.inode
+	area := inode.fs.staging
+
+	if fh.dirty {
+		err = fh.flushLocked()
+		if err != nil {
+			return
+		}
+	}
+
+	inode.mu.Lock()
+	var baseSize uint64
+	if inode.KnownSize != nil {
+		baseSize = *inode.KnownSize
+	}
+	baseETag := inode.knownETag
+	if etag, ok := inode.sysMetadata["etag"]; ok {
+		baseETag = PString(string(etag))
+	}
+	// the upload replaces the object, keep its metadata
+	err = inode.fillXattr()
+	inode.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	file, err := ioutil.TempFile(area.dir, "staging")
+	if err == nil {
+		// unlinked right away, the handle keeps it alive
+		os.Remove(file.Name())
+		err = file.Truncate(int64(baseSize))
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return
+	}
+
+	inode.logFuse("staging", baseSize, NilStr(baseETag))
+	fh.stage = &stagingFile{
+		area:     area,
+		file:     file,
+		size:     baseSize,
+		baseSize: baseSize,
+		baseETag: baseETag,
+	}
+	return
+}
+
+func (s *stagingFile) Close() {
+	s.file.Close()
+	s.area.release(s.reserved)
+	s.reserved = 0
+}
+
+// claim charges the parts of [start, end) that aren't on disk yet to the
+// staging area, they are given back with unclaim if they don't make it
+func (s *stagingFile) claim(start, end uint64) (n uint64, err error) {
+	for _, gap := range s.present.missing(start, end) {
+		n += gap.end - gap.start
+	}
+	if !s.area.reserve(n) {
+		log.Errorf("staging area is full: %v + %v > %v", atomic.LoadUint64(&s.area.used), n, s.area.max)
+		return 0, syscall.ENOSPC
+	}
+	s.reserved += n
+	return
+}
+
+func (s *stagingFile) unclaim(n uint64) {
+	s.area.release(n)
+	s.reserved -= n
+}
+
+// resize changes the logical size, growing leaves a hole that takes no
+// space until it's written
+func (s *stagingFile) resize(size uint64) (err error) {
+	err = s.file.Truncate(int64(size))
+	if err != nil {
+		return
+	}
+
+	if size < s.size {
+		s.present.truncate(size)
+		if size < s.baseSize {
+			s.baseSize = size
+		}
+		if kept := s.present.total(); kept < s.reserved {
+			s.unclaim(s.reserved - kept)
+		}
+	}
+	s.size = size
+	return
+}
+
+// fetch copies the ranges of [start, end) that only exist in the backend
+// into the staging file
+func (s *stagingFile) fetch(fh *FileHandle, start, end uint64) (err error) {
+	end = MinUInt64(end, s.baseSize)
+	if start >= end {
+		return
+	}
+
+	// round out to avoid many small requests for small reads
+	start -= start % stagingFetchSize
+	if r := end % stagingFetchSize; r != 0 {
+		end = MinUInt64(end+stagingFetchSize-r, s.baseSize)
+	}
+
+	_, key := fh.inode.cloud()
+	for _, gap := range s.present.missing(start, end) {
+		n, err := s.claim(gap.start, gap.end)
+		if err != nil {
+			return err
+		}
+
+		resp, err := fh.cloud.GetBlob(&storage.GetBlobInput{
+			Key:     key,
+			Start:   gap.start,
+			Count:   gap.end - gap.start,
+			IfMatch: s.baseETag,
+		})
+		if err != nil {
+			s.unclaim(n)
+			return mapStorageError(err)
+		}
+
+		err = s.copyAt(resp.Body, gap.start, gap.end-gap.start)
+		resp.Body.Close()
+		if err != nil {
+			s.unclaim(n)
+			return err
+		}
+		s.present.add(gap.start, gap.end)
+	}
+	return
+}
+
+func (s *stagingFile) copyAt(r io.Reader, offset uint64, size uint64) error {
+	buf := make([]byte, MinUInt64(size, stagingFetchSize))
+	for size != 0 {
+		n, err := io.ReadFull(r, buf[:MinUInt64(size, uint64(len(buf)))])
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		_, err = s.file.WriteAt(buf[:n], int64(offset))
+		if err != nil {
+			return err
+		}
+		offset += uint64(n)
+		size -= uint64(n)
+	}
+	return nil
+}
+
+func (s *stagingFile) WriteAt(data []byte, offset int64) (err error) {
+	end := uint64(offset) + uint64(len(data))
+	if end > s.size {
+		err = s.resize(end)
+		if err != nil {
+			return
+		}
+	}
+
+	n, err := s.claim(uint64(offset), end)
+	if err != nil {
+		return
+	}
+	_, err = s.file.WriteAt(data, offset)
+	if err != nil {
+		s.unclaim(n)
+		return
+	}
+	s.present.add(uint64(offset), end)
+	return
+}
+
+func (s *stagingFile) ReadAt(fh *FileHandle, buf []byte, offset int64) (n int, err error) {
+	if uint64(offset) >= s.size {
+		return 0, io.EOF
+	}
+	end := MinUInt64(s.size, uint64(offset)+uint64(len(buf)))
+
+	err = s.fetch(fh, uint64(offset), end)
+	if err != nil {
+		return
+	}
+
+	n, err = s.file.ReadAt(buf[:end-uint64(offset)], offset)
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// uploadPartSize picks a part size that fits size in the 10000 parts a
+// multipart upload can have
+func uploadPartSize(cloud storage.ObjectBackend, size uint64) uint64 {
+	partSize := uint64(stagingMinPartSize)
+	for size/partSize >= 10000 {
+		partSize *= 2
+	}
+	if max := cloud.Capabilities().MaxMultipartSize; max != 0 {
+		partSize = MinUInt64(partSize, max)
+	}
+	return partSize
+}
+
+// untouched is true if [start, end) is all still in the object we
+// started from and nothing of it was read or written
+func (s *stagingFile) untouched(start, end uint64) bool {
+	if end > s.baseSize || s.baseETag == nil {
+		return false
+	}
+	gaps := s.present.missing(start, end)
+	return len(gaps) == 1 && gaps[0] == byteRange{start, end}
+}
+
+// upload sends the file to the backend. A file that fits in a part is
+// fetched whole and put, a bigger one is uploaded in parallel parts, the
+// untouched ones copied from the old object.
+func (s *stagingFile) upload(fh *FileHandle) (etag *string, lastModified *time.Time,
+	storageClass *string, err error) {
+
+	fs := fh.inode.fs
+	_, key := fh.inode.cloud()
+	metadata := fh.inode.uploadMetadata()
+	contentType := fs.flags.GetMimeType(*fh.inode.FullName())
+
+	partSize := uploadPartSize(fh.cloud, s.size)
+	if s.size <= partSize {
+		err = s.fetch(fh, 0, s.baseSize)
+		if err != nil {
+			return
+		}
+
+		fs.replicators.Take(1, true)
+		defer fs.replicators.Return(1)
+
+		resp, err := fh.cloud.PutBlob(&storage.PutBlobInput{
+			Key:         key,
+			Metadata:    metadata,
+			ContentType: contentType,
+			Body:        io.NewSectionReader(s.file, 0, int64(s.size)),
+			Size:        PUInt64(s.size),
+		})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return resp.ETag, resp.LastModified, resp.StorageClass, nil
+	}
+
+	// the parts we send have to be complete before any goes out,
+	// fetch doesn't run in parallel
+	copied := make(map[uint32]bool)
+	for part, off := uint32(1), uint64(0); off < s.size; part, off = part+1, off+partSize {
+		end := MinUInt64(off+partSize, s.size)
+		if s.untouched(off, end) {
+			copied[part] = true
+			continue
+		}
+		err = s.fetch(fh, off, end)
+		if err != nil {
+			return
+		}
+	}
+
+	commit, err := fh.cloud.MultipartBlobBegin(&storage.MultipartBlobBeginInput{
+		Key:         key,
+		Metadata:    metadata,
+		ContentType: contentType,
+	})
+	if err != nil {
+		return
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for part, off := uint32(1), uint64(0); off < s.size; part, off = part+1, off+partSize {
+		size := MinUInt64(partSize, s.size-off)
+
+		fs.replicators.Take(1, true)
+		wg.Add(1)
+		go func(part uint32, off, size uint64) {
+			defer wg.Done()
+			defer fs.replicators.Return(1)
+
+			var err error
+			if copied[part] {
+				err = fh.copyPart(commit, part, key, s.baseETag, off, size)
+			} else {
+				_, err = fh.cloud.MultipartBlobAdd(&storage.MultipartBlobAddInput{
+					Commit:     commit,
+					PartNumber: part,
+					Body:       io.NewSectionReader(s.file, int64(off), int64(size)),
+					Size:       size,
+					Last:       off+size == s.size,
+					Offset:     off,
+				})
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(part, off, size)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		go fh.cloud.MultipartBlobAbort(commit)
+		return nil, nil, nil, firstErr
+	}
+
+	resp, err := fh.cloud.MultipartBlobCommit(commit)
+	if err != nil {
+		go fh.cloud.MultipartBlobAbort(commit)
+		return
+	}
+	return resp.ETag, resp.LastModified, resp.StorageClass, nil
+}
+
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) writeStaged(offset int64, data []byte) (err error) {
+	err = fh.stage.WriteAt(data, offset)
+	if err != nil {
+		fh.inode.errFuse("WriteFile: staging", offset, len(data), err)
+		return
+	}
+
+	fh.stageChanged()
+	return
+}
+
+// truncateStaged resizes the staging file, the backend sees the new size
+// on flush
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) truncateStaged(size uint64) (err error) {
+	err = fh.stage.resize(size)
+	if err != nil {
+		return
+	}
+
+	fh.stageChanged()
+	return
+}
+
+// LOCKS_REQUIRED(fh.mu)
+// LOCKS_EXCLUDED(fh.inode.mu)
+func (fh *FileHandle) stageChanged() {
+	inode := fh.inode
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if !fh.dirty {
+		fh.dirty = true
+		// same as for streaming writes, prefer to read back our own
+		// data until we flush
+		inode.knownETag = nil
+		inode.invalidateCache = false
+		inode.clearUtime()
+	}
+
+	inode.Attributes.Size = fh.stage.size
+	inode.Attributes.Mtime = time.Now()
+}
+
+// flushStaged uploads the staging file. The data stays local so a failed
+// flush can be retried, and the handle can keep writing.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) flushStaged() (err error) {
+	if !fh.dirty || fh.inode.Parent == nil {
+		return
+	}
+
+	etag, lastModified, storageClass, err := fh.stage.upload(fh)
+	if err != nil {
+		fh.inode.errFuse("staged upload failed", err)
+		return
+	}
+
+	fh.updateFromFlush(etag, lastModified, storageClass)
+
+	fh.stage.baseSize = fh.stage.size
+	fh.stage.baseETag = etag
+	size := fh.stage.size
+	fh.inode.mu.Lock()
+	fh.inode.KnownSize = &size
+	fh.inode.Invalid = false
+	fh.inode.mu.Unlock()
+	fh.dirty = false
+	return
+}
@@ -0,0 +1,97 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func readSymlink(t *testing.T, fs *FileSystem, id fuseops.InodeID) (string, error) {
+	t.Helper()
+	op := &fuseops.ReadSymlinkOp{Inode: id}
+	err := fs.ReadSymlink(context.Background(), op)
+	return op.Target, err
+}
+
+func TestSymlink(t *testing.T) {
+	for _, target := range []string{
+		"file",
+		"../dir/file",
+		"/absolute/path",
+		"with spaces and ünïcode",
+		strings.Repeat("long/", 200),
+	} {
+		fs := newTestFS(t, nil, nil)
+		op := &fuseops.CreateSymlinkOp{Parent: fuseops.RootInodeID, Name: "link", Target: target}
+		err := fs.CreateSymlink(context.Background(), op)
+		if err != nil {
+			t.Fatalf("symlink %q: %v", target, err)
+		}
+		if op.Entry.Attributes.Mode&os.ModeSymlink == 0 {
+			t.Errorf("mode of the link to %q = %v", target, op.Entry.Attributes.Mode)
+		}
+		if got, err := readSymlink(t, fs, op.Entry.Child); got != target || err != nil {
+			t.Errorf("readlink = %q, %v, expecting %q", got, err, target)
+		}
+
+		// the next mount finds it with a lookup
+		other := newTestFS(t, fs.cloud, nil)
+		id := mustLookUp(t, other, fuseops.RootInodeID, "link")
+		if mode := getAttributes(t, other, id).Mode; mode&os.ModeSymlink == 0 {
+			t.Errorf("mode of the link to %q after a lookup = %v", target, mode)
+		}
+		if got, err := readSymlink(t, other, id); got != target || err != nil {
+			t.Errorf("readlink after a lookup = %q, %v, expecting %q", got, err, target)
+		}
+	}
+}
+
+func TestSymlinkListing(t *testing.T) {
+	fs := newTestFS(t, nil, nil)
+	createFile(t, fs, fuseops.RootInodeID, "file", "data")
+	err := fs.CreateSymlink(context.Background(), &fuseops.CreateSymlinkOp{
+		Parent: fuseops.RootInodeID, Name: "link", Target: "file",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	types := func(fs *FileSystem) map[string]fuseutil.DirentType {
+		t.Helper()
+		types := make(map[string]fuseutil.DirentType)
+		for _, d := range readDir(t, fs, fuseops.RootInodeID) {
+			types[d.Name] = d.Type
+		}
+		return types
+	}
+
+	expected := map[string]fuseutil.DirentType{
+		"file": fuseutil.DT_File,
+		"link": fuseutil.DT_Link,
+	}
+	if got := types(fs); got["file"] != expected["file"] || got["link"] != expected["link"] {
+		t.Errorf("listing = %v, expecting %v", got, expected)
+	}
+
+	// a listing by itself can't tell, once the link was looked up
+	// it's recognized by its ETag even after the inode is forgotten
+	other := newTestFS(t, fs.cloud, nil)
+	link := mustLookUp(t, other, fuseops.RootInodeID, "link")
+	err = other.ForgetInode(context.Background(), &fuseops.ForgetInodeOp{Inode: link, N: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := types(other); got["file"] != expected["file"] || got["link"] != expected["link"] {
+		t.Errorf("listing after a lookup = %v, expecting %v", got, expected)
+	}
+
+	id := mustLookUp(t, other, fuseops.RootInodeID, "file")
+	if _, err := readSymlink(t, other, id); err != syscall.EINVAL {
+		t.Errorf("readlink of a file = %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"syscall"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+)
+
+// SyncFile makes what the handle wrote so far durable, with
+// --durable-fsync. The upload is committed the same way as on close, and
+// a write that continues at the end of the file starts a new upload that
+// copies the committed object back in, see resumeAfterSync.
+func (fh *FileHandle) SyncFile() (err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	fh.inode.logFuse("SyncFile")
+
+	if fh.stage != nil {
+		// the staging file is still there after the upload
+		return fh.flushStaged()
+	}
+
+	dirty, size := fh.dirty, fh.nextWriteOffset
+	err = fh.flushLocked()
+	if err == nil && dirty && size != 0 {
+		fh.resumeOffset = size
+	}
+	return
+}
+
+// resumeAfterSync goes back to streaming at the end of the object that
+// SyncFile committed. Whole parts are copied from the object on the
+// server when the backend can, the rest goes into the write buffer as if
+// it had just been written.
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) resumeAfterSync() (err error) {
+	size := uint64(fh.resumeOffset)
+	fs := fh.inode.fs
+
+	fh.inode.mu.Lock()
+	_, key := fh.inode.cloud()
+	var etag *string
+	if v, ok := fh.inode.sysMetadata["etag"]; ok {
+		etag = PString(string(v))
+	}
+	fh.inode.knownETag = nil
+	fh.inode.invalidateCache = false
+	fh.inode.clearUtime()
+	fh.inode.mu.Unlock()
+
+	fh.inode.logFuse("resumeAfterSync", size)
+
+	defer func() {
+		if err != nil {
+			fh.inode.errFuse("resume after fsync failed", size, err)
+			fh.lastWriteError = err
+		}
+	}()
+
+	// parts that are uploaded later have to be as big as partSize,
+	// only the end of the object is short of that
+	unit := fh.partSize()
+	copied := size - size%unit
+
+	var commit *storage.MultipartBlobCommitInput
+	var lastPartId uint32
+	if copied != 0 {
+		commit, err = fh.cloud.MultipartBlobBegin(&storage.MultipartBlobBeginInput{
+			Key:         key,
+			Metadata:    fh.inode.uploadMetadata(),
+			ContentType: fs.flags.GetMimeType(key),
+		})
+		if err != nil {
+			return
+		}
+
+		lastPartId, err = fh.copyParts(commit, key, etag, copied, unit)
+		if err != nil {
+			go fh.cloud.MultipartBlobAbort(commit)
+			return
+		}
+	}
+
+	var buf *MBuf
+	if tail := size - copied; tail != 0 {
+		var resp *storage.GetBlobOutput
+		resp, err = fh.cloud.GetBlob(&storage.GetBlobInput{
+			Key:     key,
+			Start:   copied,
+			Count:   tail,
+			IfMatch: etag,
+		})
+		if err == nil {
+			var data []byte
+			data, err = ioutil.ReadAll(&exactReader{resp.Body, tail})
+			resp.Body.Close()
+			if err == nil {
+				buf = MBuf{}.Init(fs.bufferPool, unit, true)
+				buf.Write(data)
+			}
+		}
+		if err != nil {
+			if commit != nil {
+				go fh.cloud.MultipartBlobAbort(commit)
+			}
+			return
+		}
+	}
+
+	if commit != nil {
+		// the upload already exists, don't let the first full
+		// buffer begin another one
+		fh.writeInit.Do(func() {})
+		fh.mpuId = commit
+		fh.mpuName = &key
+	}
+	fh.lastPartId = lastPartId
+	fh.buf = buf
+	fh.poolHandle = fs.bufferPool
+	fh.nextWriteOffset = int64(size)
+	fh.dirty = true
+	return
+}
+
+// copyParts fills the first parts of commit with the first size bytes of
+// key and returns how many parts that took
+//
+// LOCKS_REQUIRED(fh.mu)
+func (fh *FileHandle) copyParts(commit *storage.MultipartBlobCommitInput, key string, etag *string,
+	size uint64, unit uint64) (parts uint32, err error) {
+
+	fs := fh.inode.fs
+
+	// keep to a multiple of unit so that only the last part is short
+	partSize := uploadPartSize(fh.cloud, size)
+	partSize -= partSize % unit
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for off := uint64(0); off < size; off += partSize {
+		parts++
+		n := MinUInt64(partSize, size-off)
+
+		fs.replicators.Take(1, true)
+		wg.Add(1)
+		go func(part uint32, off, n uint64) {
+			defer wg.Done()
+			defer fs.replicators.Return(1)
+
+			err := fh.copyPart(commit, part, key, etag, off, n)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(parts, off, n)
+	}
+	wg.Wait()
+
+	return parts, firstErr
+}
+
+func (fh *FileHandle) copyPart(commit *storage.MultipartBlobCommitInput, part uint32, key string,
+	etag *string, off, size uint64) error {
+
+	_, err := fh.cloud.MultipartBlobCopy(&storage.MultipartBlobCopyInput{
+		Commit:     commit,
+		PartNumber: part,
+		Source:     key,
+		Offset:     off,
+		Size:       size,
+		ETag:       etag,
+	})
+	if err != syscall.ENOTSUP {
+		return err
+	}
+
+	// no server side copy, send the data back
+	resp, err := fh.cloud.GetBlob(&storage.GetBlobInput{
+		Key:     key,
+		Start:   off,
+		Count:   size,
+		IfMatch: etag,
+	})
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(&exactReader{resp.Body, size})
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = fh.cloud.MultipartBlobAdd(&storage.MultipartBlobAddInput{
+		Commit:     commit,
+		PartNumber: part,
+		Body:       bytes.NewReader(data),
+		Size:       size,
+		Offset:     off,
+	})
+	return err
+}
@@ -0,0 +1,99 @@
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// objectData returns what the backend has under key
+func objectData(t *testing.T, cloud storage.ObjectBackend, key string) (string, error) {
+	t.Helper()
+	resp, err := cloud.GetBlob(&storage.GetBlobInput{Key: key})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	return string(data), err
+}
+
+func TestDurableSync(t *testing.T) {
+	// big enough for the object to be resumed with a part copy
+	big := strings.Repeat("0123456789abcdef", 6*1024*1024/16)
+
+	for _, c := range []struct {
+		name    string
+		staging bool
+		before  string
+		after   string
+	}{
+		{"small", false, "hello", " world"},
+		{"big", false, big, "tail"},
+		{"staged", true, "hello", " world"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fs := newTestFS(t, nil, func(flags *Flags) {
+				flags.DurableSync = true
+				if c.staging {
+					flags.StagingDir = t.TempDir()
+				}
+			})
+			op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "file", Mode: 0644,
+				Metadata: testMetadata()}
+			err := fs.CreateFile(context.Background(), op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, fh := op.Entry.Child, op.Handle
+
+			writeFile(t, fs, id, fh, 0, c.before)
+			err = fs.SyncFile(context.Background(), &fuseops.SyncFileOp{Inode: id, Handle: fh})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, err := objectData(t, fs.cloud, "file"); data != c.before || err != nil {
+				t.Errorf("object after fsync = %v bytes, %v, expecting %v bytes",
+					len(data), err, len(c.before))
+			}
+
+			// the same handle carries on where it was
+			writeFile(t, fs, id, fh, int64(len(c.before)), c.after)
+			closeFile(t, fs, id, fh)
+			if data, err := objectData(t, fs.cloud, "file"); data != c.before+c.after || err != nil {
+				t.Errorf("object after close = %v bytes, %v, expecting %v bytes",
+					len(data), err, len(c.before+c.after))
+			}
+		})
+	}
+}
+
+// without --durable-fsync the data is only uploaded on close
+func TestSyncIgnored(t *testing.T) {
+	fs := newTestFS(t, nil, nil)
+	op := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "file", Mode: 0644,
+		Metadata: testMetadata()}
+	err := fs.CreateFile(context.Background(), op)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, fs, op.Entry.Child, op.Handle, 0, "hello")
+	err = fs.SyncFile(context.Background(), &fuseops.SyncFileOp{Inode: op.Entry.Child, Handle: op.Handle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := objectData(t, fs.cloud, "file"); err != syscall.ENOENT {
+		t.Errorf("object after fsync = %v, expecting it not to exist yet", err)
+	}
+
+	closeFile(t, fs, op.Entry.Child, op.Handle)
+	if data, err := objectData(t, fs.cloud, "file"); data != "hello" || err != nil {
+		t.Errorf("object after close = %q, %v", data, err)
+	}
+}
@@ -0,0 +1,222 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/storage"
+)
+
+// Truncate changes the size of a file. With a staging handle the change
+// is made locally and uploaded on flush, otherwise the object is
+// rewritten: the data we keep is copied from the old object and anything
+// past its end is zeros.
+func (inode *Inode) Truncate(fh *FileHandle, size uint64) (err error) {
+	inode.logFuse("Truncate", size)
+
+	if inode.isDir() {
+		return syscall.EISDIR
+	}
+
+	if fh != nil {
+		fh.mu.Lock()
+		defer fh.mu.Unlock()
+
+		if fh.lastWriteError != nil {
+			return fh.lastWriteError
+		}
+		fh.resumeOffset = 0
+
+		if fh.stage == nil && inode.fs.staging != nil {
+			err = fh.startStaging()
+			if err != nil {
+				return
+			}
+		}
+		if fh.stage != nil {
+			return fh.truncateStaged(size)
+		}
+
+		if fh.dirty {
+			if uint64(fh.nextWriteOffset) == size {
+				return
+			}
+			err = fh.flushLocked()
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return inode.truncateObject(size)
+}
+
+func (inode *Inode) truncateObject(size uint64) (err error) {
+	inode.mu.Lock()
+	var oldSize uint64
+	if inode.KnownSize != nil {
+		oldSize = *inode.KnownSize
+		if oldSize == size {
+			inode.mu.Unlock()
+			return
+		}
+	}
+	etag := inode.knownETag
+	if v, ok := inode.sysMetadata["etag"]; ok {
+		etag = PString(string(v))
+	}
+	// the new object replaces the old one, keep its metadata
+	err = inode.fillXattr()
+	inode.clearUtime()
+	var metadata map[string]*string
+	if inode.userMetadata != nil {
+		metadata = convertMetadata(inode.userMetadata)
+	}
+	inode.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	cloud, key := inode.cloud()
+
+	var body io.Reader = zeroReader{}
+	if keep := MinUInt64(oldSize, size); keep != 0 {
+		resp, err := cloud.GetBlob(&storage.GetBlobInput{
+			Key:     key,
+			Count:   keep,
+			IfMatch: etag,
+		})
+		if err != nil {
+			return mapStorageError(err)
+		}
+		defer resp.Body.Close()
+
+		body = io.MultiReader(&exactReader{resp.Body, keep}, zeroReader{})
+	}
+
+	resp, err := uploadStream(inode.fs, cloud, &storage.MultipartBlobBeginInput{
+		Key:         key,
+		Metadata:    metadata,
+		ContentType: inode.fs.flags.GetMimeType(*inode.FullName()),
+	}, body, size)
+	if err != nil {
+		inode.errFuse("truncate failed", size, err)
+		return
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	inode.KnownSize = &size
+	inode.Attributes.Size = size
+	inode.Invalid = false
+	if resp.LastModified != nil {
+		inode.Attributes.Mtime = *resp.LastModified
+	} else {
+		inode.Attributes.Mtime = time.Now()
+	}
+	if resp.ETag != nil {
+		inode.sysMetadata["etag"] = []byte(*resp.ETag)
+	}
+	if resp.StorageClass != nil {
+		inode.sysMetadata["storage-class"] = []byte(*resp.StorageClass)
+	}
+	inode.knownETag = resp.ETag
+	return
+}
+
+// uploadStream writes size bytes from r to a new object, with PutBlob or
+// one part at a time
+func uploadStream(fs *FileSystem, cloud storage.ObjectBackend, param *storage.MultipartBlobBeginInput,
+	r io.Reader, size uint64) (*storage.PutBlobOutput, error) {
+
+	fs.replicators.Take(1, true)
+	defer fs.replicators.Return(1)
+
+	partSize := uploadPartSize(cloud, size)
+	buf := make([]byte, MinUInt64(partSize, size))
+
+	if size <= partSize {
+		_, err := io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return cloud.PutBlob(&storage.PutBlobInput{
+			Key:         param.Key,
+			Metadata:    param.Metadata,
+			ContentType: param.ContentType,
+			Body:        bytes.NewReader(buf),
+			Size:        PUInt64(size),
+		})
+	}
+
+	commit, err := cloud.MultipartBlobBegin(param)
+	if err != nil {
+		return nil, err
+	}
+
+	for part, off := uint32(1), uint64(0); off < size; part, off = part+1, off+partSize {
+		n := MinUInt64(partSize, size-off)
+		_, err = io.ReadFull(r, buf[:n])
+		if err == nil {
+			_, err = cloud.MultipartBlobAdd(&storage.MultipartBlobAddInput{
+				Commit:     commit,
+				PartNumber: part,
+				Body:       bytes.NewReader(buf[:n]),
+				Size:       n,
+				Last:       off+n == size,
+				Offset:     off,
+			})
+		}
+		if err != nil {
+			go cloud.MultipartBlobAbort(commit)
+			return nil, err
+		}
+	}
+
+	resp, err := cloud.MultipartBlobCommit(commit)
+	if err != nil {
+		go cloud.MultipartBlobAbort(commit)
+		return nil, err
+	}
+	return &storage.PutBlobOutput{
+		ETag:         resp.ETag,
+		LastModified: resp.LastModified,
+		StorageClass: resp.StorageClass,
+		RequestId:    resp.RequestId,
+	}, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// exactReader fails instead of ending early if r has less than n bytes
+type exactReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (e *exactReader) Read(p []byte) (n int, err error) {
+	if e.n == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err = e.r.Read(p)
+	e.n -= uint64(n)
+	if err == io.EOF && e.n != 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestTruncate(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		staging bool
+		handle  bool
+		size    uint64
+		data    string
+	}{
+		{"shrink", false, false, 5, "hello"},
+		{"grow", false, false, 14, "hello world\x00\x00\x00"},
+		{"empty", false, false, 0, ""},
+		{"same size", false, false, 11, "hello world"},
+		{"shrink open", false, true, 5, "hello"},
+		{"grow open", false, true, 14, "hello world\x00\x00\x00"},
+		{"shrink staged", true, true, 5, "hello"},
+		{"grow staged", true, true, 14, "hello world\x00\x00\x00"},
+		{"empty staged", true, true, 0, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			fs := newTestFS(t, nil, func(flags *Flags) {
+				if c.staging {
+					flags.StagingDir = t.TempDir()
+				}
+			})
+			id := createFile(t, fs, fuseops.RootInodeID, "file", "hello world")
+
+			op := &fuseops.SetInodeAttributesOp{Inode: id, Size: &c.size}
+			var fh fuseops.HandleID
+			if c.handle {
+				fh = openHandle(t, fs, id)
+				op.Handle = &fh
+			}
+			err := fs.SetInodeAttributes(context.Background(), op)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if op.Attributes.Size != c.size {
+				t.Errorf("size after truncate = %v, expecting %v", op.Attributes.Size, c.size)
+			}
+			if c.handle {
+				closeFile(t, fs, id, fh)
+			}
+
+			if data := readFile(t, fs, id); data != c.data {
+				t.Errorf("read after truncate = %q, expecting %q", data, c.data)
+			}
+
+			// what the next mount sees
+			other := newTestFS(t, fs.cloud, nil)
+			id = mustLookUp(t, other, fuseops.RootInodeID, "file")
+			if size := getAttributes(t, other, id).Size; size != c.size {
+				t.Errorf("size of the object = %v, expecting %v", size, c.size)
+			}
+			if data := readFile(t, other, id); data != c.data {
+				t.Errorf("object after truncate = %q, expecting %q", data, c.data)
+			}
+		})
+	}
+}
+
+// a write after a truncate of the same handle lands past the new end
+func TestTruncateThenWrite(t *testing.T) {
+	fs := newTestFS(t, nil, func(flags *Flags) {
+		flags.StagingDir = t.TempDir()
+	})
+	id := createFile(t, fs, fuseops.RootInodeID, "file", strings.Repeat("x", 10))
+
+	fh := openHandle(t, fs, id)
+	size := uint64(4)
+	err := fs.SetInodeAttributes(context.Background(), &fuseops.SetInodeAttributesOp{
+		Inode: id, Handle: &fh, Size: &size,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, id, fh, 6, "yy")
+	closeFile(t, fs, id, fh)
+
+	if data := readFile(t, fs, id); data != "xxxx\x00\x00yy" {
+		t.Errorf("read = %q", data)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/shirou/gopsutil/process"
 )
@@ -114,7 +115,7 @@ func xattrEscape(value []byte) (s string) {
 	for _, c := range value {
 		if c == '%' {
 			s += "%25"
-		} else if unicode.IsPrint(rune(c)) {
+		} else if c < utf8.RuneSelf && unicode.IsPrint(rune(c)) {
 			s += string(c)
 		} else {
 			s += "%" + fmt.Sprintf("%02X", c)
@@ -1,6 +1,10 @@
 package storage
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+	"syscall"
+)
 
 var (
 	ErrNoSuchKey        = errors.New("no such key")
@@ -9,3 +13,31 @@ var (
 
 	ErrUnsupportedMethod = errors.New("unsupported method")
 )
+
+// mapHttpError translates the status of a failed request into the errno
+// the file system layer expects from a backend. nil means the status has
+// no errno equivalent and the caller should build its own error.
+func mapHttpError(status int) error {
+	switch status {
+	case 400:
+		return syscall.EINVAL
+	case 401:
+		return syscall.EACCES
+	case 403:
+		return syscall.EACCES
+	case 404:
+		return syscall.ENOENT
+	case 405:
+		return syscall.ENOTSUP
+	case http.StatusConflict:
+		return syscall.EINTR
+	case http.StatusPreconditionFailed:
+		return syscall.EAGAIN
+	case 429:
+		return syscall.EAGAIN
+	case 500:
+		return syscall.EAGAIN
+	default:
+		return nil
+	}
+}
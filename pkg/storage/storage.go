@@ -28,6 +28,9 @@ type ObjectBackend interface {
 	PutBlob(param *PutBlobInput) (*PutBlobOutput, error)
 	MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error)
 	MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error)
+	// MultipartBlobCopy adds a range of an existing blob as a part,
+	// backends that can't do it server side return ENOTSUP
+	MultipartBlobCopy(param *MultipartBlobCopyInput) (*MultipartBlobAddOutput, error)
 	MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error)
 	MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error)
 	MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error)
@@ -187,6 +190,8 @@ type MultipartBlobCommitInput struct {
 	Metadata map[string]*string
 	UploadId *string
 	Parts    []*string
+	// NumParts counts the parts that were added, a backend counts a
+	// part only once it has it so that a failed attempt can be retried
 	NumParts uint32
 
 	// for GCS
@@ -204,6 +209,16 @@ type MultipartBlobAddInput struct {
 	Offset uint64 // ADLv2 needs to know offset
 }
 
+type MultipartBlobCopyInput struct {
+	Commit     *MultipartBlobCommitInput
+	PartNumber uint32
+
+	Source string
+	Offset uint64
+	Size   uint64
+	ETag   *string // if non-nil, only copy if Source still has this ETag
+}
+
 type MultipartBlobAddOutput struct {
 	RequestId string
 }
@@ -368,6 +383,11 @@ func (s *ObjectBackendInitWrapper) MultipartBlobAdd(param *MultipartBlobAddInput
 	return s.ObjectBackend.MultipartBlobAdd(param)
 }
 
+func (s *ObjectBackendInitWrapper) MultipartBlobCopy(param *MultipartBlobCopyInput) (*MultipartBlobAddOutput, error) {
+	s.Init("")
+	return s.ObjectBackend.MultipartBlobCopy(param)
+}
+
 func (s *ObjectBackendInitWrapper) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
 	s.Init("")
 	return s.ObjectBackend.MultipartBlobAbort(param)
@@ -454,6 +474,10 @@ func (oe ObjectBackendInitError) MultipartBlobAdd(param *MultipartBlobAddInput)
 	return nil, oe
 }
 
+func (oe ObjectBackendInitError) MultipartBlobCopy(param *MultipartBlobCopyInput) (*MultipartBlobAddOutput, error) {
+	return nil, oe
+}
+
 func (oe ObjectBackendInitError) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
 	return nil, oe
 }
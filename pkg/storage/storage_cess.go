@@ -1,109 +1,765 @@
 package storage
 
-// TODO
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/utils"
+)
+
+// CessStorage talks to a CESS gateway over its object HTTP API:
+//
+//	HEAD   /{bucket}/{key}                          object attributes
+//	GET    /{bucket}/{key}                          object data, honours Range
+//	PUT    /{bucket}/{key}                          upload an object
+//	PUT    /{bucket}/{key} + X-Cess-Copy-Source     server side copy of the
+//	                                                URL encoded {bucket}/{key}
+//	DELETE /{bucket}/{key}                          delete an object
+//	GET    /{bucket}?list&prefix=...                list objects (JSON)
+//	POST   /{bucket}?delete                         batch delete (JSON)
+//	POST   /{bucket}/{key}?uploads                  begin a multipart upload
+//	PUT    /{bucket}/{key}?uploadId=&partNumber=    upload a part
+//	POST   /{bucket}/{key}?uploadId=                commit a multipart upload
+//	DELETE /{bucket}/{key}?uploadId=                abort a multipart upload
+//	GET    /{bucket}?uploads                        list pending uploads
+//	PUT    /{bucket}, DELETE /{bucket}              create/remove the bucket
+//
+// Every request carries the configured account and token. User metadata
+// travels in X-Cess-Meta-* headers.
+const (
+	cessAccountHeader      = "Account"
+	cessMetaHeaderPrefix   = "X-Cess-Meta-"
+	cessCopySourceHeader   = "X-Cess-Copy-Source"
+	cessCopyIfMatchHeader  = "X-Cess-Copy-Source-If-Match"
+	cessMetaDirective      = "X-Cess-Metadata-Directive"
+	cessStorageClassHeader = "X-Cess-Storage-Class"
+	cessRequestIdHeader    = "X-Cess-Request-Id"
+
+	// the gateway caps batch deletes the same way S3 does
+	cessMaxDeleteKeys = 1000
+	// uploads older than this are considered abandoned by MultipartExpire
+	cessMultipartAge = 48 * time.Hour
+)
+
+var cessLog = utils.GetLogger("cess")
+
 type CessConfig struct {
+	// Endpoint is the base URL of the gateway, ex: http://127.0.0.1:8080
+	Endpoint string
+	Account  string
+	Token    string
+	Bucket   string
+
+	HTTPTimeout time.Duration
+	// Transport overrides the default http transport, mostly useful
+	// to plug in a test server
+	Transport http.RoundTripper
 }
 
-// TODO
 type CessStorage struct {
+	config   *CessConfig
+	endpoint *url.URL
+	client   *http.Client
+	cap      Capabilities
 }
 
-// TODO
 func NewCessStorage(cfg *CessConfig) (ObjectBackend, error) {
-	return &CessStorage{}, nil
+	if cfg == nil {
+		return nil, fmt.Errorf("cess config is required")
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("cess bucket is required")
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cess endpoint %v: %v", cfg.Endpoint, err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid cess endpoint %v: expecting http(s)://host[:port]", cfg.Endpoint)
+	}
+
+	transport := cfg.Transport
+	if transport == nil {
+		transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          1000,
+			MaxIdleConnsPerHost:   1000,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 10 * time.Second,
+			ResponseHeaderTimeout: cfg.HTTPTimeout,
+		}
+	}
+
+	return &CessStorage{
+		config:   cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: transport},
+		cap: Capabilities{
+			Name:             "cess",
+			MaxMultipartSize: 5 * 1024 * 1024 * 1024,
+		},
+	}, nil
+}
+
+type cessListObject struct {
+	Key          string    `json:"key"`
+	ETag         string    `json:"etag"`
+	Size         uint64    `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	StorageClass string    `json:"storageClass,omitempty"`
+}
+
+type cessListResult struct {
+	Prefixes              []string         `json:"prefixes"`
+	Objects               []cessListObject `json:"objects"`
+	IsTruncated           bool             `json:"isTruncated"`
+	NextContinuationToken string           `json:"nextContinuationToken,omitempty"`
+}
+
+type cessDeleteRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type cessUploadResult struct {
+	UploadId string `json:"uploadId"`
+}
+
+type cessPart struct {
+	PartNumber uint32 `json:"partNumber"`
+	ETag       string `json:"etag"`
+}
+
+type cessCommitRequest struct {
+	Parts []cessPart `json:"parts"`
+}
+
+type cessCommitResult struct {
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+type cessUpload struct {
+	Key       string    `json:"key"`
+	UploadId  string    `json:"uploadId"`
+	Initiated time.Time `json:"initiated"`
+}
+
+type cessUploadList struct {
+	Uploads []cessUpload `json:"uploads"`
+}
+
+func (cs *CessStorage) url(key *string, query url.Values) string {
+	u := *cs.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + cs.config.Bucket
+	if key != nil {
+		u.Path += "/" + *key
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+func (cs *CessStorage) newRequest(method string, key *string, query url.Values,
+	body io.ReadSeeker, size int64) (req *http.Request, err error) {
+
+	var reader io.Reader
+	if body != nil {
+		reader = ioutil.NopCloser(body)
+	}
+
+	req, err = http.NewRequest(method, cs.url(key, query), reader)
+	if err != nil {
+		return
+	}
+
+	if body != nil {
+		req.ContentLength = size
+		req.GetBody = func() (io.ReadCloser, error) {
+			_, err := body.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(body), nil
+		}
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+
+	if cs.config.Account != "" {
+		req.Header.Set(cessAccountHeader, cs.config.Account)
+	}
+	if cs.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cs.config.Token)
+	}
+	return
+}
+
+func (cs *CessStorage) do(req *http.Request, expect ...int) (resp *http.Response, err error) {
+	cessLog.Debugf("%v %v", req.Method, req.URL)
+
+	resp, err = cs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, code := range expect {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+
+	// drain so the connection can be reused
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	err = mapHttpError(resp.StatusCode)
+	cessLog.Debugf("%v %v = %v %v", req.Method, req.URL, resp.Status, strings.TrimSpace(string(msg)))
+	if err == nil {
+		err = fmt.Errorf("%v %v: %v %v", req.Method, req.URL.Path, resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	return nil, err
+}
+
+func (cs *CessStorage) doJSON(req *http.Request, out interface{}, expect ...int) (requestId string, err error) {
+	resp, err := cs.do(req, expect...)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	requestId = resp.Header.Get(cessRequestIdHeader)
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return
+}
+
+// escapePath escapes every segment of path, unlike url.PathEscape which
+// also escapes the /
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func jsonBody(v interface{}) (io.ReadSeeker, int64, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(buf), int64(len(buf)), nil
+}
+
+func readSeekerSize(body io.ReadSeeker) (int64, error) {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = body.Seek(0, io.SeekStart)
+	return size, err
+}
+
+func setMetadataHeaders(h http.Header, metadata map[string]*string) {
+	for k, v := range metadata {
+		if v != nil {
+			h.Set(cessMetaHeaderPrefix+k, *v)
+		}
+	}
+}
+
+func headFromResponse(key string, resp *http.Response) (head HeadBlobOutput) {
+	head.Key = &key
+	head.RequestId = resp.Header.Get(cessRequestIdHeader)
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		head.ETag = &etag
+	}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		head.LastModified = &lm
+	}
+	if sc := resp.Header.Get(cessStorageClassHeader); sc != "" {
+		head.StorageClass = &sc
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		head.ContentType = &ct
+	}
+
+	// for ranged GETs Content-Length is the size of the range
+	if resp.ContentLength > 0 {
+		head.Size = uint64(resp.ContentLength)
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		if slash := strings.LastIndex(cr, "/"); slash != -1 {
+			if total, err := strconv.ParseUint(cr[slash+1:], 10, 64); err == nil {
+				head.Size = total
+			}
+		}
+	}
+
+	head.Metadata = make(map[string]*string)
+	for k, v := range resp.Header {
+		if strings.HasPrefix(k, cessMetaHeaderPrefix) && len(v) != 0 {
+			value := v[0]
+			head.Metadata[strings.ToLower(k[len(cessMetaHeaderPrefix):])] = &value
+		}
+	}
+	head.IsDirBlob = strings.HasSuffix(key, "/")
+	return
 }
 
-// TODO
 func (cs *CessStorage) Init(key string) error {
-	return ErrUnsupportedMethod
+	// we are not expecting this key to exist, a 404 tells us the
+	// bucket is reachable and that our credentials are fine
+	_, err := cs.HeadBlob(&HeadBlobInput{Key: key})
+	if err == syscall.ENOENT {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to access bucket %v at %v: %v",
+			cs.config.Bucket, cs.config.Endpoint, err)
+	}
+	return nil
 }
 
-// TODO
 func (cs *CessStorage) Capabilities() *Capabilities {
-	return nil
+	return &cs.cap
 }
 
-// TODO
 func (cs *CessStorage) Bucket() string {
-	return ""
+	return cs.config.Bucket
 }
 
-// TODO
 func (cs *CessStorage) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
-	return nil, ErrUnsupportedMethod
+	req, err := cs.newRequest("HEAD", &param.Key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cs.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	head := headFromResponse(param.Key, resp)
+	return &head, nil
 }
 
-// TODO
 func (cs *CessStorage) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
-	return nil, ErrUnsupportedMethod
+	query := url.Values{}
+	query.Set("list", "")
+	if param.Prefix != nil {
+		query.Set("prefix", *param.Prefix)
+	}
+	if param.Delimiter != nil {
+		query.Set("delimiter", *param.Delimiter)
+	}
+	if param.MaxKeys != nil {
+		query.Set("max-keys", strconv.FormatUint(uint64(*param.MaxKeys), 10))
+	}
+	if param.StartAfter != nil {
+		query.Set("start-after", *param.StartAfter)
+	}
+	if param.ContinuationToken != nil {
+		query.Set("continuation-token", *param.ContinuationToken)
+	}
+
+	req, err := cs.newRequest("GET", nil, query, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var res cessListResult
+	requestId, err := cs.doJSON(req, &res, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ListBlobsOutput{
+		IsTruncated: res.IsTruncated,
+		RequestId:   requestId,
+	}
+	if res.NextContinuationToken != "" {
+		out.NextContinuationToken = &res.NextContinuationToken
+	}
+	for i := range res.Prefixes {
+		out.Prefixes = append(out.Prefixes, BlobPrefixOutput{Prefix: &res.Prefixes[i]})
+	}
+	for i := range res.Objects {
+		o := &res.Objects[i]
+		item := BlobItemOutput{
+			Key:          &o.Key,
+			ETag:         &o.ETag,
+			LastModified: &o.LastModified,
+			Size:         o.Size,
+		}
+		if o.StorageClass != "" {
+			item.StorageClass = &o.StorageClass
+		}
+		out.Items = append(out.Items, item)
+	}
+
+	return out, nil
 }
 
-// TODO
 func (cs *CessStorage) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
-	return nil, ErrUnsupportedMethod
+	req, err := cs.newRequest("DELETE", &param.Key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cs.do(req, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &DeleteBlobOutput{RequestId: resp.Header.Get(cessRequestIdHeader)}, nil
 }
 
-// TODO
 func (cs *CessStorage) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
-	return nil, ErrUnsupportedMethod
+	var requestIds []string
+
+	items := param.Items
+	for len(items) != 0 {
+		n := len(items)
+		if n > cessMaxDeleteKeys {
+			n = cessMaxDeleteKeys
+		}
+
+		body, size, err := jsonBody(cessDeleteRequest{Keys: items[:n]})
+		if err != nil {
+			return nil, err
+		}
+
+		query := url.Values{}
+		query.Set("delete", "")
+		req, err := cs.newRequest("POST", nil, query, body, size)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		requestId, err := cs.doJSON(req, nil, http.StatusOK, http.StatusNoContent)
+		if err != nil {
+			return nil, err
+		}
+
+		requestIds = append(requestIds, requestId)
+		items = items[n:]
+	}
+
+	return &DeleteBlobsOutput{RequestId: strings.Join(requestIds, ", ")}, nil
 }
 
-// TODO
 func (cs *CessStorage) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
-	return nil, ErrUnsupportedMethod
+	// the gateway has no native rename, callers fall back to copy
+	// and delete
+	return nil, syscall.ENOTSUP
+}
+
+func (cs *CessStorage) MultipartBlobCopy(param *MultipartBlobCopyInput) (*MultipartBlobAddOutput, error) {
+	// no ranged copy in the gateway either, callers upload the data
+	return nil, syscall.ENOTSUP
 }
 
-// TODO
 func (cs *CessStorage) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
-	return nil, ErrUnsupportedMethod
+	req, err := cs.newRequest("PUT", &param.Destination, nil, bytes.NewReader(nil), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(cessCopySourceHeader, escapePath(cs.config.Bucket+"/"+param.Source))
+	if param.ETag != nil && *param.ETag != "" {
+		req.Header.Set(cessCopyIfMatchHeader, *param.ETag)
+	}
+	if param.Metadata != nil {
+		req.Header.Set(cessMetaDirective, "REPLACE")
+		setMetadataHeaders(req.Header, param.Metadata)
+	}
+	if param.StorageClass != nil {
+		req.Header.Set(cessStorageClassHeader, *param.StorageClass)
+	}
+
+	resp, err := cs.do(req, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &CopyBlobOutput{RequestId: resp.Header.Get(cessRequestIdHeader)}, nil
 }
 
-// TODO
 func (cs *CessStorage) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
-	return nil, ErrUnsupportedMethod
+	req, err := cs.newRequest("GET", &param.Key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if param.Start != 0 || param.Count != 0 {
+		if param.Count != 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%v-%v",
+				param.Start, param.Start+param.Count-1))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%v-", param.Start))
+		}
+	}
+	if param.IfMatch != nil {
+		req.Header.Set("If-Match", *param.IfMatch)
+	}
+
+	resp, err := cs.do(req, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return nil, err
+	}
+
+	head := headFromResponse(param.Key, resp)
+	return &GetBlobOutput{
+		HeadBlobOutput: head,
+		Body:           resp.Body,
+		RequestId:      head.RequestId,
+	}, nil
 }
 
-// TODO
 func (cs *CessStorage) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
-	return nil, ErrUnsupportedMethod
+	body := param.Body
+	if body == nil {
+		body = bytes.NewReader(nil)
+	}
+
+	var size int64
+	if param.Size != nil {
+		size = int64(*param.Size)
+	} else {
+		var err error
+		size, err = readSeekerSize(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := cs.newRequest("PUT", &param.Key, nil, body, size)
+	if err != nil {
+		return nil, err
+	}
+
+	if param.ContentType != nil {
+		req.Header.Set("Content-Type", *param.ContentType)
+	}
+	setMetadataHeaders(req.Header, param.Metadata)
+
+	resp, err := cs.do(req, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	head := headFromResponse(param.Key, resp)
+	return &PutBlobOutput{
+		ETag:         head.ETag,
+		LastModified: head.LastModified,
+		StorageClass: head.StorageClass,
+		RequestId:    head.RequestId,
+	}, nil
 }
 
-// TODO
 func (cs *CessStorage) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
-	return nil, ErrUnsupportedMethod
+	query := url.Values{}
+	query.Set("uploads", "")
+	req, err := cs.newRequest("POST", &param.Key, query, bytes.NewReader(nil), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if param.ContentType != nil {
+		req.Header.Set("Content-Type", *param.ContentType)
+	}
+	setMetadataHeaders(req.Header, param.Metadata)
+
+	var res cessUploadResult
+	_, err = cs.doJSON(req, &res, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MultipartBlobCommitInput{
+		Key:      &param.Key,
+		Metadata: param.Metadata,
+		UploadId: &res.UploadId,
+		Parts:    make([]*string, 10000), // at most 10K parts
+	}, nil
 }
 
-// TODO
 func (cs *CessStorage) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
-	return nil, ErrUnsupportedMethod
+	query := url.Values{}
+	query.Set("uploadId", *param.Commit.UploadId)
+	query.Set("partNumber", strconv.FormatUint(uint64(param.PartNumber), 10))
+
+	req, err := cs.newRequest("PUT", param.Commit.Key, query, param.Body, int64(param.Size))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cs.do(req, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	param.Commit.Parts[param.PartNumber-1] = &etag
+	atomic.AddUint32(&param.Commit.NumParts, 1)
+
+	return &MultipartBlobAddOutput{RequestId: resp.Header.Get(cessRequestIdHeader)}, nil
 }
 
-// TODO
 func (cs *CessStorage) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
-	return nil, ErrUnsupportedMethod
+	query := url.Values{}
+	query.Set("uploadId", *param.UploadId)
+	req, err := cs.newRequest("DELETE", param.Key, query, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cs.do(req, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &MultipartBlobAbortOutput{RequestId: resp.Header.Get(cessRequestIdHeader)}, nil
 }
 
-// TODO
 func (cs *CessStorage) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
-	return nil, ErrUnsupportedMethod
+	commit := cessCommitRequest{}
+	for i := uint32(0); i < param.NumParts; i++ {
+		if param.Parts[i] == nil {
+			return nil, fmt.Errorf("multipart upload of %v is missing part %v",
+				*param.Key, i+1)
+		}
+		commit.Parts = append(commit.Parts, cessPart{
+			PartNumber: i + 1,
+			ETag:       *param.Parts[i],
+		})
+	}
+
+	body, size, err := jsonBody(commit)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("uploadId", *param.UploadId)
+	req, err := cs.newRequest("POST", param.Key, query, body, size)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var res cessCommitResult
+	requestId, err := cs.doJSON(req, &res, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &MultipartBlobCommitOutput{RequestId: requestId}
+	if res.ETag != "" {
+		out.ETag = &res.ETag
+	}
+	if !res.LastModified.IsZero() {
+		out.LastModified = &res.LastModified
+	}
+	return out, nil
 }
 
-// TODO
 func (cs *CessStorage) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
-	return nil, ErrUnsupportedMethod
+	query := url.Values{}
+	query.Set("uploads", "")
+	req, err := cs.newRequest("GET", nil, query, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var res cessUploadList
+	requestId, err := cs.doJSON(req, &res, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range res.Uploads {
+		u := &res.Uploads[i]
+		if now.Sub(u.Initiated) < cessMultipartAge {
+			continue
+		}
+
+		_, err := cs.MultipartBlobAbort(&MultipartBlobCommitInput{
+			Key:      &u.Key,
+			UploadId: &u.UploadId,
+		})
+		if err != nil {
+			cessLog.Errorf("unable to expire multipart upload %v of %v: %v",
+				u.UploadId, u.Key, err)
+		} else {
+			cessLog.Infof("expired multipart upload %v of %v", u.UploadId, u.Key)
+		}
+	}
+
+	return &MultipartExpireOutput{RequestId: requestId}, nil
 }
 
-// TODO
 func (cs *CessStorage) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
-	return nil, ErrUnsupportedMethod
+	req, err := cs.newRequest("DELETE", nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cs.do(req, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &RemoveBucketOutput{RequestId: resp.Header.Get(cessRequestIdHeader)}, nil
 }
 
-// TODO
 func (cs *CessStorage) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
-	return nil, ErrUnsupportedMethod
+	req, err := cs.newRequest("PUT", nil, nil, bytes.NewReader(nil), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := cs.do(req, http.StatusOK, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &MakeBucketOutput{RequestId: resp.Header.Get(cessRequestIdHeader)}, nil
 }
 
-// TODO
 func (cs *CessStorage) Delegate() interface{} {
-	return nil
+	return cs
 }
@@ -0,0 +1,563 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// fakeGateway serves the CESS gateway API of one bucket out of a
+// MemStorage
+type fakeGateway struct {
+	t      *testing.T
+	bucket string
+	mem    *MemStorage
+
+	mu       sync.Mutex
+	requests []*http.Request
+	// status to fail the next requests with
+	failWith []int
+}
+
+func newFakeGateway(t *testing.T) (*fakeGateway, *CessStorage) {
+	g := &fakeGateway{t: t, bucket: "bkt", mem: NewMemStorage("bkt")}
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+
+	cloud, err := NewCessStorage(&CessConfig{
+		Endpoint: server.URL,
+		Account:  "acct",
+		Token:    "secret",
+		Bucket:   g.bucket,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, cloud.(*CessStorage)
+}
+
+func (g *fakeGateway) fail(status ...int) {
+	g.mu.Lock()
+	g.failWith = append(g.failWith, status...)
+	g.mu.Unlock()
+}
+
+func (g *fakeGateway) count(method string) (n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, r := range g.requests {
+		if r.Method == method {
+			n++
+		}
+	}
+	return
+}
+
+func (g *fakeGateway) errorStatus(w http.ResponseWriter, err error) {
+	switch err {
+	case syscall.ENOENT:
+		w.WriteHeader(http.StatusNotFound)
+	case syscall.EAGAIN:
+		w.WriteHeader(http.StatusPreconditionFailed)
+	case syscall.EINVAL:
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	fmt.Fprint(w, err)
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	g.requests = append(g.requests, r)
+	var status int
+	if len(g.failWith) != 0 {
+		status, g.failWith = g.failWith[0], g.failWith[1:]
+	}
+	g.mu.Unlock()
+
+	if r.Header.Get(cessAccountHeader) != "acct" || r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		fmt.Fprint(w, "injected")
+		return
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != g.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var key string
+	if len(path) == 2 {
+		key = path[1]
+	}
+	q := r.URL.Query()
+	w.Header().Set(cessRequestIdHeader, strconv.Itoa(len(g.requests)))
+
+	setHead := func(h *HeadBlobOutput) {
+		w.Header().Set("ETag", *h.ETag)
+		w.Header().Set("Last-Modified", h.LastModified.UTC().Format(http.TimeFormat))
+		for k, v := range h.Metadata {
+			w.Header().Set(cessMetaHeaderPrefix+k, *v)
+		}
+	}
+	metadata := func() map[string]*string {
+		m := make(map[string]*string)
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, cessMetaHeaderPrefix) {
+				value := v[0]
+				m[strings.ToLower(k[len(cessMetaHeaderPrefix):])] = &value
+			}
+		}
+		return m
+	}
+	uploadId := q.Get("uploadId")
+
+	switch {
+	case r.Method == "GET" && key == "" && q.Has("list"):
+		in := &ListBlobsInput{}
+		for name, p := range map[string]**string{
+			"prefix":             &in.Prefix,
+			"delimiter":          &in.Delimiter,
+			"start-after":        &in.StartAfter,
+			"continuation-token": &in.ContinuationToken,
+		} {
+			if q.Has(name) {
+				s := q.Get(name)
+				*p = &s
+			}
+		}
+		if q.Has("max-keys") {
+			n, _ := strconv.ParseUint(q.Get("max-keys"), 10, 32)
+			in.MaxKeys = aws.Uint32(uint32(n))
+		}
+		out, err := g.mem.ListBlobs(in)
+		if err != nil {
+			g.errorStatus(w, err)
+			return
+		}
+		res := cessListResult{IsTruncated: out.IsTruncated}
+		for _, p := range out.Prefixes {
+			res.Prefixes = append(res.Prefixes, *p.Prefix)
+		}
+		for _, i := range out.Items {
+			res.Objects = append(res.Objects, cessListObject{
+				Key: *i.Key, ETag: *i.ETag, Size: i.Size, LastModified: *i.LastModified,
+			})
+		}
+		if out.NextContinuationToken != nil {
+			res.NextContinuationToken = *out.NextContinuationToken
+		}
+		json.NewEncoder(w).Encode(res)
+
+	case r.Method == "POST" && key == "" && q.Has("delete"):
+		var req cessDeleteRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if len(req.Keys) > cessMaxDeleteKeys {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		g.mem.DeleteBlobs(&DeleteBlobsInput{Items: req.Keys})
+
+	case r.Method == "HEAD":
+		h, err := g.mem.HeadBlob(&HeadBlobInput{Key: key})
+		if err != nil {
+			g.errorStatus(w, err)
+			return
+		}
+		setHead(h)
+		w.Header().Set("Content-Length", strconv.FormatUint(h.Size, 10))
+
+	case r.Method == "GET":
+		in := &GetBlobInput{Key: key}
+		if rg := r.Header.Get("Range"); rg != "" {
+			se := strings.Split(strings.TrimPrefix(rg, "bytes="), "-")
+			in.Start, _ = strconv.ParseUint(se[0], 10, 64)
+			if se[1] != "" {
+				end, _ := strconv.ParseUint(se[1], 10, 64)
+				in.Count = end - in.Start + 1
+			}
+		}
+		if etag := r.Header.Get("If-Match"); etag != "" {
+			in.IfMatch = &etag
+		}
+		out, err := g.mem.GetBlob(in)
+		if err != nil {
+			g.errorStatus(w, err)
+			return
+		}
+		defer out.Body.Close()
+		setHead(&out.HeadBlobOutput)
+		if in.Start != 0 || in.Count != 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v",
+				in.Start, in.Start+in.Count-1, out.Size))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		io.Copy(w, out.Body)
+
+	case r.Method == "PUT" && uploadId != "":
+		n, _ := strconv.ParseUint(q.Get("partNumber"), 10, 32)
+		data, _ := ioutil.ReadAll(r.Body)
+		commit := &MultipartBlobCommitInput{UploadId: &uploadId, Parts: make([]*string, 10000)}
+		_, err := g.mem.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit: commit, PartNumber: uint32(n), Body: bytes.NewReader(data),
+		})
+		if err != nil {
+			g.errorStatus(w, err)
+			return
+		}
+		w.Header().Set("ETag", *commit.Parts[n-1])
+
+	case r.Method == "PUT" && r.Header.Get(cessCopySourceHeader) != "":
+		source, err := url.PathUnescape(r.Header.Get(cessCopySourceHeader))
+		if err != nil || !strings.HasPrefix(source, g.bucket+"/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		in := &CopyBlobInput{Source: source[len(g.bucket)+1:], Destination: key}
+		if r.Header.Get(cessMetaDirective) == "REPLACE" {
+			in.Metadata = metadata()
+		}
+		if etag := r.Header.Get(cessCopyIfMatchHeader); etag != "" {
+			in.ETag = &etag
+		}
+		_, err = g.mem.CopyBlob(in)
+		if err != nil {
+			g.errorStatus(w, err)
+			return
+		}
+
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		if int64(len(data)) != r.ContentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		out, err := g.mem.PutBlob(&PutBlobInput{Key: key, Body: bytes.NewReader(data), Metadata: metadata()})
+		if err != nil {
+			g.errorStatus(w, err)
+			return
+		}
+		w.Header().Set("ETag", *out.ETag)
+		w.WriteHeader(http.StatusCreated)
+
+	case r.Method == "DELETE" && uploadId != "":
+		_, err := g.mem.MultipartBlobAbort(&MultipartBlobCommitInput{UploadId: &uploadId})
+		if err != nil {
+			g.errorStatus(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "DELETE":
+		g.mem.DeleteBlob(&DeleteBlobInput{Key: key})
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "POST" && q.Has("uploads"):
+		commit, err := g.mem.MultipartBlobBegin(&MultipartBlobBeginInput{Key: key, Metadata: metadata()})
+		if err != nil {
+			g.errorStatus(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(cessUploadResult{UploadId: *commit.UploadId})
+
+	case r.Method == "POST" && uploadId != "":
+		var req cessCommitRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		for i, p := range req.Parts {
+			if p.PartNumber != uint32(i+1) || p.ETag == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		out, err := g.mem.MultipartBlobCommit(&MultipartBlobCommitInput{
+			UploadId: &uploadId,
+			NumParts: uint32(len(req.Parts)),
+		})
+		if err != nil {
+			g.errorStatus(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(cessCommitResult{ETag: *out.ETag, LastModified: time.Now()})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func putString(t *testing.T, cloud ObjectBackend, key string, data string) {
+	t.Helper()
+	_, err := cloud.PutBlob(&PutBlobInput{Key: key, Body: strings.NewReader(data)})
+	if err != nil {
+		t.Fatalf("put %v: %v", key, err)
+	}
+}
+
+func getString(t *testing.T, cloud ObjectBackend, in *GetBlobInput) string {
+	t.Helper()
+	resp, err := cloud.GetBlob(in)
+	if err != nil {
+		t.Fatalf("get %v: %v", in.Key, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("get %v: %v", in.Key, err)
+	}
+	return string(data)
+}
+
+func TestCessPutHeadGet(t *testing.T) {
+	_, cloud := newFakeGateway(t)
+
+	put, err := cloud.PutBlob(&PutBlobInput{
+		Key:      "dir/file",
+		Body:     strings.NewReader("hello world"),
+		Metadata: map[string]*string{"mode": aws.String("644")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put.ETag == nil || *put.ETag == "" {
+		t.Fatal("no etag from put")
+	}
+
+	head, err := cloud.HeadBlob(&HeadBlobInput{Key: "dir/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Size != 11 || *head.ETag != *put.ETag || head.LastModified == nil {
+		t.Errorf("head = size %v etag %v lastModified %v", head.Size, *head.ETag, head.LastModified)
+	}
+	if v := head.Metadata["mode"]; v == nil || *v != "644" {
+		t.Errorf("metadata = %v", head.Metadata)
+	}
+
+	if s := getString(t, cloud, &GetBlobInput{Key: "dir/file"}); s != "hello world" {
+		t.Errorf("get = %q", s)
+	}
+	if s := getString(t, cloud, &GetBlobInput{Key: "dir/file", Start: 6, Count: 3}); s != "wor" {
+		t.Errorf("ranged get = %q", s)
+	}
+	resp, err := cloud.GetBlob(&GetBlobInput{Key: "dir/file", Start: 6, Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Size != 11 {
+		t.Errorf("ranged get size = %v, expecting the object size", resp.Size)
+	}
+
+	_, err = cloud.GetBlob(&GetBlobInput{Key: "dir/file", IfMatch: aws.String("\"other\"")})
+	if err != syscall.EAGAIN {
+		t.Errorf("get with a stale etag = %v, expecting EAGAIN", err)
+	}
+}
+
+func TestCessErrors(t *testing.T) {
+	g, cloud := newFakeGateway(t)
+
+	_, err := cloud.HeadBlob(&HeadBlobInput{Key: "missing"})
+	if err != syscall.ENOENT {
+		t.Errorf("head of a missing key = %v", err)
+	}
+	if err = cloud.Init("missing"); err != nil {
+		t.Errorf("init = %v", err)
+	}
+
+	for status, expected := range map[int]error{
+		http.StatusForbidden:           syscall.EACCES,
+		http.StatusTooManyRequests:     syscall.EAGAIN,
+		http.StatusInternalServerError: syscall.EAGAIN,
+		http.StatusConflict:            syscall.EINTR,
+	} {
+		g.fail(status)
+		_, err = cloud.HeadBlob(&HeadBlobInput{Key: "missing"})
+		if err != expected {
+			t.Errorf("status %v = %v, expecting %v", status, err, expected)
+		}
+	}
+
+	g.fail(http.StatusBadGateway)
+	_, err = cloud.HeadBlob(&HeadBlobInput{Key: "missing"})
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("status 502 = %v", err)
+	}
+
+	cloud.config.Token = "wrong"
+	if err = cloud.Init("missing"); err == nil {
+		t.Error("init with a wrong token succeeded")
+	}
+}
+
+func TestCessListBlobs(t *testing.T) {
+	_, cloud := newFakeGateway(t)
+
+	for _, key := range []string{"a/1", "a/2", "a/b/3", "a-b", "c"} {
+		putString(t, cloud, key, key)
+	}
+
+	resp, err := cloud.ListBlobs(&ListBlobsInput{Delimiter: aws.String("/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prefixes, keys []string
+	for _, p := range resp.Prefixes {
+		prefixes = append(prefixes, *p.Prefix)
+	}
+	for _, i := range resp.Items {
+		keys = append(keys, *i.Key)
+	}
+	if fmt.Sprint(prefixes) != "[a/]" || fmt.Sprint(keys) != "[a-b c]" || resp.IsTruncated {
+		t.Errorf("list = %v %v truncated %v", prefixes, keys, resp.IsTruncated)
+	}
+
+	// page through everything under a/
+	keys = nil
+	var token *string
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("listing doesn't end")
+		}
+		resp, err = cloud.ListBlobs(&ListBlobsInput{
+			Prefix:            aws.String("a/"),
+			MaxKeys:           aws.Uint32(2),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range resp.Items {
+			keys = append(keys, *i.Key)
+			if i.Size != uint64(len(*i.Key)) || i.ETag == nil || i.LastModified == nil {
+				t.Errorf("item %v = %+v", *i.Key, i)
+			}
+		}
+		if !resp.IsTruncated {
+			break
+		}
+		token = resp.NextContinuationToken
+	}
+	if fmt.Sprint(keys) != "[a/1 a/2 a/b/3]" {
+		t.Errorf("paged list = %v", keys)
+	}
+}
+
+func TestCessCopyAndDelete(t *testing.T) {
+	g, cloud := newFakeGateway(t)
+
+	keys := []string{"plain", "with space", "100%", "päth/ü", "q?x#y"}
+	for _, key := range keys {
+		putString(t, cloud, key, "data of "+key)
+		_, err := cloud.CopyBlob(&CopyBlobInput{Source: key, Destination: "copy/" + key})
+		if err != nil {
+			t.Fatalf("copy %q: %v", key, err)
+		}
+		if s := getString(t, cloud, &GetBlobInput{Key: "copy/" + key}); s != "data of "+key {
+			t.Errorf("copy of %q = %q", key, s)
+		}
+	}
+
+	_, err := cloud.CopyBlob(&CopyBlobInput{Source: "plain", Destination: "x", ETag: aws.String("\"stale\"")})
+	if err != syscall.EAGAIN {
+		t.Errorf("copy with a stale etag = %v, expecting EAGAIN", err)
+	}
+
+	_, err = cloud.DeleteBlob(&DeleteBlobInput{Key: "plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cloud.HeadBlob(&HeadBlobInput{Key: "plain"}); err != syscall.ENOENT {
+		t.Errorf("head after delete = %v", err)
+	}
+
+	// more than one batch
+	var many []string
+	for i := 0; i < cessMaxDeleteKeys+10; i++ {
+		key := fmt.Sprintf("many/%v", i)
+		g.mem.PutBlob(&PutBlobInput{Key: key, Body: strings.NewReader("")})
+		many = append(many, key)
+	}
+	posts := g.count("POST")
+	_, err = cloud.DeleteBlobs(&DeleteBlobsInput{Items: many})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := g.count("POST") - posts; n != 2 {
+		t.Errorf("%v batch deletes, expecting 2", n)
+	}
+	resp, err := cloud.ListBlobs(&ListBlobsInput{Prefix: aws.String("many/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 0 {
+		t.Errorf("%v keys left after DeleteBlobs", len(resp.Items))
+	}
+}
+
+func TestCessMultipart(t *testing.T) {
+	_, cloud := newFakeGateway(t)
+
+	commit, err := cloud.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "big file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []byte
+	for part := uint32(1); part <= 3; part++ {
+		data := bytes.Repeat([]byte{byte('a' + part)}, 1000)
+		expected = append(expected, data...)
+		_, err = cloud.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit:     commit,
+			PartNumber: part,
+			Body:       bytes.NewReader(data),
+			Size:       uint64(len(data)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if commit.NumParts != 3 {
+		t.Errorf("%v parts counted", commit.NumParts)
+	}
+
+	out, err := cloud.MultipartBlobCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.ETag == nil || *out.ETag == "" {
+		t.Error("no etag from commit")
+	}
+	if s := getString(t, cloud, &GetBlobInput{Key: "big file"}); s != string(expected) {
+		t.Errorf("committed %v bytes, expecting %v", len(s), len(expected))
+	}
+
+	commit, err = cloud.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "aborted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cloud.MultipartBlobAbort(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cloud.MultipartBlobAbort(commit); err != syscall.ENOENT {
+		t.Errorf("second abort = %v", err)
+	}
+}
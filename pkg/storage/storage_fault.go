@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/utils"
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+var faultLog = utils.GetLogger("fault")
+
+// FaultRule describes a failure to inject into the calls it matches.
+type FaultRule struct {
+	// Method is the ObjectBackend method to match, ex: GetBlob. Empty
+	// matches every method.
+	Method string
+	// Key is a path.Match pattern for the key of the call, that is the
+	// prefix for ListBlobs and the source for RenameBlob and CopyBlob.
+	// Empty matches every key.
+	Key string
+	// Probability of firing on a matching call, 0 is the same as 1
+	Probability float64
+	// After lets the first After matching calls through
+	After int
+	// Count stops the rule after firing that many times, 0 is unlimited
+	Count int
+
+	// Latency is added before the call
+	Latency time.Duration
+	// Err is returned instead of making the call
+	Err error
+	// Truncate cuts GetBlob bodies after that many bytes, reading past
+	// it fails with io.ErrUnexpectedEOF
+	Truncate int64
+	// DropPart makes MultipartBlobAdd report success without uploading
+	// the part
+	DropPart bool
+
+	matched int64
+	fired   int64
+}
+
+func (r *FaultRule) String() string {
+	var s []string
+	if r.Method != "" {
+		s = append(s, "method="+r.Method)
+	}
+	if r.Key != "" {
+		s = append(s, "key="+r.Key)
+	}
+	if r.Probability != 0 {
+		s = append(s, fmt.Sprintf("p=%v", r.Probability))
+	}
+	if r.After != 0 {
+		s = append(s, fmt.Sprintf("after=%v", r.After))
+	}
+	if r.Count != 0 {
+		s = append(s, fmt.Sprintf("count=%v", r.Count))
+	}
+	if r.Latency != 0 {
+		s = append(s, fmt.Sprintf("latency=%v", r.Latency))
+	}
+	if r.Err != nil {
+		s = append(s, fmt.Sprintf("err=%v", r.Err))
+	}
+	if r.Truncate != 0 {
+		s = append(s, fmt.Sprintf("truncate=%v", r.Truncate))
+	}
+	if r.DropPart {
+		s = append(s, "drop")
+	}
+	return strings.Join(s, ",")
+}
+
+// Fired returns how many times the rule was applied
+func (r *FaultRule) Fired() int {
+	return int(atomic.LoadInt64(&r.fired))
+}
+
+var faultErrors = map[string]error{
+	"EIO":       syscall.EIO,
+	"EAGAIN":    syscall.EAGAIN,
+	"ENOENT":    syscall.ENOENT,
+	"EACCES":    syscall.EACCES,
+	"EINVAL":    syscall.EINVAL,
+	"EINTR":     syscall.EINTR,
+	"ENOSPC":    syscall.ENOSPC,
+	"ENOTSUP":   syscall.ENOTSUP,
+	"ETIMEDOUT": syscall.ETIMEDOUT,
+	"EOF":       io.ErrUnexpectedEOF,
+}
+
+// ParseFaultRules parses rules separated by ';', each a comma separated
+// list of:
+//
+//	method=<name>    key=<pattern>    p=<probability>
+//	after=<n>        count=<n>        latency=<duration>
+//	err=<EIO|EAGAIN|ENOENT|...>       truncate=<bytes>    drop
+//
+// ex: "method=MultipartBlobAdd,after=2,count=1,drop;method=GetBlob,p=0.1,err=EIO"
+//
+// A rule that is just seed=<n> seeds the random numbers used for p, so
+// that a failing run can be replayed.
+func ParseFaultRules(spec string) (rules []*FaultRule, seed int64, err error) {
+	seed = 1
+
+	for _, r := range strings.Split(spec, ";") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		if strings.HasPrefix(r, "seed=") {
+			seed, err = strconv.ParseInt(r[5:], 10, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid fault seed %q", r)
+			}
+			continue
+		}
+
+		rule := &FaultRule{}
+		for _, opt := range strings.Split(r, ",") {
+			name, value := opt, ""
+			if eq := strings.IndexByte(opt, '='); eq != -1 {
+				name, value = opt[:eq], opt[eq+1:]
+			}
+
+			switch name {
+			case "method":
+				rule.Method = value
+			case "key":
+				rule.Key = value
+				_, err = path.Match(value, "")
+			case "p":
+				rule.Probability, err = strconv.ParseFloat(value, 64)
+			case "after":
+				rule.After, err = strconv.Atoi(value)
+			case "count":
+				rule.Count, err = strconv.Atoi(value)
+			case "latency":
+				rule.Latency, err = time.ParseDuration(value)
+			case "err":
+				var ok bool
+				if rule.Err, ok = faultErrors[strings.ToUpper(value)]; !ok {
+					err = fmt.Errorf("unknown error")
+				}
+			case "truncate":
+				rule.Truncate, err = strconv.ParseInt(value, 10, 64)
+			case "drop":
+				rule.DropPart = true
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid fault rule %q at %q: %v", r, opt, err)
+			}
+		}
+
+		if rule.Latency == 0 && rule.Err == nil && rule.Truncate == 0 && !rule.DropPart {
+			return nil, 0, fmt.Errorf("fault rule %q does nothing, "+
+				"add one of latency, err, truncate or drop", r)
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+// FaultInjector is an ObjectBackend that makes calls to the backend it
+// wraps fail according to a set of rules, to reproduce partial failures.
+// Rules are evaluated in order and every rule that fires applies, so a
+// call can be both delayed and failed.
+type FaultInjector struct {
+	ObjectBackend
+
+	mu    sync.Mutex
+	rules []*FaultRule
+	rand  *rand.Rand
+}
+
+func NewFaultInjector(backend ObjectBackend, seed int64, rules ...*FaultRule) *FaultInjector {
+	return &FaultInjector{
+		ObjectBackend: backend,
+		rules:         rules,
+		rand:          rand.New(rand.NewSource(seed)),
+	}
+}
+
+func (f *FaultInjector) AddRule(rule *FaultRule) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = append(f.rules, rule)
+}
+
+// ClearRules lets all calls through from now on
+func (f *FaultInjector) ClearRules() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = nil
+}
+
+type faultAction struct {
+	err      error
+	truncate int64
+	drop     bool
+}
+
+// inject applies the latency of the rules matching method on any of keys
+// and returns what else the call should do
+func (f *FaultInjector) inject(method string, keys ...string) (action faultAction) {
+	var latency time.Duration
+
+	f.mu.Lock()
+	for _, r := range f.rules {
+		if r.Method != "" && r.Method != method {
+			continue
+		}
+		if r.Key != "" && !matchesAny(r.Key, keys) {
+			continue
+		}
+
+		r.matched++
+		if int(r.matched) <= r.After {
+			continue
+		}
+		if r.Count != 0 && int(r.fired) >= r.Count {
+			continue
+		}
+		if r.Probability != 0 && f.rand.Float64() >= r.Probability {
+			continue
+		}
+		atomic.AddInt64(&r.fired, 1)
+
+		faultLog.Warnf("%v %v: injecting %v", method, strings.Join(keys, " "), r)
+		latency += r.Latency
+		if action.err == nil {
+			action.err = r.Err
+		}
+		if r.Truncate != 0 {
+			action.truncate = r.Truncate
+		}
+		action.drop = action.drop || r.DropPart
+	}
+	f.mu.Unlock()
+
+	if latency != 0 {
+		time.Sleep(latency)
+	}
+	return
+}
+
+func matchesAny(pattern string, keys []string) bool {
+	for _, k := range keys {
+		if ok, _ := path.Match(pattern, k); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// truncatedBody returns the first n bytes of the body and then fails,
+// like a connection that broke midway
+type truncatedBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	return n, err
+}
+
+func (f *FaultInjector) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	if a := f.inject("HeadBlob", param.Key); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.HeadBlob(param)
+}
+
+func (f *FaultInjector) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	var prefix string
+	if param.Prefix != nil {
+		prefix = *param.Prefix
+	}
+	if a := f.inject("ListBlobs", prefix); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.ListBlobs(param)
+}
+
+func (f *FaultInjector) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	if a := f.inject("DeleteBlob", param.Key); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.DeleteBlob(param)
+}
+
+func (f *FaultInjector) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	if a := f.inject("DeleteBlobs", param.Items...); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.DeleteBlobs(param)
+}
+
+func (f *FaultInjector) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	if a := f.inject("RenameBlob", param.Source, param.Destination); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.RenameBlob(param)
+}
+
+func (f *FaultInjector) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	if a := f.inject("CopyBlob", param.Source, param.Destination); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.CopyBlob(param)
+}
+
+func (f *FaultInjector) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	a := f.inject("GetBlob", param.Key)
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	resp, err := f.ObjectBackend.GetBlob(param)
+	if err == nil && a.truncate != 0 {
+		resp.Body = &truncatedBody{resp.Body, a.truncate}
+	}
+	return resp, err
+}
+
+func (f *FaultInjector) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	if a := f.inject("PutBlob", param.Key); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.PutBlob(param)
+}
+
+func (f *FaultInjector) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	if a := f.inject("MultipartBlobBegin", param.Key); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.MultipartBlobBegin(param)
+}
+
+func (f *FaultInjector) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	a := f.inject("MultipartBlobAdd", *param.Commit.Key)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if a.drop {
+		// count the part like a backend would, but don't send it
+		atomic.AddUint32(&param.Commit.NumParts, 1)
+		param.Commit.Parts[param.PartNumber-1] = aws.String(fmt.Sprintf("\"dropped-%v\"", param.PartNumber))
+		return &MultipartBlobAddOutput{}, nil
+	}
+	return f.ObjectBackend.MultipartBlobAdd(param)
+}
+
+func (f *FaultInjector) MultipartBlobCopy(param *MultipartBlobCopyInput) (*MultipartBlobAddOutput, error) {
+	if a := f.inject("MultipartBlobCopy", *param.Commit.Key, param.Source); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.MultipartBlobCopy(param)
+}
+
+func (f *FaultInjector) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	if a := f.inject("MultipartBlobAbort", *param.Key); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.MultipartBlobAbort(param)
+}
+
+func (f *FaultInjector) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	if a := f.inject("MultipartBlobCommit", *param.Key); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.MultipartBlobCommit(param)
+}
+
+func (f *FaultInjector) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	if a := f.inject("MultipartExpire"); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.MultipartExpire(param)
+}
+
+func (f *FaultInjector) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	if a := f.inject("RemoveBucket"); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.RemoveBucket(param)
+}
+
+func (f *FaultInjector) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	if a := f.inject("MakeBucket"); a.err != nil {
+		return nil, a.err
+	}
+	return f.ObjectBackend.MakeBucket(param)
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a multipart upload through the wrappers NewCloud stacks, fault then
+// retry, must commit every part even when adding them failed
+func TestFaultRetryMultipart(t *testing.T) {
+	for _, spec := range []string{
+		"method=MultipartBlobAdd,err=EAGAIN,count=1",
+		"method=MultipartBlobAdd,err=EAGAIN,after=2,count=1",
+		"method=MultipartBlobAdd,err=EAGAIN,p=0.5",
+		"method=MultipartBlobCopy,err=EAGAIN,count=2",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			rules, seed, err := ParseFaultRules(spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mem := NewMemStorage("test")
+			cloud := NewObjectBackendRetryWrapper(NewFaultInjector(mem, seed, rules...),
+				RetryConfig{MaxRetries: 10, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+			src := []byte("0123456789abcdef")
+			_, err = mem.PutBlob(&PutBlobInput{Key: "src", Body: bytes.NewReader(src)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			commit, err := cloud.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "dst"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected []byte
+			for part := uint32(1); part <= 4; part++ {
+				data := []byte(fmt.Sprintf("part %v;", part))
+				expected = append(expected, data...)
+				_, err = cloud.MultipartBlobAdd(&MultipartBlobAddInput{
+					Commit:     commit,
+					PartNumber: part,
+					Body:       bytes.NewReader(data),
+					Size:       uint64(len(data)),
+				})
+				if err != nil {
+					t.Fatalf("part %v: %v", part, err)
+				}
+			}
+			_, err = cloud.MultipartBlobCopy(&MultipartBlobCopyInput{
+				Commit:     commit,
+				PartNumber: 5,
+				Source:     "src",
+				Offset:     4,
+				Size:       8,
+			})
+			if err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+			expected = append(expected, src[4:12]...)
+
+			_, err = cloud.MultipartBlobCommit(commit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commit.NumParts != 5 {
+				t.Errorf("%v parts counted, expecting 5", commit.NumParts)
+			}
+
+			resp, err := mem.GetBlob(&GetBlobInput{Key: "dst"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			got, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, expected) {
+				t.Errorf("committed %q, expecting %q", got, expected)
+			}
+			if rules[0].Fired() == 0 {
+				t.Errorf("%v never fired", rules[0])
+			}
+		})
+	}
+}
+
+// lostReply commits an upload and then fails as if the reply was lost
+type lostReply struct {
+	ObjectBackend
+}
+
+func (l lostReply) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	_, err := l.ObjectBackend.MultipartBlobCommit(param)
+	if err != nil {
+		return nil, err
+	}
+	return nil, syscall.EAGAIN
+}
+
+// a commit whose retry finds the upload gone mustn't report success, the
+// upload may just as well have been lost
+func TestRetryAmbiguousCommit(t *testing.T) {
+	mem := NewMemStorage("test")
+	cloud := NewObjectBackendRetryWrapper(lostReply{mem},
+		RetryConfig{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	commit, err := cloud.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "dst"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cloud.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit:     commit,
+		PartNumber: 1,
+		Body:       bytes.NewReader([]byte("data")),
+		Size:       4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := cloud.MultipartBlobCommit(commit)
+	if err != syscall.EAGAIN || out != nil {
+		t.Errorf("commit = %+v, %v, expecting the error of the failed attempt", out, err)
+	}
+	if stats := cloud.Stats(); stats.Retries != 1 {
+		t.Errorf("%v", stats)
+	}
+}
@@ -0,0 +1,531 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// MemStorage keeps every blob in memory. It follows the same semantics as
+// the S3-like backends (flat keys, "dir/" blobs, delimiter listings with
+// common prefixes, opaque continuation tokens) so it can stand in for them
+// in tests and serve scratch mounts.
+type MemStorage struct {
+	bucket string
+	cap    Capabilities
+
+	mu       sync.RWMutex
+	blobs    map[string]*memBlob
+	keys     []string // sorted, kept in sync with blobs
+	uploads  map[string]*memUpload
+	uploadId uint64
+}
+
+type memBlob struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+	contentType  *string
+	storageClass string
+	metadata     map[string]*string
+}
+
+type memUpload struct {
+	key         string
+	contentType *string
+	metadata    map[string]*string
+	initiated   time.Time
+
+	mu    sync.Mutex
+	parts map[uint32][]byte
+}
+
+const memDefaultMaxKeys = 1000
+
+func NewMemStorage(bucket string) *MemStorage {
+	return &MemStorage{
+		bucket: bucket,
+		cap: Capabilities{
+			Name: "mem",
+		},
+		blobs:   make(map[string]*memBlob),
+		uploads: make(map[string]*memUpload),
+	}
+}
+
+func memETag(data []byte) string {
+	sum := md5.Sum(data)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+func copyMetadata(meta map[string]*string) map[string]*string {
+	if meta == nil {
+		return nil
+	}
+	ret := make(map[string]*string, len(meta))
+	for k, v := range meta {
+		if v != nil {
+			value := *v
+			ret[strings.ToLower(k)] = &value
+		}
+	}
+	return ret
+}
+
+func copyStringPtr(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	v := *s
+	return &v
+}
+
+func (b *memBlob) item(key string) BlobItemOutput {
+	etag := b.etag
+	lastModified := b.lastModified
+	storageClass := b.storageClass
+	return BlobItemOutput{
+		Key:          &key,
+		ETag:         &etag,
+		LastModified: &lastModified,
+		Size:         uint64(len(b.data)),
+		StorageClass: &storageClass,
+	}
+}
+
+func (b *memBlob) head(key string) HeadBlobOutput {
+	return HeadBlobOutput{
+		BlobItemOutput: b.item(key),
+		ContentType:    copyStringPtr(b.contentType),
+		Metadata:       copyMetadata(b.metadata),
+		IsDirBlob:      strings.HasSuffix(key, "/"),
+	}
+}
+
+// LOCKS_REQUIRED(m.mu)
+func (m *MemStorage) putUnlocked(key string, blob *memBlob) {
+	if _, ok := m.blobs[key]; !ok {
+		i := sort.SearchStrings(m.keys, key)
+		m.keys = append(m.keys, "")
+		copy(m.keys[i+1:], m.keys[i:])
+		m.keys[i] = key
+	}
+	m.blobs[key] = blob
+}
+
+// LOCKS_REQUIRED(m.mu)
+func (m *MemStorage) deleteUnlocked(key string) bool {
+	if _, ok := m.blobs[key]; !ok {
+		return false
+	}
+	delete(m.blobs, key)
+	i := sort.SearchStrings(m.keys, key)
+	m.keys = append(m.keys[:i], m.keys[i+1:]...)
+	return true
+}
+
+func readAllBody(body io.ReadSeeker) ([]byte, error) {
+	if body == nil {
+		return []byte{}, nil
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
+
+func (m *MemStorage) Init(key string) error {
+	return nil
+}
+
+func (m *MemStorage) Capabilities() *Capabilities {
+	return &m.cap
+}
+
+func (m *MemStorage) Bucket() string {
+	return m.bucket
+}
+
+func (m *MemStorage) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	blob, ok := m.blobs[param.Key]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+
+	head := blob.head(param.Key)
+	return &head, nil
+}
+
+func (m *MemStorage) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	var prefix, delimiter, marker string
+	if param.Prefix != nil {
+		prefix = *param.Prefix
+	}
+	if param.Delimiter != nil {
+		delimiter = *param.Delimiter
+	}
+	// the continuation token is simply the last key or common prefix
+	// returned, same as StartAfter
+	if param.StartAfter != nil {
+		marker = *param.StartAfter
+	}
+	if param.ContinuationToken != nil && *param.ContinuationToken > marker {
+		marker = *param.ContinuationToken
+	}
+	maxKeys := memDefaultMaxKeys
+	if param.MaxKeys != nil && *param.MaxKeys != 0 {
+		maxKeys = int(*param.MaxKeys)
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := &ListBlobsOutput{}
+	var last string
+
+	i := sort.SearchStrings(m.keys, prefix)
+	if marker != "" && marker >= prefix {
+		i = sort.Search(len(m.keys), func(i int) bool { return m.keys[i] > marker })
+	}
+
+	for ; i < len(m.keys); i++ {
+		key := m.keys[i]
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+
+		if delimiter != "" {
+			if idx := strings.Index(key[len(prefix):], delimiter); idx != -1 {
+				commonPrefix := key[:len(prefix)+idx+len(delimiter)]
+				if commonPrefix == last || commonPrefix <= marker {
+					// already returned this prefix, either
+					// in this page or in a previous one
+					continue
+				}
+				if len(out.Prefixes)+len(out.Items) == maxKeys {
+					out.IsTruncated = true
+					break
+				}
+				out.Prefixes = append(out.Prefixes, BlobPrefixOutput{
+					Prefix: aws.String(commonPrefix),
+				})
+				last = commonPrefix
+				continue
+			}
+		}
+
+		if len(out.Prefixes)+len(out.Items) == maxKeys {
+			out.IsTruncated = true
+			break
+		}
+		out.Items = append(out.Items, m.blobs[key].item(key))
+		last = key
+	}
+
+	if out.IsTruncated {
+		out.NextContinuationToken = aws.String(last)
+	}
+	return out, nil
+}
+
+func (m *MemStorage) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// like S3, deleting a missing key is not an error
+	m.deleteUnlocked(param.Key)
+	return &DeleteBlobOutput{}, nil
+}
+
+func (m *MemStorage) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range param.Items {
+		m.deleteUnlocked(key)
+	}
+	return &DeleteBlobsOutput{}, nil
+}
+
+func (m *MemStorage) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	blob, ok := m.blobs[param.Source]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	if param.Source == param.Destination {
+		return &RenameBlobOutput{}, nil
+	}
+
+	m.deleteUnlocked(param.Source)
+	m.putUnlocked(param.Destination, blob)
+	return &RenameBlobOutput{}, nil
+}
+
+func (m *MemStorage) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	src, ok := m.blobs[param.Source]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	if param.ETag != nil && *param.ETag != "" && *param.ETag != src.etag {
+		return nil, syscall.EAGAIN
+	}
+
+	dst := &memBlob{
+		// blobs are never modified in place, so sharing data is fine
+		data:         src.data,
+		etag:         src.etag,
+		lastModified: time.Now(),
+		contentType:  copyStringPtr(src.contentType),
+		storageClass: src.storageClass,
+		metadata:     copyMetadata(src.metadata),
+	}
+	if param.Metadata != nil {
+		dst.metadata = copyMetadata(param.Metadata)
+	}
+	if param.StorageClass != nil {
+		dst.storageClass = *param.StorageClass
+	}
+
+	m.putUnlocked(param.Destination, dst)
+	return &CopyBlobOutput{}, nil
+}
+
+func (m *MemStorage) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	blob, ok := m.blobs[param.Key]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	if param.IfMatch != nil && *param.IfMatch != blob.etag {
+		return nil, syscall.EAGAIN
+	}
+
+	size := uint64(len(blob.data))
+	if param.Start > size || (param.Start == size && size != 0) {
+		return nil, syscall.EINVAL
+	}
+	end := size
+	if param.Count != 0 && param.Start+param.Count < size {
+		end = param.Start + param.Count
+	}
+
+	return &GetBlobOutput{
+		HeadBlobOutput: blob.head(param.Key),
+		Body:           ioutil.NopCloser(bytes.NewReader(blob.data[param.Start:end])),
+	}, nil
+}
+
+func (m *MemStorage) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	data, err := readAllBody(param.Body)
+	if err != nil {
+		return nil, err
+	}
+	if param.Size != nil && *param.Size != uint64(len(data)) {
+		return nil, fmt.Errorf("put %v: expected %v bytes, got %v",
+			param.Key, *param.Size, len(data))
+	}
+
+	blob := &memBlob{
+		data:         data,
+		etag:         memETag(data),
+		lastModified: time.Now(),
+		contentType:  copyStringPtr(param.ContentType),
+		storageClass: "STANDARD",
+		metadata:     copyMetadata(param.Metadata),
+	}
+
+	m.mu.Lock()
+	m.putUnlocked(param.Key, blob)
+	m.mu.Unlock()
+
+	return &PutBlobOutput{
+		ETag:         aws.String(blob.etag),
+		LastModified: &blob.lastModified,
+		StorageClass: aws.String(blob.storageClass),
+	}, nil
+}
+
+func (m *MemStorage) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	id := fmt.Sprintf("mem-%v", atomic.AddUint64(&m.uploadId, 1))
+
+	m.mu.Lock()
+	m.uploads[id] = &memUpload{
+		key:         param.Key,
+		contentType: copyStringPtr(param.ContentType),
+		metadata:    copyMetadata(param.Metadata),
+		initiated:   time.Now(),
+		parts:       make(map[uint32][]byte),
+	}
+	m.mu.Unlock()
+
+	return &MultipartBlobCommitInput{
+		Key:      aws.String(param.Key),
+		Metadata: param.Metadata,
+		UploadId: &id,
+		Parts:    make([]*string, 10000), // at most 10K parts
+	}, nil
+}
+
+func (m *MemStorage) getUpload(commit *MultipartBlobCommitInput) (*memUpload, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	upload, ok := m.uploads[*commit.UploadId]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return upload, nil
+}
+
+func (m *MemStorage) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	if param.PartNumber == 0 || int(param.PartNumber) > len(param.Commit.Parts) {
+		return nil, syscall.EINVAL
+	}
+
+	upload, err := m.getUpload(param.Commit)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readAllBody(param.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	upload.mu.Lock()
+	upload.parts[param.PartNumber] = data
+	upload.mu.Unlock()
+
+	param.Commit.Parts[param.PartNumber-1] = aws.String(memETag(data))
+	atomic.AddUint32(&param.Commit.NumParts, 1)
+	return &MultipartBlobAddOutput{}, nil
+}
+
+func (m *MemStorage) MultipartBlobCopy(param *MultipartBlobCopyInput) (*MultipartBlobAddOutput, error) {
+	src, err := m.GetBlob(&GetBlobInput{
+		Key:     param.Source,
+		Start:   param.Offset,
+		Count:   param.Size,
+		IfMatch: param.ETag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, _ := ioutil.ReadAll(src.Body)
+
+	return m.MultipartBlobAdd(&MultipartBlobAddInput{
+		Commit:     param.Commit,
+		PartNumber: param.PartNumber,
+		Body:       bytes.NewReader(data),
+		Size:       uint64(len(data)),
+	})
+}
+
+func (m *MemStorage) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.uploads[*param.UploadId]; !ok {
+		return nil, syscall.ENOENT
+	}
+	delete(m.uploads, *param.UploadId)
+	return &MultipartBlobAbortOutput{}, nil
+}
+
+func (m *MemStorage) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	upload, err := m.getUpload(param)
+	if err != nil {
+		return nil, err
+	}
+
+	upload.mu.Lock()
+	var data []byte
+	etags := md5.New()
+	for i := uint32(1); i <= param.NumParts; i++ {
+		part, ok := upload.parts[i]
+		if !ok {
+			upload.mu.Unlock()
+			return nil, fmt.Errorf("multipart upload of %v is missing part %v", upload.key, i)
+		}
+		data = append(data, part...)
+		sum := md5.Sum(part)
+		etags.Write(sum[:])
+	}
+	upload.mu.Unlock()
+
+	if data == nil {
+		data = []byte{}
+	}
+
+	blob := &memBlob{
+		data:         data,
+		etag:         fmt.Sprintf("\"%v-%v\"", hex.EncodeToString(etags.Sum(nil)), param.NumParts),
+		lastModified: time.Now(),
+		contentType:  upload.contentType,
+		storageClass: "STANDARD",
+		metadata:     upload.metadata,
+	}
+	if param.Metadata != nil {
+		blob.metadata = copyMetadata(param.Metadata)
+	}
+
+	m.mu.Lock()
+	delete(m.uploads, *param.UploadId)
+	m.putUnlocked(upload.key, blob)
+	m.mu.Unlock()
+
+	return &MultipartBlobCommitOutput{
+		ETag:         aws.String(blob.etag),
+		LastModified: &blob.lastModified,
+		StorageClass: aws.String(blob.storageClass),
+	}, nil
+}
+
+func (m *MemStorage) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	return &MultipartExpireOutput{}, nil
+}
+
+func (m *MemStorage) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.blobs) != 0 {
+		return nil, syscall.ENOTEMPTY
+	}
+	m.uploads = make(map[string]*memUpload)
+	return &RemoveBucketOutput{}, nil
+}
+
+func (m *MemStorage) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	return &MakeBucketOutput{}, nil
+}
+
+func (m *MemStorage) Delegate() interface{} {
+	return m
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// listAll pages through ListBlobs maxKeys at a time, and returns the
+// prefixes and keys of every page
+func listAll(t *testing.T, cloud ObjectBackend, in ListBlobsInput, maxKeys uint32) (pages []string) {
+	t.Helper()
+	in.MaxKeys = &maxKeys
+	for {
+		resp, err := cloud.ListBlobs(&in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page []string
+		for _, p := range resp.Prefixes {
+			page = append(page, *p.Prefix)
+		}
+		for _, i := range resp.Items {
+			page = append(page, *i.Key)
+		}
+		pages = append(pages, strings.Join(page, " "))
+		if !resp.IsTruncated {
+			return
+		}
+		if len(pages) > 100 {
+			t.Fatal("listing doesn't end")
+		}
+		in.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+func TestMemListBlobs(t *testing.T) {
+	mem := NewMemStorage("test")
+	for _, key := range []string{"a/", "a/1", "a/2", "a/b/3", "a/c/4", "a-b", "b/5", "c"} {
+		putString(t, mem, key, key)
+	}
+
+	for _, c := range []struct {
+		in       ListBlobsInput
+		maxKeys  uint32
+		expected string
+	}{
+		{ListBlobsInput{}, 0, "[a-b a/ a/1 a/2 a/b/3 a/c/4 b/5 c]"},
+		{ListBlobsInput{}, 3, "[a-b a/ a/1 a/2 a/b/3 a/c/4 b/5 c]"},
+		{ListBlobsInput{Delimiter: aws.String("/")}, 0, "[a/ b/ a-b c]"},
+		{ListBlobsInput{Delimiter: aws.String("/")}, 1, "[a-b a/ b/ c]"},
+		{ListBlobsInput{Prefix: aws.String("a/"), Delimiter: aws.String("/")}, 0, "[a/b/ a/c/ a/ a/1 a/2]"},
+		// every page has its prefixes first
+		{ListBlobsInput{Prefix: aws.String("a/"), Delimiter: aws.String("/")}, 2, "[a/ a/1 a/b/ a/2 a/c/]"},
+		{ListBlobsInput{Prefix: aws.String("a/"), StartAfter: aws.String("a/2")}, 0, "[a/b/3 a/c/4]"},
+		{ListBlobsInput{Prefix: aws.String("x")}, 0, "[]"},
+	} {
+		pages := listAll(t, mem, c.in, c.maxKeys)
+		var all []string
+		for _, p := range pages {
+			if p != "" {
+				all = append(all, strings.Split(p, " ")...)
+			}
+			if c.maxKeys != 0 && len(strings.Fields(p)) > int(c.maxKeys) {
+				t.Errorf("page %q has more than %v entries", p, c.maxKeys)
+			}
+		}
+		if fmt.Sprint(all) != c.expected {
+			t.Errorf("list prefix %v delimiter %v max %v = %v (pages %q), expecting %v",
+				aws.StringValue(c.in.Prefix), aws.StringValue(c.in.Delimiter), c.maxKeys,
+				all, pages, c.expected)
+		}
+	}
+
+	// a continuation token is still good after the key it names is
+	// deleted
+	resp, err := mem.ListBlobs(&ListBlobsInput{MaxKeys: aws.Uint32(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem.DeleteBlob(&DeleteBlobInput{Key: "a/1"})
+	resp, err = mem.ListBlobs(&ListBlobsInput{ContinuationToken: resp.NextContinuationToken, MaxKeys: aws.Uint32(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 1 || *resp.Items[0].Key != "a/2" {
+		t.Errorf("list after the deleted token = %+v", resp.Items)
+	}
+}
+
+func TestMemMultipart(t *testing.T) {
+	mem := NewMemStorage("test")
+	putString(t, mem, "src", "0123456789")
+
+	commit, err := mem.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key:      "dst",
+		Metadata: map[string]*string{"Mode": aws.String("600")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// in any order
+	for _, part := range []uint32{3, 1} {
+		_, err = mem.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit:     commit,
+			PartNumber: part,
+			Body:       bytes.NewReader([]byte(fmt.Sprintf("part%v ", part))),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = mem.MultipartBlobCopy(&MultipartBlobCopyInput{
+		Commit:     commit,
+		PartNumber: 2,
+		Source:     "src",
+		Offset:     2,
+		Size:       3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.NumParts != 3 {
+		t.Errorf("%v parts counted", commit.NumParts)
+	}
+
+	_, err = mem.MultipartBlobAdd(&MultipartBlobAddInput{Commit: commit, PartNumber: 0, Body: bytes.NewReader(nil)})
+	if err != syscall.EINVAL {
+		t.Errorf("part 0 = %v", err)
+	}
+	if commit.NumParts != 3 {
+		t.Errorf("a failed part was counted")
+	}
+
+	out, err := mem.MultipartBlobCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(*out.ETag, "-3\"") {
+		t.Errorf("etag of 3 parts = %v", *out.ETag)
+	}
+	if s := getString(t, mem, &GetBlobInput{Key: "dst"}); s != "part1 234part3 " {
+		t.Errorf("committed %q", s)
+	}
+	head, err := mem.HeadBlob(&HeadBlobInput{Key: "dst"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := head.Metadata["mode"]; v == nil || *v != "600" {
+		t.Errorf("metadata = %v", head.Metadata)
+	}
+
+	// the upload is gone once committed
+	if _, err = mem.MultipartBlobCommit(commit); err != syscall.ENOENT {
+		t.Errorf("second commit = %v", err)
+	}
+
+	// a hole is refused
+	commit, err = mem.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "holes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mem.MultipartBlobAdd(&MultipartBlobAddInput{Commit: commit, PartNumber: 2, Body: bytes.NewReader([]byte("x"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit.NumParts = 2
+	if _, err = mem.MultipartBlobCommit(commit); err == nil {
+		t.Error("committed an upload without part 1")
+	}
+	if _, err = mem.MultipartBlobAbort(commit); err != nil {
+		t.Error(err)
+	}
+	if _, err = mem.HeadBlob(&HeadBlobInput{Key: "holes"}); err != syscall.ENOENT {
+		t.Errorf("head of the aborted upload = %v", err)
+	}
+}
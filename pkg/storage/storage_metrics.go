@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ObjectBackendMetricsWrapper counts the calls made to the backend it
+// wraps, their errors, latency and the bytes transferred. It goes below
+// ObjectBackendRetryWrapper so that every attempt is counted.
+type ObjectBackendMetricsWrapper struct {
+	ObjectBackend
+
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	bytes    *prometheus.CounterVec
+}
+
+func NewObjectBackendMetricsWrapper(backend ObjectBackend, reg prometheus.Registerer) (*ObjectBackendMetricsWrapper, error) {
+	m := &ObjectBackendMetricsWrapper{
+		ObjectBackend: backend,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cessfuse",
+			Subsystem: "backend",
+			Name:      "requests_total",
+			Help:      "Backend requests, by method.",
+		}, []string{"method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cessfuse",
+			Subsystem: "backend",
+			Name:      "errors_total",
+			Help:      "Backend requests that failed, by method.",
+		}, []string{"method"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "cessfuse",
+			Subsystem: "backend",
+			Name:      "request_duration_seconds",
+			Help:      "Backend request latency, by method. For GetBlob this is the time to the response, not to the end of the body.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2.5, 12),
+		}, []string{"method"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cessfuse",
+			Subsystem: "backend",
+			Name:      "bytes_total",
+			Help:      "Object data transferred, by direction (read or write).",
+		}, []string{"direction"}),
+	}
+
+	for _, c := range []prometheus.Collector{m.requests, m.errors, m.duration, m.bytes} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *ObjectBackendMetricsWrapper) observe(method string, start time.Time, err *error) {
+	m.requests.WithLabelValues(method).Inc()
+	m.duration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		m.errors.WithLabelValues(method).Inc()
+	}
+}
+
+// bodySize is how much of body is left to be sent
+func bodySize(body io.ReadSeeker) int64 {
+	if body == nil {
+		return 0
+	}
+	cur, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+	end, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+	body.Seek(cur, io.SeekStart)
+	return end - cur
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (b countingBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.counter.Add(float64(n))
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) HeadBlob(param *HeadBlobInput) (out *HeadBlobOutput, err error) {
+	defer m.observe("HeadBlob", time.Now(), &err)
+	out, err = m.ObjectBackend.HeadBlob(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) ListBlobs(param *ListBlobsInput) (out *ListBlobsOutput, err error) {
+	defer m.observe("ListBlobs", time.Now(), &err)
+	out, err = m.ObjectBackend.ListBlobs(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) DeleteBlob(param *DeleteBlobInput) (out *DeleteBlobOutput, err error) {
+	defer m.observe("DeleteBlob", time.Now(), &err)
+	out, err = m.ObjectBackend.DeleteBlob(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) DeleteBlobs(param *DeleteBlobsInput) (out *DeleteBlobsOutput, err error) {
+	defer m.observe("DeleteBlobs", time.Now(), &err)
+	out, err = m.ObjectBackend.DeleteBlobs(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) RenameBlob(param *RenameBlobInput) (out *RenameBlobOutput, err error) {
+	defer m.observe("RenameBlob", time.Now(), &err)
+	out, err = m.ObjectBackend.RenameBlob(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) CopyBlob(param *CopyBlobInput) (out *CopyBlobOutput, err error) {
+	defer m.observe("CopyBlob", time.Now(), &err)
+	out, err = m.ObjectBackend.CopyBlob(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) GetBlob(param *GetBlobInput) (out *GetBlobOutput, err error) {
+	defer m.observe("GetBlob", time.Now(), &err)
+	out, err = m.ObjectBackend.GetBlob(param)
+	if err == nil {
+		out.Body = countingBody{out.Body, m.bytes.WithLabelValues("read")}
+	}
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) PutBlob(param *PutBlobInput) (out *PutBlobOutput, err error) {
+	defer m.observe("PutBlob", time.Now(), &err)
+	size := bodySize(param.Body)
+	out, err = m.ObjectBackend.PutBlob(param)
+	if err == nil {
+		m.bytes.WithLabelValues("write").Add(float64(size))
+	}
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) MultipartBlobBegin(param *MultipartBlobBeginInput) (out *MultipartBlobCommitInput, err error) {
+	defer m.observe("MultipartBlobBegin", time.Now(), &err)
+	out, err = m.ObjectBackend.MultipartBlobBegin(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) MultipartBlobAdd(param *MultipartBlobAddInput) (out *MultipartBlobAddOutput, err error) {
+	defer m.observe("MultipartBlobAdd", time.Now(), &err)
+	size := bodySize(param.Body)
+	out, err = m.ObjectBackend.MultipartBlobAdd(param)
+	if err == nil {
+		m.bytes.WithLabelValues("write").Add(float64(size))
+	}
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) MultipartBlobCopy(param *MultipartBlobCopyInput) (out *MultipartBlobAddOutput, err error) {
+	defer m.observe("MultipartBlobCopy", time.Now(), &err)
+	out, err = m.ObjectBackend.MultipartBlobCopy(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) MultipartBlobAbort(param *MultipartBlobCommitInput) (out *MultipartBlobAbortOutput, err error) {
+	defer m.observe("MultipartBlobAbort", time.Now(), &err)
+	out, err = m.ObjectBackend.MultipartBlobAbort(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) MultipartBlobCommit(param *MultipartBlobCommitInput) (out *MultipartBlobCommitOutput, err error) {
+	defer m.observe("MultipartBlobCommit", time.Now(), &err)
+	out, err = m.ObjectBackend.MultipartBlobCommit(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) MultipartExpire(param *MultipartExpireInput) (out *MultipartExpireOutput, err error) {
+	defer m.observe("MultipartExpire", time.Now(), &err)
+	out, err = m.ObjectBackend.MultipartExpire(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) RemoveBucket(param *RemoveBucketInput) (out *RemoveBucketOutput, err error) {
+	defer m.observe("RemoveBucket", time.Now(), &err)
+	out, err = m.ObjectBackend.RemoveBucket(param)
+	return
+}
+
+func (m *ObjectBackendMetricsWrapper) MakeBucket(param *MakeBucketInput) (out *MakeBucketOutput, err error) {
+	defer m.observe("MakeBucket", time.Now(), &err)
+	out, err = m.ObjectBackend.MakeBucket(param)
+	return
+}
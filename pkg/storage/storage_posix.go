@@ -0,0 +1,890 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"golang.org/x/sys/unix"
+)
+
+// PosixStorage uses a local directory as the blob store. Key a/b/c is the
+// file <root>/a/b/c and the dir blob a/b/ is the directory <root>/a/b, so
+// the tree can be inspected and modified with regular tools. Metadata and
+// content type are kept in user.cess.* xattrs on the file itself, which
+// means they follow the file through renames.
+//
+// Multipart uploads stage their parts as files under <root>/.cess-fuse,
+// which is hidden from listings.
+type PosixStorage struct {
+	root string
+	cap  Capabilities
+
+	mu      sync.Mutex
+	uploads map[string]*posixUpload
+}
+
+type posixUpload struct {
+	key         string
+	dir         string
+	metadata    map[string]*string
+	contentType *string
+}
+
+const (
+	posixInternalDir = ".cess-fuse"
+
+	posixXattrMetaPrefix  = "user.cess.meta."
+	posixXattrContentType = "user.cess.content-type"
+)
+
+func NewPosixStorage(root string) (*PosixStorage, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PosixStorage{
+		root: root,
+		cap: Capabilities{
+			Name:    "posix",
+			DirBlob: true,
+		},
+		uploads: make(map[string]*posixUpload),
+	}, nil
+}
+
+func mapPosixError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	} else if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	} else if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	if err == syscall.ENOTDIR {
+		// a/b/c where a/b is a file simply doesn't exist
+		return syscall.ENOENT
+	}
+	return err
+}
+
+// path maps a key to its location on disk, refusing keys that would
+// escape the root or clash with our own bookkeeping.
+func (p *PosixStorage) path(key string) (string, error) {
+	name := strings.TrimSuffix(key, "/")
+	if name == "" {
+		return p.root, nil
+	}
+	if path.Clean("/"+name) != "/"+name || name == posixInternalDir ||
+		strings.HasPrefix(name, posixInternalDir+"/") {
+		return "", syscall.EINVAL
+	}
+	return filepath.Join(p.root, filepath.FromSlash(name)), nil
+}
+
+func (p *PosixStorage) internalDir(elem ...string) string {
+	return filepath.Join(append([]string{p.root, posixInternalDir}, elem...)...)
+}
+
+func posixETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+func (p *PosixStorage) item(key string, info os.FileInfo) BlobItemOutput {
+	etag := posixETag(info)
+	mtime := info.ModTime()
+	item := BlobItemOutput{
+		Key:          &key,
+		ETag:         &etag,
+		LastModified: &mtime,
+	}
+	if !info.IsDir() {
+		item.Size = uint64(info.Size())
+	}
+	return item
+}
+
+func getXattr(path string, name string) (value []byte, err error) {
+	size, err := unix.Getxattr(path, name, nil)
+	if err != nil {
+		return
+	}
+	value = make([]byte, size)
+	size, err = unix.Getxattr(path, name, value)
+	if err != nil {
+		return
+	}
+	return value[:size], nil
+}
+
+func listXattr(path string) (names []string, err error) {
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return
+	}
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(path, buf)
+	if err != nil {
+		return
+	}
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+func readPosixMetadata(path string) (metadata map[string]*string, contentType *string, err error) {
+	names, err := listXattr(path)
+	if err != nil {
+		return
+	}
+
+	metadata = make(map[string]*string)
+	for _, name := range names {
+		if !strings.HasPrefix(name, "user.cess.") {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := string(value)
+
+		if name == posixXattrContentType {
+			contentType = &s
+		} else if strings.HasPrefix(name, posixXattrMetaPrefix) {
+			metadata[name[len(posixXattrMetaPrefix):]] = &s
+		}
+	}
+	return
+}
+
+// writePosixMetadata replaces all the metadata stored on path
+func writePosixMetadata(path string, metadata map[string]*string, contentType *string) error {
+	names, err := listXattr(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, "user.cess.") {
+			err = unix.Removexattr(path, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for k, v := range metadata {
+		if v != nil {
+			err = unix.Setxattr(path, posixXattrMetaPrefix+strings.ToLower(k), []byte(*v), 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if contentType != nil {
+		err = unix.Setxattr(path, posixXattrContentType, []byte(*contentType), 0)
+	}
+	return err
+}
+
+// createTemp returns a new file in our internal dir, which lives on the
+// same file system as root so it can be renamed into place
+func (p *PosixStorage) createTemp() (*os.File, error) {
+	dir := p.internalDir("tmp")
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.TempFile(dir, "blob")
+}
+
+// commitTemp sets the metadata on a fully written temp file and atomically
+// moves it to its final destination
+func (p *PosixStorage) commitTemp(tmp *os.File, dst string,
+	metadata map[string]*string, contentType *string) (info os.FileInfo, err error) {
+
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	err = writePosixMetadata(tmp.Name(), metadata, contentType)
+	if err != nil {
+		return
+	}
+
+	if st, err := os.Stat(dst); err == nil && st.IsDir() {
+		return nil, syscall.EISDIR
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		return
+	}
+
+	return os.Stat(dst)
+}
+
+func (p *PosixStorage) Init(key string) error {
+	st, err := os.Stat(p.root)
+	if err != nil {
+		return fmt.Errorf("unable to use %v as posix backend: %v", p.root, err)
+	}
+	if !st.IsDir() {
+		return fmt.Errorf("unable to use %v as posix backend: not a directory", p.root)
+	}
+
+	// metadata is stored in xattrs, make sure that works here
+	tmp, err := p.createTemp()
+	if err != nil {
+		return fmt.Errorf("unable to write to %v: %v", p.root, err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Close()
+
+	err = unix.Setxattr(tmp.Name(), posixXattrContentType, []byte("test"), 0)
+	if err != nil {
+		return fmt.Errorf("%v does not support user xattrs, which are needed "+
+			"to keep object metadata: %v", p.root, err)
+	}
+	return nil
+}
+
+func (p *PosixStorage) Capabilities() *Capabilities {
+	return &p.cap
+}
+
+func (p *PosixStorage) Bucket() string {
+	return p.root
+}
+
+func (p *PosixStorage) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	path, err := p.path(param.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	if strings.HasSuffix(param.Key, "/") && !info.IsDir() {
+		return nil, syscall.ENOENT
+	}
+
+	metadata, contentType, err := readPosixMetadata(path)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+
+	return &HeadBlobOutput{
+		BlobItemOutput: p.item(param.Key, info),
+		ContentType:    contentType,
+		Metadata:       metadata,
+		IsDirBlob:      info.IsDir(),
+	}, nil
+}
+
+type posixEntry struct {
+	key  string
+	info os.FileInfo
+}
+
+// readDirSorted returns the entries of the directory for dirKey, ordered
+// the way their keys sort: a directory "a" is "a/" so it sorts after "a-b"
+func (p *PosixStorage) readDirSorted(dirKey string) ([]posixEntry, error) {
+	path, err := p.path(dirKey)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]posixEntry, 0, len(infos))
+	for _, info := range infos {
+		if dirKey == "" && info.Name() == posixInternalDir {
+			continue
+		}
+		key := dirKey + info.Name()
+		if info.IsDir() {
+			key += "/"
+		}
+		entries = append(entries, posixEntry{key, info})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+type posixLister struct {
+	p         *PosixStorage
+	prefix    string
+	marker    string
+	delimited bool
+	maxKeys   int
+
+	out  *ListBlobsOutput
+	last string
+}
+
+// emit adds an entry to the listing, returning false once the page is full
+func (l *posixLister) emit(key string, info os.FileInfo, isPrefix bool) bool {
+	if key <= l.marker {
+		return true
+	}
+	if len(l.out.Items)+len(l.out.Prefixes) == l.maxKeys {
+		l.out.IsTruncated = true
+		l.out.NextContinuationToken = aws.String(l.last)
+		return false
+	}
+
+	if isPrefix {
+		l.out.Prefixes = append(l.out.Prefixes, BlobPrefixOutput{Prefix: aws.String(key)})
+	} else {
+		l.out.Items = append(l.out.Items, l.p.item(key, info))
+	}
+	l.last = key
+	return true
+}
+
+func (l *posixLister) walk(dirKey string) (more bool, err error) {
+	entries, err := l.p.readDirSorted(dirKey)
+	if err != nil {
+		if os.IsNotExist(err) || mapPosixError(err) == syscall.ENOENT {
+			// listing a prefix that doesn't exist is not an error
+			return true, nil
+		}
+		return false, err
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.key, l.prefix) && !strings.HasPrefix(l.prefix, e.key) {
+			continue
+		}
+
+		if !e.info.IsDir() {
+			if strings.HasPrefix(e.key, l.prefix) && !l.emit(e.key, e.info, false) {
+				return false, nil
+			}
+			continue
+		}
+
+		if e.key != l.prefix && strings.HasPrefix(l.prefix, e.key) {
+			// the prefix is further down this dir
+			more, err = l.walk(e.key)
+			if !more || err != nil {
+				return
+			}
+			continue
+		}
+
+		if e.key < l.marker && !strings.HasPrefix(l.marker, e.key) {
+			// everything in this dir was in previous pages
+			continue
+		}
+
+		if l.delimited && e.key != l.prefix {
+			if !l.emit(e.key, e.info, true) {
+				return false, nil
+			}
+			continue
+		}
+
+		// the dir blob itself, followed by its children
+		if !l.emit(e.key, e.info, false) {
+			return false, nil
+		}
+		more, err = l.walk(e.key)
+		if !more || err != nil {
+			return
+		}
+	}
+	return true, nil
+}
+
+func (p *PosixStorage) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	l := &posixLister{
+		p:       p,
+		maxKeys: 1000,
+		out:     &ListBlobsOutput{},
+	}
+	if param.Prefix != nil {
+		l.prefix = *param.Prefix
+	}
+	if param.Delimiter != nil && *param.Delimiter != "" {
+		if *param.Delimiter != "/" {
+			return nil, syscall.EINVAL
+		}
+		l.delimited = true
+	}
+	if param.MaxKeys != nil && *param.MaxKeys != 0 {
+		l.maxKeys = int(*param.MaxKeys)
+	}
+	if param.StartAfter != nil {
+		l.marker = *param.StartAfter
+	}
+	if param.ContinuationToken != nil && *param.ContinuationToken > l.marker {
+		l.marker = *param.ContinuationToken
+	}
+
+	_, err := l.walk("")
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	return l.out, nil
+}
+
+func (p *PosixStorage) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	path, err := p.path(param.Key)
+	if err != nil {
+		return nil, err
+	}
+	if path == p.root {
+		return nil, syscall.EINVAL
+	}
+
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, mapPosixError(err)
+	}
+	return &DeleteBlobOutput{}, nil
+}
+
+func (p *PosixStorage) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	// delete children before their dirs
+	items := make([]string, len(param.Items))
+	copy(items, param.Items)
+	sort.Sort(sort.Reverse(sort.StringSlice(items)))
+
+	for _, key := range items {
+		_, err := p.DeleteBlob(&DeleteBlobInput{Key: key})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &DeleteBlobsOutput{}, nil
+}
+
+func (p *PosixStorage) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	src, err := p.path(param.Source)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := p.path(param.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = os.Lstat(src); err != nil {
+		return nil, mapPosixError(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+
+	err = os.Rename(src, dst)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	return &RenameBlobOutput{}, nil
+}
+
+func (p *PosixStorage) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	src, err := p.path(param.Source)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := p.path(param.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	if param.ETag != nil && *param.ETag != "" && *param.ETag != posixETag(info) {
+		return nil, syscall.EAGAIN
+	}
+
+	metadata, contentType, err := readPosixMetadata(src)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	if param.Metadata != nil {
+		metadata = param.Metadata
+	}
+
+	if src == dst || info.IsDir() {
+		if src != dst {
+			err = os.MkdirAll(dst, 0755)
+			if err != nil {
+				return nil, mapPosixError(err)
+			}
+		}
+		err = writePosixMetadata(dst, metadata, contentType)
+		return &CopyBlobOutput{}, mapPosixError(err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	defer in.Close()
+
+	tmp, err := p.createTemp()
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	_, err = io.Copy(tmp, in)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, mapPosixError(err)
+	}
+
+	_, err = p.commitTemp(tmp, dst, metadata, contentType)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	return &CopyBlobOutput{}, nil
+}
+
+type posixReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (p *PosixStorage) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	head, err := p.HeadBlob(&HeadBlobInput{Key: param.Key})
+	if err != nil {
+		return nil, err
+	}
+	if head.IsDirBlob {
+		return nil, syscall.EISDIR
+	}
+	if param.IfMatch != nil && *param.IfMatch != *head.ETag {
+		return nil, syscall.EAGAIN
+	}
+	if param.Start > head.Size || (param.Start == head.Size && head.Size != 0) {
+		return nil, syscall.EINVAL
+	}
+
+	path, _ := p.path(param.Key)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+
+	var reader io.Reader = io.NewSectionReader(f, int64(param.Start),
+		int64(head.Size-param.Start))
+	if param.Count != 0 {
+		reader = io.LimitReader(reader, int64(param.Count))
+	}
+
+	return &GetBlobOutput{
+		HeadBlobOutput: *head,
+		Body:           posixReader{reader, f},
+	}, nil
+}
+
+func (p *PosixStorage) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	path, err := p.path(param.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var info os.FileInfo
+	if param.DirBlob || strings.HasSuffix(param.Key, "/") {
+		err = os.MkdirAll(path, 0755)
+		if err == nil {
+			err = writePosixMetadata(path, param.Metadata, param.ContentType)
+		}
+		if err == nil {
+			info, err = os.Stat(path)
+		}
+	} else {
+		var tmp *os.File
+		tmp, err = p.createTemp()
+		if err != nil {
+			return nil, mapPosixError(err)
+		}
+		if param.Body != nil {
+			_, err = io.Copy(tmp, param.Body)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, mapPosixError(err)
+		}
+		info, err = p.commitTemp(tmp, path, param.Metadata, param.ContentType)
+	}
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+
+	item := p.item(param.Key, info)
+	return &PutBlobOutput{
+		ETag:         item.ETag,
+		LastModified: item.LastModified,
+	}, nil
+}
+
+func (p *PosixStorage) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	if _, err := p.path(param.Key); err != nil {
+		return nil, err
+	}
+
+	err := os.MkdirAll(p.internalDir("uploads"), 0700)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	dir, err := ioutil.TempDir(p.internalDir("uploads"), "")
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	id := filepath.Base(dir)
+
+	p.mu.Lock()
+	p.uploads[id] = &posixUpload{
+		key:         param.Key,
+		dir:         dir,
+		metadata:    param.Metadata,
+		contentType: param.ContentType,
+	}
+	p.mu.Unlock()
+
+	return &MultipartBlobCommitInput{
+		Key:      aws.String(param.Key),
+		Metadata: param.Metadata,
+		UploadId: &id,
+		Parts:    make([]*string, 10000), // at most 10K parts
+	}, nil
+}
+
+func (p *PosixStorage) getUpload(id string) (*posixUpload, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upload, ok := p.uploads[id]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	return upload, nil
+}
+
+func (p *PosixStorage) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	return p.addPart(param.Commit, param.PartNumber, param.Body)
+}
+
+func (p *PosixStorage) MultipartBlobCopy(param *MultipartBlobCopyInput) (*MultipartBlobAddOutput, error) {
+	src, err := p.GetBlob(&GetBlobInput{
+		Key:     param.Source,
+		Start:   param.Offset,
+		Count:   param.Size,
+		IfMatch: param.ETag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer src.Body.Close()
+
+	return p.addPart(param.Commit, param.PartNumber, src.Body)
+}
+
+func (p *PosixStorage) addPart(commit *MultipartBlobCommitInput, partNumber uint32, body io.Reader) (*MultipartBlobAddOutput, error) {
+	if partNumber == 0 || int(partNumber) > len(commit.Parts) {
+		return nil, syscall.EINVAL
+	}
+
+	upload, err := p.getUpload(*commit.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	part := filepath.Join(upload.dir, strconv.FormatUint(uint64(partNumber), 10))
+	tmp, err := ioutil.TempFile(upload.dir, "part")
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), body)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), part)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, mapPosixError(err)
+	}
+
+	commit.Parts[partNumber-1] = aws.String("\"" + hex.EncodeToString(hash.Sum(nil)) + "\"")
+	atomic.AddUint32(&commit.NumParts, 1)
+	return &MultipartBlobAddOutput{}, nil
+}
+
+func (p *PosixStorage) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	upload, err := p.getUpload(*param.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	delete(p.uploads, *param.UploadId)
+	p.mu.Unlock()
+
+	err = os.RemoveAll(upload.dir)
+	return &MultipartBlobAbortOutput{}, mapPosixError(err)
+}
+
+func (p *PosixStorage) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	upload, err := p.getUpload(*param.UploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := p.path(upload.key)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := p.createTemp()
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+
+	for i := uint32(1); i <= param.NumParts; i++ {
+		err = appendFile(tmp, filepath.Join(upload.dir, strconv.FormatUint(uint64(i), 10)))
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("multipart upload of %v is missing part %v", upload.key, i)
+			}
+			return nil, mapPosixError(err)
+		}
+	}
+
+	metadata := upload.metadata
+	if param.Metadata != nil {
+		metadata = param.Metadata
+	}
+	info, err := p.commitTemp(tmp, path, metadata, upload.contentType)
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+
+	p.mu.Lock()
+	delete(p.uploads, *param.UploadId)
+	p.mu.Unlock()
+	os.RemoveAll(upload.dir)
+
+	item := p.item(upload.key, info)
+	return &MultipartBlobCommitOutput{
+		ETag:         item.ETag,
+		LastModified: item.LastModified,
+	}, nil
+}
+
+func appendFile(dst *os.File, path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// MultipartExpire removes the staged parts of uploads that were started
+// more than 48 hours ago, including those left behind by a previous run.
+func (p *PosixStorage) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	infos, err := ioutil.ReadDir(p.internalDir("uploads"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return &MultipartExpireOutput{}, err
+	}
+
+	cutoff := time.Now().Add(-48 * time.Hour)
+	for _, info := range infos {
+		if !info.IsDir() || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		p.mu.Lock()
+		delete(p.uploads, info.Name())
+		p.mu.Unlock()
+
+		os.RemoveAll(p.internalDir("uploads", info.Name()))
+	}
+	return &MultipartExpireOutput{}, nil
+}
+
+func (p *PosixStorage) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	entries, err := p.readDirSorted("")
+	if err != nil {
+		return nil, mapPosixError(err)
+	}
+	if len(entries) != 0 {
+		return nil, syscall.ENOTEMPTY
+	}
+
+	err = os.RemoveAll(p.internalDir())
+	if err == nil {
+		err = os.Remove(p.root)
+	}
+	return &RemoveBucketOutput{}, mapPosixError(err)
+}
+
+func (p *PosixStorage) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	err := os.MkdirAll(p.root, 0755)
+	return &MakeBucketOutput{}, mapPosixError(err)
+}
+
+func (p *PosixStorage) Delegate() interface{} {
+	return p
+}
@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func newPosixStorage(t *testing.T) *PosixStorage {
+	t.Helper()
+	p, err := NewPosixStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Init("")
+	if err != nil {
+		// no user xattrs on the temp dir
+		t.Skip(err)
+	}
+	return p
+}
+
+func TestPosixETag(t *testing.T) {
+	p := newPosixStorage(t)
+
+	etag := func() string {
+		t.Helper()
+		head, err := p.HeadBlob(&HeadBlobInput{Key: "file"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *head.ETag
+	}
+
+	putString(t, p, "file", "aaaa")
+	first := etag()
+	if first != etag() {
+		t.Errorf("etag changed without a write")
+	}
+
+	// same size, only the mtime tells them apart
+	time.Sleep(20 * time.Millisecond)
+	putString(t, p, "file", "bbbb")
+	second := etag()
+	if second == first {
+		t.Errorf("etag %v unchanged by an overwrite of the same size", first)
+	}
+
+	putString(t, p, "file", "ccccc")
+	if third := etag(); third == second {
+		t.Errorf("etag %v unchanged by an overwrite of another size", second)
+	}
+
+	_, err := p.GetBlob(&GetBlobInput{Key: "file", IfMatch: &first})
+	if err != syscall.EAGAIN {
+		t.Errorf("get with a stale etag = %v", err)
+	}
+	_, err = p.CopyBlob(&CopyBlobInput{Source: "file", Destination: "copy", ETag: &first})
+	if err != syscall.EAGAIN {
+		t.Errorf("copy with a stale etag = %v", err)
+	}
+}
+
+func TestPosixDeleteDir(t *testing.T) {
+	p := newPosixStorage(t)
+	putString(t, p, "dir/file", "x")
+
+	_, err := p.DeleteBlob(&DeleteBlobInput{Key: "dir/"})
+	if err != syscall.ENOTEMPTY {
+		t.Errorf("delete of a dir with a file = %v", err)
+	}
+
+	_, err = p.DeleteBlobs(&DeleteBlobsInput{Items: []string{"dir/", "dir/file"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.HeadBlob(&HeadBlobInput{Key: "dir/"})
+	if err != syscall.ENOENT {
+		t.Errorf("head of the deleted dir = %v", err)
+	}
+
+	// deleting what doesn't exist is fine, like with any object store
+	_, err = p.DeleteBlob(&DeleteBlobInput{Key: "dir/file"})
+	if err != nil {
+		t.Errorf("delete of a missing key = %v", err)
+	}
+}
+
+func TestPosixMetadata(t *testing.T) {
+	p := newPosixStorage(t)
+
+	_, err := p.PutBlob(&PutBlobInput{
+		Key:         "file",
+		Body:        strings.NewReader("data"),
+		Metadata:    map[string]*string{"Mode": aws.String("600"), "uid": aws.String("1000")},
+		ContentType: aws.String("text/plain"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(key string, expected map[string]string) {
+		t.Helper()
+		head, err := p.HeadBlob(&HeadBlobInput{Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]string)
+		for k, v := range head.Metadata {
+			got[k] = *v
+		}
+		if fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Errorf("metadata of %v = %v, expecting %v", key, got, expected)
+		}
+		if aws.StringValue(head.ContentType) != "text/plain" {
+			t.Errorf("content type of %v = %v", key, aws.StringValue(head.ContentType))
+		}
+	}
+	check("file", map[string]string{"mode": "600", "uid": "1000"})
+
+	// kept by a plain copy and a rename
+	_, err = p.CopyBlob(&CopyBlobInput{Source: "file", Destination: "copy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("copy", map[string]string{"mode": "600", "uid": "1000"})
+	_, err = p.RenameBlob(&RenameBlobInput{Source: "copy", Destination: "dir/renamed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("dir/renamed", map[string]string{"mode": "600", "uid": "1000"})
+
+	// replaced in place, the way chmod updates it
+	_, err = p.CopyBlob(&CopyBlobInput{
+		Source:      "file",
+		Destination: "file",
+		Metadata:    map[string]*string{"mode": aws.String("644")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("file", map[string]string{"mode": "644"})
+	if s := getString(t, p, &GetBlobInput{Key: "file"}); s != "data" {
+		t.Errorf("data after the metadata update = %q", s)
+	}
+}
+
+func TestPosixListBlobs(t *testing.T) {
+	p := newPosixStorage(t)
+	for _, key := range []string{"a/1", "a/2", "a/b/3", "a/c/4", "a-b", "b/5", "c"} {
+		putString(t, p, key, key)
+	}
+
+	// unlike other backends every directory on the way is a dir blob
+	for _, c := range []struct {
+		in       ListBlobsInput
+		maxKeys  uint32
+		expected string
+	}{
+		{ListBlobsInput{}, 0, "[a-b a/ a/1 a/2 a/b/ a/b/3 a/c/ a/c/4 b/ b/5 c]"},
+		{ListBlobsInput{}, 4, "[a-b a/ a/1 a/2 a/b/ a/b/3 a/c/ a/c/4 b/ b/5 c]"},
+		{ListBlobsInput{}, 1, "[a-b a/ a/1 a/2 a/b/ a/b/3 a/c/ a/c/4 b/ b/5 c]"},
+		{ListBlobsInput{Delimiter: aws.String("/")}, 0, "[a/ b/ a-b c]"},
+		{ListBlobsInput{Delimiter: aws.String("/")}, 1, "[a-b a/ b/ c]"},
+		{ListBlobsInput{Prefix: aws.String("a/"), Delimiter: aws.String("/")}, 0, "[a/b/ a/c/ a/ a/1 a/2]"},
+		{ListBlobsInput{Prefix: aws.String("a/"), Delimiter: aws.String("/")}, 2, "[a/ a/1 a/b/ a/2 a/c/]"},
+		{ListBlobsInput{Prefix: aws.String("a/b")}, 2, "[a/b/ a/b/3]"},
+		{ListBlobsInput{StartAfter: aws.String("a/b/3")}, 3, "[a/c/ a/c/4 b/ b/5 c]"},
+		{ListBlobsInput{Prefix: aws.String("x/")}, 0, "[]"},
+	} {
+		pages := listAll(t, p, c.in, c.maxKeys)
+		var all []string
+		for _, page := range pages {
+			if page != "" {
+				all = append(all, strings.Split(page, " ")...)
+			}
+			if c.maxKeys != 0 && len(strings.Fields(page)) > int(c.maxKeys) {
+				t.Errorf("page %q has more than %v entries", page, c.maxKeys)
+			}
+		}
+		if fmt.Sprint(all) != c.expected {
+			t.Errorf("list prefix %v delimiter %v max %v = %v (pages %q), expecting %v",
+				aws.StringValue(c.in.Prefix), aws.StringValue(c.in.Delimiter), c.maxKeys,
+				all, pages, c.expected)
+		}
+	}
+
+	// multipart uploads in progress aren't listed
+	_, err := p.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages := listAll(t, p, ListBlobsInput{Delimiter: aws.String("/")}, 0); pages[0] != "a/ b/ a-b c" {
+		t.Errorf("list with an upload in progress = %q", pages)
+	}
+}
@@ -0,0 +1,373 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/utils"
+)
+
+var retryLog = utils.GetLogger("retry")
+
+type RetryConfig struct {
+	// MaxRetries is how many times a call is retried after the first
+	// attempt failed
+	MaxRetries int
+	// the first retry waits about MinBackoff, doubling up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Deadline bounds the time spent on one call including all its
+	// retries, no new attempt is started past it. 0 means no limit.
+	Deadline time.Duration
+}
+
+type RetryStats struct {
+	// Retries is the number of attempts beyond the first one
+	Retries uint64
+	// Recovered counts calls that succeeded after at least one retry
+	Recovered uint64
+	// GaveUp counts calls that still failed when out of retries or time
+	GaveUp uint64
+}
+
+func (s RetryStats) String() string {
+	return fmt.Sprintf("%v retries, %v recovered, %v gave up",
+		s.Retries, s.Recovered, s.GaveUp)
+}
+
+// ObjectBackendRetryWrapper retries calls that failed with a transient
+// error (EAGAIN, which is what 429 and 5xx map to, or a network error)
+// with jittered exponential backoff.
+//
+// Calls are only retried when doing so is safe:
+//
+//   - request bodies are rewound before being sent again
+//   - EAGAIN from a conditional GetBlob/CopyBlob may be a failed
+//     precondition rather than a busy server, it is only retried if the
+//     ETag still matches
+//   - backends count a multipart part in NumParts only once they stored
+//     it, so a part that failed is sent again without being counted twice
+//   - a RenameBlob or MultipartBlobAbort whose retry finds its source
+//     gone is checked against the destination, because the failed
+//     attempt may have gone through after all
+//   - a MultipartBlobCommit whose retry finds the upload gone can't tell
+//     whether the failed attempt committed it or the upload was lost, it
+//     returns the error of that attempt
+//
+// Only the request is retried, errors while reading a GetBlob body are
+// returned to the caller.
+type ObjectBackendRetryWrapper struct {
+	ObjectBackend
+	config RetryConfig
+	stats  RetryStats
+}
+
+func NewObjectBackendRetryWrapper(backend ObjectBackend, config RetryConfig) *ObjectBackendRetryWrapper {
+	if config.MinBackoff == 0 {
+		config.MinBackoff = 100 * time.Millisecond
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 5 * time.Second
+	}
+	return &ObjectBackendRetryWrapper{
+		ObjectBackend: backend,
+		config:        config,
+	}
+}
+
+func (r *ObjectBackendRetryWrapper) Stats() RetryStats {
+	return RetryStats{
+		Retries:   atomic.LoadUint64(&r.stats.Retries),
+		Recovered: atomic.LoadUint64(&r.stats.Recovered),
+		GaveUp:    atomic.LoadUint64(&r.stats.GaveUp),
+	}
+}
+
+func isTransientError(err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		return true
+	}
+
+	// syscall.Errno is also a net.Error, so check it first
+	if errno, ok := err.(syscall.Errno); ok {
+		switch errno {
+		case syscall.EAGAIN, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ETIMEDOUT:
+			return true
+		}
+		return false
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// aws-sdk-go wraps network errors
+	if e, ok := err.(interface{ OrigErr() error }); ok && e.OrigErr() != nil {
+		return isTransientError(e.OrigErr())
+	}
+	return false
+}
+
+// retry calls fn until it succeeds, fails with a permanent error, or we
+// run out of attempts or time. attempt is 0 for the first call. For
+// conditional requests etag is the ETag that key must still have for
+// EAGAIN to be worth retrying.
+func (r *ObjectBackendRetryWrapper) retry(op string, key string, etag *string,
+	fn func(attempt int) error) error {
+
+	start := time.Now()
+	backoff := r.config.MinBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			if attempt != 0 {
+				atomic.AddUint64(&r.stats.Recovered, 1)
+				retryLog.Infof("%v %v succeeded after %v retries", op, key, attempt)
+			}
+			return nil
+		}
+
+		if !isTransientError(err) {
+			return err
+		}
+		if err == syscall.EAGAIN && etag != nil && !r.matches(key, *etag) {
+			return err
+		}
+
+		// full jitter between backoff/2 and backoff keeps clients that
+		// failed together from retrying together
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if attempt == r.config.MaxRetries ||
+			(r.config.Deadline != 0 && time.Since(start)+sleep > r.config.Deadline) {
+			atomic.AddUint64(&r.stats.GaveUp, 1)
+			retryLog.Errorf("%v %v failed after %v attempts in %v: %v",
+				op, key, attempt+1, time.Since(start), err)
+			return err
+		}
+
+		atomic.AddUint64(&r.stats.Retries, 1)
+		retryLog.Warnf("%v %v failed, retry %v/%v in %v: %v",
+			op, key, attempt+1, r.config.MaxRetries, sleep, err)
+		time.Sleep(sleep)
+
+		backoff *= 2
+		if backoff > r.config.MaxBackoff {
+			backoff = r.config.MaxBackoff
+		}
+	}
+}
+
+// rewind returns a function that seeks body back to where it is now
+func rewind(body io.ReadSeeker) (func() error, error) {
+	if body == nil {
+		return func() error { return nil }, nil
+	}
+	pos, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		_, err := body.Seek(pos, io.SeekStart)
+		return err
+	}, nil
+}
+
+func (r *ObjectBackendRetryWrapper) HeadBlob(param *HeadBlobInput) (out *HeadBlobOutput, err error) {
+	err = r.retry("HeadBlob", param.Key, nil, func(int) (err error) {
+		out, err = r.ObjectBackend.HeadBlob(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) ListBlobs(param *ListBlobsInput) (out *ListBlobsOutput, err error) {
+	var prefix string
+	if param.Prefix != nil {
+		prefix = *param.Prefix
+	}
+	err = r.retry("ListBlobs", prefix, nil, func(int) (err error) {
+		out, err = r.ObjectBackend.ListBlobs(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) DeleteBlob(param *DeleteBlobInput) (out *DeleteBlobOutput, err error) {
+	err = r.retry("DeleteBlob", param.Key, nil, func(int) (err error) {
+		out, err = r.ObjectBackend.DeleteBlob(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) DeleteBlobs(param *DeleteBlobsInput) (out *DeleteBlobsOutput, err error) {
+	err = r.retry("DeleteBlobs", fmt.Sprintf("(%v keys)", len(param.Items)), nil,
+		func(int) (err error) {
+			out, err = r.ObjectBackend.DeleteBlobs(param)
+			return
+		})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) matches(key string, etag string) bool {
+	head, err := r.ObjectBackend.HeadBlob(&HeadBlobInput{Key: key})
+	return err == nil && head.ETag != nil && *head.ETag == etag
+}
+
+// exists is used to find out whether an attempt that failed went through
+// anyway
+func (r *ObjectBackendRetryWrapper) exists(key string) bool {
+	_, err := r.ObjectBackend.HeadBlob(&HeadBlobInput{Key: key})
+	return err == nil
+}
+
+func (r *ObjectBackendRetryWrapper) RenameBlob(param *RenameBlobInput) (out *RenameBlobOutput, err error) {
+	err = r.retry("RenameBlob", param.Source, nil, func(attempt int) (err error) {
+		out, err = r.ObjectBackend.RenameBlob(param)
+		if err == syscall.ENOENT && attempt != 0 && r.exists(param.Destination) {
+			retryLog.Infof("RenameBlob %v -> %v went through on a failed attempt",
+				param.Source, param.Destination)
+			out, err = &RenameBlobOutput{}, nil
+		}
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) CopyBlob(param *CopyBlobInput) (out *CopyBlobOutput, err error) {
+	err = r.retry("CopyBlob", param.Source, param.ETag, func(int) (err error) {
+		out, err = r.ObjectBackend.CopyBlob(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) GetBlob(param *GetBlobInput) (out *GetBlobOutput, err error) {
+	err = r.retry("GetBlob", param.Key, param.IfMatch, func(int) (err error) {
+		out, err = r.ObjectBackend.GetBlob(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) PutBlob(param *PutBlobInput) (out *PutBlobOutput, err error) {
+	reset, err := rewind(param.Body)
+	if err != nil {
+		// can't send the body twice
+		return r.ObjectBackend.PutBlob(param)
+	}
+
+	err = r.retry("PutBlob", param.Key, nil, func(attempt int) (err error) {
+		if attempt != 0 {
+			if err = reset(); err != nil {
+				return
+			}
+		}
+		out, err = r.ObjectBackend.PutBlob(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) MultipartBlobBegin(param *MultipartBlobBeginInput) (out *MultipartBlobCommitInput, err error) {
+	// a failed attempt may leave an upload behind, MultipartExpire
+	// cleans those up
+	err = r.retry("MultipartBlobBegin", param.Key, nil, func(int) (err error) {
+		out, err = r.ObjectBackend.MultipartBlobBegin(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) MultipartBlobAdd(param *MultipartBlobAddInput) (out *MultipartBlobAddOutput, err error) {
+	reset, err := rewind(param.Body)
+	if err != nil {
+		return r.ObjectBackend.MultipartBlobAdd(param)
+	}
+
+	key := fmt.Sprintf("%v part %v", *param.Commit.Key, param.PartNumber)
+	err = r.retry("MultipartBlobAdd", key, nil, func(attempt int) (err error) {
+		if attempt != 0 {
+			// backends only count the part once they
+			// have it, the failed attempt didn't
+			if err = reset(); err != nil {
+				return
+			}
+		}
+		out, err = r.ObjectBackend.MultipartBlobAdd(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) MultipartBlobCopy(param *MultipartBlobCopyInput) (out *MultipartBlobAddOutput, err error) {
+	err = r.retry("MultipartBlobCopy", param.Source, param.ETag, func(int) (err error) {
+		out, err = r.ObjectBackend.MultipartBlobCopy(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) MultipartBlobAbort(param *MultipartBlobCommitInput) (out *MultipartBlobAbortOutput, err error) {
+	err = r.retry("MultipartBlobAbort", *param.Key, nil, func(attempt int) (err error) {
+		out, err = r.ObjectBackend.MultipartBlobAbort(param)
+		if err == syscall.ENOENT && attempt != 0 {
+			// the failed attempt got rid of the upload
+			out, err = &MultipartBlobAbortOutput{}, nil
+		}
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) MultipartBlobCommit(param *MultipartBlobCommitInput) (out *MultipartBlobCommitOutput, err error) {
+	var failed error
+
+	err = r.retry("MultipartBlobCommit", *param.Key, nil, func(attempt int) (err error) {
+		out, err = r.ObjectBackend.MultipartBlobCommit(param)
+		if err == syscall.ENOENT && attempt != 0 {
+			// Either the failed attempt committed the upload or
+			// it was lost, and neither the object nor its ETag
+			// tells which. Don't claim it went through.
+			retryLog.Errorf("MultipartBlobCommit %v: upload is gone after %v, it may not have been committed",
+				*param.Key, failed)
+			out = nil
+			return
+		}
+		failed = err
+		return
+	})
+	if err == syscall.ENOENT && failed != nil {
+		err = failed
+	}
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) MultipartExpire(param *MultipartExpireInput) (out *MultipartExpireOutput, err error) {
+	err = r.retry("MultipartExpire", "", nil, func(int) (err error) {
+		out, err = r.ObjectBackend.MultipartExpire(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) RemoveBucket(param *RemoveBucketInput) (out *RemoveBucketOutput, err error) {
+	err = r.retry("RemoveBucket", r.Bucket(), nil, func(int) (err error) {
+		out, err = r.ObjectBackend.RemoveBucket(param)
+		return
+	})
+	return
+}
+
+func (r *ObjectBackendRetryWrapper) MakeBucket(param *MakeBucketInput) (out *MakeBucketOutput, err error) {
+	err = r.retry("MakeBucket", r.Bucket(), nil, func(int) (err error) {
+		out, err = r.ObjectBackend.MakeBucket(param)
+		return
+	})
+	return
+}
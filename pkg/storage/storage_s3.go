@@ -0,0 +1,691 @@
+package storage
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/arvinsg/cess-fuse/pkg/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// CopyObject refuses sources larger than this, bigger objects are
+	// copied part by part
+	s3MaxCopySize = 5 * 1024 * 1024 * 1024
+	s3MaxParts    = 10000
+	// uploads older than this are considered abandoned by MultipartExpire
+	s3MultipartAge = 48 * time.Hour
+)
+
+var s3Log = utils.GetLogger("s3")
+
+type S3Config struct {
+	// Endpoint of an S3 compatible service such as the CESS S3 gateway
+	// or MinIO, empty means AWS
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	// static credentials, if not set the usual AWS_* environment
+	// variables, shared config Profile and instance roles are used
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Profile      string
+
+	// Subdomain addresses the bucket as bucket.endpoint instead of
+	// endpoint/bucket. Most gateways only support the latter.
+	Subdomain    bool
+	StorageClass string
+
+	HTTPTimeout time.Duration
+	// Transport overrides the default http transport, mostly useful
+	// to plug in a test server
+	Transport http.RoundTripper
+}
+
+type S3Backend struct {
+	*s3.S3
+	config *S3Config
+	cap    Capabilities
+}
+
+func NewS3Storage(cfg *S3Config) (*S3Backend, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("s3 config is required")
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is required")
+	}
+	if cfg.Endpoint != "" {
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid s3 endpoint %v: expecting http(s)://host[:port]",
+				cfg.Endpoint)
+		}
+	}
+
+	transport := cfg.Transport
+	if transport == nil {
+		transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          1000,
+			MaxIdleConnsPerHost:   1000,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 10 * time.Second,
+			ResponseHeaderTimeout: cfg.HTTPTimeout,
+		}
+	}
+
+	awsConfig := &aws.Config{
+		Region:           aws.String(cfg.Region),
+		S3ForcePathStyle: aws.Bool(!cfg.Subdomain),
+		HTTPClient:       &http.Client{Transport: transport},
+		Logger:           s3Log,
+	}
+	if awsConfig.Region == nil || *awsConfig.Region == "" {
+		awsConfig.Region = aws.String("us-east-1")
+	}
+	if cfg.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(cfg.Endpoint)
+	}
+	if cfg.AccessKey != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(
+			cfg.AccessKey, cfg.SecretKey, cfg.SessionToken)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		Profile:           cfg.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create s3 session: %v", err)
+	}
+
+	return &S3Backend{
+		S3:     s3.New(sess),
+		config: cfg,
+		cap: Capabilities{
+			Name:             "s3",
+			MaxMultipartSize: 5 * 1024 * 1024 * 1024,
+		},
+	}, nil
+}
+
+func mapAwsError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "NoSuchBucket":
+			return syscall.ENXIO
+		case "BucketAlreadyOwnedByYou":
+			return syscall.EEXIST
+		case "BucketNotEmpty":
+			return syscall.ENOTEMPTY
+		}
+
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			// A service error occurred
+			err = mapHttpError(reqErr.StatusCode())
+			if err != nil {
+				return err
+			}
+			s3Log.Errorf("http=%v %v s3=%v request=%v",
+				reqErr.StatusCode(), reqErr.Message(),
+				awsErr.Code(), reqErr.RequestID())
+			return reqErr
+		}
+
+		// Generic AWS Error with Code, Message, and original error (if any)
+		s3Log.Errorf("code=%v msg=%v, err=%v", awsErr.Code(), awsErr.Message(), awsErr.OrigErr())
+		return awsErr
+	}
+	return err
+}
+
+func (s *S3Backend) Init(key string) error {
+	_, err := s.HeadBlob(&HeadBlobInput{Key: key})
+	if err == syscall.ENOENT {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to access bucket %v at %v: %v",
+			s.config.Bucket, s.Endpoint, err)
+	}
+	return nil
+}
+
+func (s *S3Backend) Capabilities() *Capabilities {
+	return &s.cap
+}
+
+func (s *S3Backend) Bucket() string {
+	return s.config.Bucket
+}
+
+func s3Metadata(metadata map[string]*string) map[string]*string {
+	// S3 lowercases metadata keys, do the same so that a fresh HeadBlob
+	// and a cached copy agree
+	out := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+func (s *S3Backend) HeadBlob(param *HeadBlobInput) (*HeadBlobOutput, error) {
+	req, resp := s.HeadObjectRequest(&s3.HeadObjectInput{
+		Bucket: &s.config.Bucket,
+		Key:    &param.Key,
+	})
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	return &HeadBlobOutput{
+		BlobItemOutput: BlobItemOutput{
+			Key:          &param.Key,
+			ETag:         resp.ETag,
+			LastModified: resp.LastModified,
+			Size:         uint64(aws.Int64Value(resp.ContentLength)),
+			StorageClass: resp.StorageClass,
+		},
+		ContentType: resp.ContentType,
+		Metadata:    s3Metadata(resp.Metadata),
+		IsDirBlob:   strings.HasSuffix(param.Key, "/"),
+		RequestId:   s.getRequestId(req.HTTPResponse),
+	}, nil
+}
+
+func (s *S3Backend) getRequestId(resp *http.Response) string {
+	if resp == nil {
+		return ""
+	}
+	return resp.Header.Get("x-amz-request-id") + ": " + resp.Header.Get("x-amz-id-2")
+}
+
+func (s *S3Backend) ListBlobs(param *ListBlobsInput) (*ListBlobsOutput, error) {
+	var maxKeys *int64
+	if param.MaxKeys != nil {
+		maxKeys = aws.Int64(int64(*param.MaxKeys))
+	}
+
+	req, resp := s.ListObjectsV2Request(&s3.ListObjectsV2Input{
+		Bucket:            &s.config.Bucket,
+		Prefix:            param.Prefix,
+		Delimiter:         param.Delimiter,
+		MaxKeys:           maxKeys,
+		StartAfter:        param.StartAfter,
+		ContinuationToken: param.ContinuationToken,
+	})
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	prefixes := make([]BlobPrefixOutput, 0, len(resp.CommonPrefixes))
+	for _, p := range resp.CommonPrefixes {
+		prefixes = append(prefixes, BlobPrefixOutput{Prefix: p.Prefix})
+	}
+
+	items := make([]BlobItemOutput, 0, len(resp.Contents))
+	for _, i := range resp.Contents {
+		items = append(items, BlobItemOutput{
+			Key:          i.Key,
+			ETag:         i.ETag,
+			LastModified: i.LastModified,
+			Size:         uint64(aws.Int64Value(i.Size)),
+			StorageClass: i.StorageClass,
+		})
+	}
+
+	return &ListBlobsOutput{
+		Prefixes:              prefixes,
+		Items:                 items,
+		NextContinuationToken: resp.NextContinuationToken,
+		IsTruncated:           aws.BoolValue(resp.IsTruncated),
+		RequestId:             s.getRequestId(req.HTTPResponse),
+	}, nil
+}
+
+func (s *S3Backend) DeleteBlob(param *DeleteBlobInput) (*DeleteBlobOutput, error) {
+	req, _ := s.DeleteObjectRequest(&s3.DeleteObjectInput{
+		Bucket: &s.config.Bucket,
+		Key:    &param.Key,
+	})
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+	return &DeleteBlobOutput{s.getRequestId(req.HTTPResponse)}, nil
+}
+
+func (s *S3Backend) DeleteBlobs(param *DeleteBlobsInput) (*DeleteBlobsOutput, error) {
+	// DeleteObjects takes at most 1000 keys, callers are expected to
+	// batch accordingly
+	objects := make([]*s3.ObjectIdentifier, 0, len(param.Items))
+	for i := range param.Items {
+		objects = append(objects, &s3.ObjectIdentifier{Key: &param.Items[i]})
+	}
+
+	req, resp := s.DeleteObjectsRequest(&s3.DeleteObjectsInput{
+		Bucket: &s.config.Bucket,
+		Delete: &s3.Delete{
+			Objects: objects,
+			Quiet:   aws.Bool(true),
+		},
+	})
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	for _, e := range resp.Errors {
+		if aws.StringValue(e.Code) == "NoSuchKey" {
+			continue
+		}
+		s3Log.Errorf("delete %v = %v %v", aws.StringValue(e.Key),
+			aws.StringValue(e.Code), aws.StringValue(e.Message))
+		return nil, syscall.EIO
+	}
+	return &DeleteBlobsOutput{s.getRequestId(req.HTTPResponse)}, nil
+}
+
+func (s *S3Backend) RenameBlob(param *RenameBlobInput) (*RenameBlobOutput, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (s *S3Backend) copySource(key string) *string {
+	return aws.String(url.PathEscape(s.config.Bucket + "/" + key))
+}
+
+// copyObjectMultipart copies a source that is too large for CopyObject
+// with UploadPartCopy
+func (s *S3Backend) copyObjectMultipart(param *CopyBlobInput, size uint64,
+	contentType *string) (requestId string, err error) {
+
+	partSize := uint64(128 * 1024 * 1024)
+	for (size+partSize-1)/partSize > s3MaxParts {
+		partSize *= 2
+	}
+
+	commit, err := s.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key:         param.Destination,
+		Metadata:    param.Metadata,
+		ContentType: contentType,
+	})
+	if err != nil {
+		return
+	}
+
+	for offset, part := uint64(0), int64(1); offset < size; offset, part = offset+partSize, part+1 {
+		end := offset + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		req, resp := s.UploadPartCopyRequest(&s3.UploadPartCopyInput{
+			Bucket:            &s.config.Bucket,
+			Key:               &param.Destination,
+			CopySource:        s.copySource(param.Source),
+			CopySourceIfMatch: param.ETag,
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%v-%v", offset, end)),
+			UploadId:          commit.UploadId,
+			PartNumber:        &part,
+		})
+		err = req.Send()
+		if err != nil {
+			s.MultipartBlobAbort(commit)
+			return "", mapAwsError(err)
+		}
+
+		commit.Parts[part-1] = resp.CopyPartResult.ETag
+		commit.NumParts++
+	}
+
+	resp, err := s.MultipartBlobCommit(commit)
+	if err != nil {
+		return
+	}
+	return resp.RequestId, nil
+}
+
+func (s *S3Backend) CopyBlob(param *CopyBlobInput) (*CopyBlobOutput, error) {
+	metadataDirective := s3.MetadataDirectiveCopy
+	if param.Metadata != nil {
+		metadataDirective = s3.MetadataDirectiveReplace
+	}
+
+	storageClass := param.StorageClass
+	if storageClass == nil && s.config.StorageClass != "" {
+		storageClass = &s.config.StorageClass
+	}
+
+	// replacing metadata also replaces the content type, so we need to
+	// know the old one. The size decides between a plain and a
+	// multipart copy.
+	var contentType *string
+	size := param.Size
+	if size == nil || param.Metadata != nil {
+		head, err := s.HeadBlob(&HeadBlobInput{Key: param.Source})
+		if err != nil {
+			return nil, err
+		}
+		size = &head.Size
+		contentType = head.ContentType
+		if param.ETag != nil && head.ETag != nil && *param.ETag != *head.ETag {
+			return nil, syscall.EAGAIN
+		}
+	}
+
+	if *size > s3MaxCopySize {
+		requestId, err := s.copyObjectMultipart(param, *size, contentType)
+		if err != nil {
+			return nil, err
+		}
+		return &CopyBlobOutput{requestId}, nil
+	}
+
+	params := &s3.CopyObjectInput{
+		Bucket:            &s.config.Bucket,
+		Key:               &param.Destination,
+		CopySource:        s.copySource(param.Source),
+		CopySourceIfMatch: param.ETag,
+		MetadataDirective: &metadataDirective,
+		StorageClass:      storageClass,
+	}
+	if param.Metadata != nil {
+		params.Metadata = param.Metadata
+		params.ContentType = contentType
+	}
+
+	req, _ := s.CopyObjectRequest(params)
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+	return &CopyBlobOutput{s.getRequestId(req.HTTPResponse)}, nil
+}
+
+func (s *S3Backend) GetBlob(param *GetBlobInput) (*GetBlobOutput, error) {
+	get := s3.GetObjectInput{
+		Bucket:  &s.config.Bucket,
+		Key:     &param.Key,
+		IfMatch: param.IfMatch,
+	}
+
+	if param.Start != 0 || param.Count != 0 {
+		var bytes string
+		if param.Count != 0 {
+			bytes = fmt.Sprintf("bytes=%v-%v", param.Start, param.Start+param.Count-1)
+		} else {
+			bytes = fmt.Sprintf("bytes=%v-", param.Start)
+		}
+		get.Range = &bytes
+	}
+
+	req, resp := s.GetObjectRequest(&get)
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	return &GetBlobOutput{
+		HeadBlobOutput: HeadBlobOutput{
+			BlobItemOutput: BlobItemOutput{
+				Key:          &param.Key,
+				ETag:         resp.ETag,
+				LastModified: resp.LastModified,
+				Size:         uint64(aws.Int64Value(resp.ContentLength)),
+				StorageClass: resp.StorageClass,
+			},
+			ContentType: resp.ContentType,
+			Metadata:    s3Metadata(resp.Metadata),
+		},
+		Body:      resp.Body,
+		RequestId: s.getRequestId(req.HTTPResponse),
+	}, nil
+}
+
+func (s *S3Backend) PutBlob(param *PutBlobInput) (*PutBlobOutput, error) {
+	put := &s3.PutObjectInput{
+		Bucket:      &s.config.Bucket,
+		Key:         &param.Key,
+		Metadata:    param.Metadata,
+		Body:        param.Body,
+		ContentType: param.ContentType,
+	}
+	if s.config.StorageClass != "" {
+		put.StorageClass = &s.config.StorageClass
+	}
+	if param.Size != nil {
+		put.ContentLength = aws.Int64(int64(*param.Size))
+	}
+	if put.Body == nil {
+		put.Body = strings.NewReader("")
+	}
+
+	req, resp := s.PutObjectRequest(put)
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	return &PutBlobOutput{
+		ETag:         resp.ETag,
+		LastModified: lastModifiedFromResponse(req.HTTPResponse),
+		StorageClass: put.StorageClass,
+		RequestId:    s.getRequestId(req.HTTPResponse),
+	}, nil
+}
+
+func lastModifiedFromResponse(resp *http.Response) *time.Time {
+	if resp != nil {
+		if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			return &t
+		}
+	}
+	now := time.Now()
+	return &now
+}
+
+func (s *S3Backend) MultipartBlobBegin(param *MultipartBlobBeginInput) (*MultipartBlobCommitInput, error) {
+	mpu := s3.CreateMultipartUploadInput{
+		Bucket:      &s.config.Bucket,
+		Key:         &param.Key,
+		Metadata:    param.Metadata,
+		ContentType: param.ContentType,
+	}
+	if s.config.StorageClass != "" {
+		mpu.StorageClass = &s.config.StorageClass
+	}
+
+	resp, err := s.CreateMultipartUpload(&mpu)
+	if err != nil {
+		s3Log.Errorf("CreateMultipartUpload %v = %v", param.Key, err)
+		return nil, mapAwsError(err)
+	}
+
+	return &MultipartBlobCommitInput{
+		Key:      &param.Key,
+		Metadata: param.Metadata,
+		UploadId: resp.UploadId,
+		Parts:    make([]*string, s3MaxParts),
+	}, nil
+}
+
+func (s *S3Backend) MultipartBlobAdd(param *MultipartBlobAddInput) (*MultipartBlobAddOutput, error) {
+	en := &param.Commit.Parts[param.PartNumber-1]
+
+	params := s3.UploadPartInput{
+		Bucket:     &s.config.Bucket,
+		Key:        param.Commit.Key,
+		PartNumber: aws.Int64(int64(param.PartNumber)),
+		UploadId:   param.Commit.UploadId,
+		Body:       param.Body,
+	}
+	if param.Size != 0 {
+		params.ContentLength = aws.Int64(int64(param.Size))
+	}
+
+	req, resp := s.UploadPartRequest(&params)
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	if *en != nil {
+		panic(fmt.Sprintf("etags for part %v already set: %v", param.PartNumber, **en))
+	}
+	*en = resp.ETag
+	atomic.AddUint32(&param.Commit.NumParts, 1)
+
+	return &MultipartBlobAddOutput{s.getRequestId(req.HTTPResponse)}, nil
+}
+
+func (s *S3Backend) MultipartBlobCopy(param *MultipartBlobCopyInput) (*MultipartBlobAddOutput, error) {
+	en := &param.Commit.Parts[param.PartNumber-1]
+
+	params := s3.UploadPartCopyInput{
+		Bucket:            &s.config.Bucket,
+		Key:               param.Commit.Key,
+		PartNumber:        aws.Int64(int64(param.PartNumber)),
+		UploadId:          param.Commit.UploadId,
+		CopySource:        s.copySource(param.Source),
+		CopySourceIfMatch: param.ETag,
+		CopySourceRange: aws.String(fmt.Sprintf("bytes=%v-%v",
+			param.Offset, param.Offset+param.Size-1)),
+	}
+
+	req, resp := s.UploadPartCopyRequest(&params)
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	if *en != nil {
+		panic(fmt.Sprintf("etags for part %v already set: %v", param.PartNumber, **en))
+	}
+	*en = resp.CopyPartResult.ETag
+	atomic.AddUint32(&param.Commit.NumParts, 1)
+
+	return &MultipartBlobAddOutput{s.getRequestId(req.HTTPResponse)}, nil
+}
+
+func (s *S3Backend) MultipartBlobCommit(param *MultipartBlobCommitInput) (*MultipartBlobCommitOutput, error) {
+	parts := make([]*s3.CompletedPart, param.NumParts)
+	for i := uint32(0); i < param.NumParts; i++ {
+		parts[i] = &s3.CompletedPart{
+			ETag:       param.Parts[i],
+			PartNumber: aws.Int64(int64(i + 1)),
+		}
+	}
+
+	req, resp := s.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+		Bucket:   &s.config.Bucket,
+		Key:      param.Key,
+		UploadId: param.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: parts,
+		},
+	})
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+
+	s3Log.Debug(resp)
+
+	return &MultipartBlobCommitOutput{
+		ETag:         resp.ETag,
+		LastModified: lastModifiedFromResponse(req.HTTPResponse),
+		RequestId:    s.getRequestId(req.HTTPResponse),
+	}, nil
+}
+
+func (s *S3Backend) MultipartBlobAbort(param *MultipartBlobCommitInput) (*MultipartBlobAbortOutput, error) {
+	req, _ := s.AbortMultipartUploadRequest(&s3.AbortMultipartUploadInput{
+		Bucket:   &s.config.Bucket,
+		Key:      param.Key,
+		UploadId: param.UploadId,
+	})
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+	return &MultipartBlobAbortOutput{s.getRequestId(req.HTTPResponse)}, nil
+}
+
+func (s *S3Backend) MultipartExpire(param *MultipartExpireInput) (*MultipartExpireOutput, error) {
+	cutoff := time.Now().Add(-s3MultipartAge)
+
+	err := s.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: &s.config.Bucket,
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if upload.Initiated == nil || upload.Initiated.After(cutoff) {
+				continue
+			}
+
+			s3Log.Debugf("aborting expired upload %v of %v",
+				aws.StringValue(upload.UploadId), aws.StringValue(upload.Key))
+			_, err := s.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   &s.config.Bucket,
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				s3Log.Errorf("abort upload %v of %v = %v",
+					aws.StringValue(upload.UploadId), aws.StringValue(upload.Key), err)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+	return &MultipartExpireOutput{}, nil
+}
+
+func (s *S3Backend) RemoveBucket(param *RemoveBucketInput) (*RemoveBucketOutput, error) {
+	req, _ := s.DeleteBucketRequest(&s3.DeleteBucketInput{Bucket: &s.config.Bucket})
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+	return &RemoveBucketOutput{s.getRequestId(req.HTTPResponse)}, nil
+}
+
+func (s *S3Backend) MakeBucket(param *MakeBucketInput) (*MakeBucketOutput, error) {
+	req, _ := s.CreateBucketRequest(&s3.CreateBucketInput{Bucket: &s.config.Bucket})
+	err := req.Send()
+	if err != nil {
+		return nil, mapAwsError(err)
+	}
+	return &MakeBucketOutput{s.getRequestId(req.HTTPResponse)}, nil
+}
+
+func (s *S3Backend) Delegate() interface{} {
+	return s
+}
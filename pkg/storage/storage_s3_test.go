@@ -0,0 +1,690 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// fakeS3 serves the part of the S3 API that S3Backend uses, for one
+// path style bucket kept in a MemStorage
+type fakeS3 struct {
+	bucket string
+	mem    *MemStorage
+
+	mu       sync.Mutex
+	requests []string
+}
+
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+type fakeS3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         uint64
+	StorageClass string
+}
+
+type fakeS3Prefix struct {
+	Prefix string
+}
+
+type fakeS3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Name                  string
+	Prefix                string
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	NextContinuationToken string `xml:",omitempty"`
+	Contents              []fakeS3Object
+	CommonPrefixes        []fakeS3Prefix
+}
+
+type fakeS3Delete struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type fakeS3Complete struct {
+	Parts []struct {
+		ETag       string
+		PartNumber uint32
+	} `xml:"Part"`
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3Backend) {
+	f := &fakeS3{bucket: "bkt", mem: NewMemStorage("bkt")}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	s3, err := NewS3Storage(&S3Config{
+		Endpoint:  server.URL,
+		Bucket:    f.bucket,
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, s3
+}
+
+func (f *fakeS3) count(op string) (n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.requests {
+		if r == op {
+			n++
+		}
+	}
+	return
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%v</Code><Message>%v</Message><RequestId>1</RequestId></Error>",
+		code, code)
+}
+
+func (f *fakeS3) errno(w http.ResponseWriter, err error) {
+	switch err {
+	case syscall.ENOENT:
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+	case syscall.EAGAIN:
+		f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+	case syscall.EINVAL:
+		f.error(w, http.StatusBadRequest, "InvalidArgument")
+	default:
+		f.error(w, http.StatusInternalServerError, "InternalError")
+	}
+}
+
+func (f *fakeS3) xml(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeS3) setHead(w http.ResponseWriter, h *HeadBlobOutput) {
+	w.Header().Set("ETag", *h.ETag)
+	w.Header().Set("Last-Modified", h.LastModified.UTC().Format(http.TimeFormat))
+	if h.ContentType != nil {
+		w.Header().Set("Content-Type", *h.ContentType)
+	}
+	for k, v := range h.Metadata {
+		w.Header().Set("X-Amz-Meta-"+k, *v)
+	}
+}
+
+func (f *fakeS3) metadata(r *http.Request) map[string]*string {
+	m := make(map[string]*string)
+	for k, v := range r.Header {
+		if strings.HasPrefix(k, "X-Amz-Meta-") {
+			value := v[0]
+			m[strings.ToLower(k[len("X-Amz-Meta-"):])] = &value
+		}
+	}
+	return m
+}
+
+// copySource returns the key and the content of the range in the
+// x-amz-copy-source headers
+func (f *fakeS3) copySource(w http.ResponseWriter, r *http.Request) (key string, data []byte, ok bool) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil || !strings.HasPrefix(source, f.bucket+"/") {
+		f.error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	in := &GetBlobInput{Key: source[len(f.bucket)+1:]}
+	if etag := r.Header.Get("X-Amz-Copy-Source-If-Match"); etag != "" {
+		in.IfMatch = &etag
+	}
+	if rg := r.Header.Get("X-Amz-Copy-Source-Range"); rg != "" {
+		var end uint64
+		fmt.Sscanf(rg, "bytes=%d-%d", &in.Start, &end)
+		in.Count = end - in.Start + 1
+	}
+	resp, err := f.mem.GetBlob(in)
+	if err != nil {
+		f.errno(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	data, _ = ioutil.ReadAll(resp.Body)
+	return in.Key, data, true
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	var key string
+	if len(path) == 2 {
+		key = path[1]
+	}
+	q := r.URL.Query()
+	uploadId := q.Get("uploadId")
+	w.Header().Set("X-Amz-Request-Id", "req")
+
+	var op string
+	defer func() {
+		f.mu.Lock()
+		f.requests = append(f.requests, op)
+		f.mu.Unlock()
+	}()
+
+	switch {
+	case r.Method == "GET" && key == "" && q.Get("list-type") == "2":
+		op = "ListObjectsV2"
+		in := &ListBlobsInput{}
+		for name, p := range map[string]**string{
+			"prefix":             &in.Prefix,
+			"delimiter":          &in.Delimiter,
+			"start-after":        &in.StartAfter,
+			"continuation-token": &in.ContinuationToken,
+		} {
+			if q.Has(name) {
+				*p = aws.String(q.Get(name))
+			}
+		}
+		if q.Has("max-keys") {
+			n, _ := strconv.ParseUint(q.Get("max-keys"), 10, 32)
+			in.MaxKeys = aws.Uint32(uint32(n))
+		}
+		out, err := f.mem.ListBlobs(in)
+		if err != nil {
+			f.errno(w, err)
+			return
+		}
+		res := fakeS3ListResult{
+			Name:        f.bucket,
+			Prefix:      q.Get("prefix"),
+			KeyCount:    len(out.Prefixes) + len(out.Items),
+			MaxKeys:     1000,
+			IsTruncated: out.IsTruncated,
+		}
+		for _, p := range out.Prefixes {
+			res.CommonPrefixes = append(res.CommonPrefixes, fakeS3Prefix{*p.Prefix})
+		}
+		for _, i := range out.Items {
+			res.Contents = append(res.Contents, fakeS3Object{
+				Key:          *i.Key,
+				LastModified: i.LastModified.UTC().Format(s3TimeFormat),
+				ETag:         *i.ETag,
+				Size:         i.Size,
+				StorageClass: *i.StorageClass,
+			})
+		}
+		if out.NextContinuationToken != nil {
+			res.NextContinuationToken = *out.NextContinuationToken
+		}
+		f.xml(w, res)
+
+	case r.Method == "POST" && key == "" && q.Has("delete"):
+		op = "DeleteObjects"
+		if r.Header.Get("Content-MD5") == "" {
+			f.error(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		var req fakeS3Delete
+		xml.NewDecoder(r.Body).Decode(&req)
+		var keys []string
+		for _, o := range req.Objects {
+			keys = append(keys, o.Key)
+		}
+		f.mem.DeleteBlobs(&DeleteBlobsInput{Items: keys})
+		f.xml(w, struct {
+			XMLName xml.Name `xml:"DeleteResult"`
+		}{})
+
+	case r.Method == "HEAD":
+		op = "HeadObject"
+		h, err := f.mem.HeadBlob(&HeadBlobInput{Key: key})
+		if err != nil {
+			// no body in a response to HEAD
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.setHead(w, h)
+		w.Header().Set("Content-Length", strconv.FormatUint(h.Size, 10))
+
+	case r.Method == "GET":
+		op = "GetObject"
+		in := &GetBlobInput{Key: key}
+		if rg := r.Header.Get("Range"); rg != "" {
+			se := strings.Split(strings.TrimPrefix(rg, "bytes="), "-")
+			in.Start, _ = strconv.ParseUint(se[0], 10, 64)
+			if se[1] != "" {
+				end, _ := strconv.ParseUint(se[1], 10, 64)
+				in.Count = end - in.Start + 1
+			}
+		}
+		if etag := r.Header.Get("If-Match"); etag != "" {
+			in.IfMatch = &etag
+		}
+		out, err := f.mem.GetBlob(in)
+		if err != nil {
+			f.errno(w, err)
+			return
+		}
+		defer out.Body.Close()
+		data, _ := ioutil.ReadAll(out.Body)
+		f.setHead(w, &out.HeadBlobOutput)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Header.Get("Range") != "" {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v",
+				in.Start, in.Start+uint64(len(data))-1, out.Size))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		w.Write(data)
+
+	case r.Method == "PUT" && uploadId != "":
+		n, _ := strconv.ParseUint(q.Get("partNumber"), 10, 32)
+		var data []byte
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			op = "UploadPartCopy"
+			var ok bool
+			_, data, ok = f.copySource(w, r)
+			if !ok {
+				return
+			}
+		} else {
+			op = "UploadPart"
+			data, _ = ioutil.ReadAll(r.Body)
+		}
+		commit := &MultipartBlobCommitInput{UploadId: &uploadId, Parts: make([]*string, s3MaxParts)}
+		_, err := f.mem.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit: commit, PartNumber: uint32(n), Body: bytes.NewReader(data),
+		})
+		if err != nil {
+			f.errno(w, err)
+			return
+		}
+		if op == "UploadPartCopy" {
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%v</ETag><LastModified>%v</LastModified></CopyPartResult>",
+				*commit.Parts[n-1], time.Now().UTC().Format(s3TimeFormat))
+		} else {
+			w.Header().Set("ETag", *commit.Parts[n-1])
+		}
+
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		op = "CopyObject"
+		source, _, ok := f.copySource(w, r)
+		if !ok {
+			return
+		}
+		in := &CopyBlobInput{Source: source, Destination: key}
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			in.Metadata = f.metadata(r)
+		}
+		if class := r.Header.Get("X-Amz-Storage-Class"); class != "" {
+			in.StorageClass = &class
+		}
+		_, err := f.mem.CopyBlob(in)
+		if err != nil {
+			f.errno(w, err)
+			return
+		}
+		h, _ := f.mem.HeadBlob(&HeadBlobInput{Key: key})
+		fmt.Fprintf(w, "<CopyObjectResult><ETag>%v</ETag><LastModified>%v</LastModified></CopyObjectResult>",
+			*h.ETag, h.LastModified.UTC().Format(s3TimeFormat))
+
+	case r.Method == "PUT" && key != "":
+		op = "PutObject"
+		data, _ := ioutil.ReadAll(r.Body)
+		if int64(len(data)) != r.ContentLength {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		in := &PutBlobInput{Key: key, Body: bytes.NewReader(data), Metadata: f.metadata(r)}
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			in.ContentType = &ct
+		}
+		out, err := f.mem.PutBlob(in)
+		if err != nil {
+			f.errno(w, err)
+			return
+		}
+		w.Header().Set("ETag", *out.ETag)
+
+	case r.Method == "DELETE" && uploadId != "":
+		op = "AbortMultipartUpload"
+		_, err := f.mem.MultipartBlobAbort(&MultipartBlobCommitInput{UploadId: &uploadId})
+		if err != nil {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "DELETE" && key != "":
+		op = "DeleteObject"
+		f.mem.DeleteBlob(&DeleteBlobInput{Key: key})
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "POST" && q.Has("uploads"):
+		op = "CreateMultipartUpload"
+		in := &MultipartBlobBeginInput{Key: key, Metadata: f.metadata(r)}
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			in.ContentType = &ct
+		}
+		commit, err := f.mem.MultipartBlobBegin(in)
+		if err != nil {
+			f.errno(w, err)
+			return
+		}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%v</Bucket><Key>%v</Key>"+
+			"<UploadId>%v</UploadId></InitiateMultipartUploadResult>", f.bucket, key, *commit.UploadId)
+
+	case r.Method == "POST" && uploadId != "":
+		op = "CompleteMultipartUpload"
+		var req fakeS3Complete
+		xml.NewDecoder(r.Body).Decode(&req)
+		for i, p := range req.Parts {
+			if p.PartNumber != uint32(i+1) || p.ETag == "" {
+				f.error(w, http.StatusBadRequest, "InvalidPartOrder")
+				return
+			}
+		}
+		out, err := f.mem.MultipartBlobCommit(&MultipartBlobCommitInput{
+			UploadId: &uploadId,
+			NumParts: uint32(len(req.Parts)),
+		})
+		if err != nil {
+			f.error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%v</Bucket><Key>%v</Key>"+
+			"<ETag>%v</ETag></CompleteMultipartUploadResult>", f.bucket, key, *out.ETag)
+
+	default:
+		op = r.Method
+		f.error(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func TestS3PutHeadGet(t *testing.T) {
+	_, s3 := newFakeS3(t)
+
+	put, err := s3.PutBlob(&PutBlobInput{
+		Key:         "dir/file",
+		Body:        strings.NewReader("hello world"),
+		Size:        aws.Uint64(11),
+		ContentType: aws.String("text/plain"),
+		Metadata:    map[string]*string{"Mode": aws.String("644")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if put.ETag == nil || *put.ETag == "" {
+		t.Fatal("no etag from put")
+	}
+
+	head, err := s3.HeadBlob(&HeadBlobInput{Key: "dir/file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Size != 11 || *head.ETag != *put.ETag || aws.StringValue(head.ContentType) != "text/plain" {
+		t.Errorf("head = size %v etag %v content type %v", head.Size, *head.ETag, aws.StringValue(head.ContentType))
+	}
+	if v := head.Metadata["mode"]; v == nil || *v != "644" {
+		t.Errorf("metadata = %v", head.Metadata)
+	}
+	if head.RequestId == "" {
+		t.Error("no request id")
+	}
+
+	if s := getString(t, s3, &GetBlobInput{Key: "dir/file"}); s != "hello world" {
+		t.Errorf("get = %q", s)
+	}
+	if s := getString(t, s3, &GetBlobInput{Key: "dir/file", Start: 6, Count: 3}); s != "wor" {
+		t.Errorf("ranged get = %q", s)
+	}
+	if s := getString(t, s3, &GetBlobInput{Key: "dir/file", Start: 6}); s != "world" {
+		t.Errorf("get from 6 = %q", s)
+	}
+
+	_, err = s3.GetBlob(&GetBlobInput{Key: "dir/file", IfMatch: aws.String("\"other\"")})
+	if err != syscall.EAGAIN {
+		t.Errorf("get with a stale etag = %v, expecting EAGAIN", err)
+	}
+	if _, err = s3.HeadBlob(&HeadBlobInput{Key: "missing"}); err != syscall.ENOENT {
+		t.Errorf("head of a missing key = %v", err)
+	}
+	if _, err = s3.GetBlob(&GetBlobInput{Key: "missing"}); err != syscall.ENOENT {
+		t.Errorf("get of a missing key = %v", err)
+	}
+	if err = s3.Init("missing"); err != nil {
+		t.Errorf("init = %v", err)
+	}
+
+	s3.config.Bucket = "other"
+	if _, err = s3.ListBlobs(&ListBlobsInput{}); err != syscall.ENXIO {
+		t.Errorf("list of a missing bucket = %v", err)
+	}
+}
+
+func TestS3ListBlobs(t *testing.T) {
+	f, s3 := newFakeS3(t)
+
+	for _, key := range []string{"a/", "a/1", "a/2", "a/b/3", "a b/4", "a-b", "c"} {
+		putString(t, f.mem, key, key)
+	}
+
+	for _, c := range []struct {
+		in       ListBlobsInput
+		maxKeys  uint32
+		expected string
+	}{
+		{ListBlobsInput{}, 0, "[a b/4 a-b a/ a/1 a/2 a/b/3 c]"},
+		{ListBlobsInput{}, 3, "[a b/4 a-b a/ a/1 a/2 a/b/3 c]"},
+		{ListBlobsInput{Delimiter: aws.String("/")}, 0, "[a b/ a/ a-b c]"},
+		{ListBlobsInput{Delimiter: aws.String("/")}, 1, "[a b/ a-b a/ c]"},
+		{ListBlobsInput{Prefix: aws.String("a/"), Delimiter: aws.String("/")}, 0, "[a/b/ a/ a/1 a/2]"},
+		{ListBlobsInput{Prefix: aws.String("a/"), StartAfter: aws.String("a/1")}, 0, "[a/2 a/b/3]"},
+	} {
+		pages := listAll(t, s3, c.in, c.maxKeys)
+		var all []string
+		for _, p := range pages {
+			if p != "" {
+				all = append(all, strings.Split(p, " ")...)
+			}
+		}
+		if fmt.Sprint(all) != c.expected {
+			t.Errorf("list prefix %v delimiter %v max %v = %q, expecting %v",
+				aws.StringValue(c.in.Prefix), aws.StringValue(c.in.Delimiter), c.maxKeys,
+				pages, c.expected)
+		}
+	}
+
+	resp, err := s3.ListBlobs(&ListBlobsInput{Prefix: aws.String("a/1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 1 {
+		t.Fatalf("list a/1 = %+v", resp.Items)
+	}
+	i := resp.Items[0]
+	if i.Size != 3 || aws.StringValue(i.ETag) == "" || i.LastModified == nil ||
+		time.Since(*i.LastModified) > time.Minute || aws.StringValue(i.StorageClass) != "STANDARD" {
+		t.Errorf("item = size %v etag %v mtime %v class %v", i.Size, aws.StringValue(i.ETag),
+			i.LastModified, aws.StringValue(i.StorageClass))
+	}
+}
+
+func TestS3CopyAndDelete(t *testing.T) {
+	f, s3 := newFakeS3(t)
+
+	for _, key := range []string{"plain", "with space", "100%", "päth/ü", "q?x#y+z"} {
+		putString(t, s3, key, "data of "+key)
+		_, err := s3.CopyBlob(&CopyBlobInput{Source: key, Destination: "copy/" + key})
+		if err != nil {
+			t.Fatalf("copy %q: %v", key, err)
+		}
+		if s := getString(t, s3, &GetBlobInput{Key: "copy/" + key}); s != "data of "+key {
+			t.Errorf("copy of %q = %q", key, s)
+		}
+	}
+
+	// replacing the metadata keeps the content type
+	_, err := s3.PutBlob(&PutBlobInput{Key: "typed", Body: strings.NewReader("x"), ContentType: aws.String("image/png")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s3.CopyBlob(&CopyBlobInput{
+		Source:      "typed",
+		Destination: "typed",
+		Metadata:    map[string]*string{"mode": aws.String("600")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := s3.HeadBlob(&HeadBlobInput{Key: "typed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(head.Metadata["mode"]) != "600" || aws.StringValue(head.ContentType) != "image/png" {
+		t.Errorf("after replacing metadata = %v %v", head.Metadata, aws.StringValue(head.ContentType))
+	}
+
+	_, err = s3.CopyBlob(&CopyBlobInput{Source: "plain", Destination: "x", Size: aws.Uint64(18),
+		ETag: aws.String("\"stale\"")})
+	if err != syscall.EAGAIN {
+		t.Errorf("copy with a stale etag = %v, expecting EAGAIN", err)
+	}
+	_, err = s3.CopyBlob(&CopyBlobInput{Source: "missing", Destination: "x"})
+	if err != syscall.ENOENT {
+		t.Errorf("copy of a missing key = %v", err)
+	}
+
+	if _, err = s3.DeleteBlob(&DeleteBlobInput{Key: "plain"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s3.HeadBlob(&HeadBlobInput{Key: "plain"}); err != syscall.ENOENT {
+		t.Errorf("head after delete = %v", err)
+	}
+
+	_, err = s3.DeleteBlobs(&DeleteBlobsInput{Items: []string{"with space", "100%", "missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count("DeleteObjects"); n != 1 {
+		t.Errorf("%v DeleteObjects", n)
+	}
+	resp, err := s3.ListBlobs(&ListBlobsInput{StartAfter: aws.String("copy/~")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, i := range resp.Items {
+		keys = append(keys, *i.Key)
+	}
+	if fmt.Sprint(keys) != "[päth/ü q?x#y+z typed]" {
+		t.Errorf("left after DeleteBlobs: %v", keys)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	f, s3 := newFakeS3(t)
+	putString(t, s3, "src", "0123456789")
+
+	commit, err := s3.MultipartBlobBegin(&MultipartBlobBeginInput{
+		Key:      "big file",
+		Metadata: map[string]*string{"mode": aws.String("600")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []byte
+	for part := uint32(1); part <= 2; part++ {
+		data := bytes.Repeat([]byte{byte('a' + part)}, 1000)
+		expected = append(expected, data...)
+		_, err = s3.MultipartBlobAdd(&MultipartBlobAddInput{
+			Commit:     commit,
+			PartNumber: part,
+			Body:       bytes.NewReader(data),
+			Size:       uint64(len(data)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = s3.MultipartBlobCopy(&MultipartBlobCopyInput{
+		Commit:     commit,
+		PartNumber: 3,
+		Source:     "src",
+		Offset:     2,
+		Size:       5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "23456"...)
+	if commit.NumParts != 3 {
+		t.Errorf("%v parts counted", commit.NumParts)
+	}
+
+	out, err := s3.MultipartBlobCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(aws.StringValue(out.ETag), "-3\"") {
+		t.Errorf("etag of the commit = %v", aws.StringValue(out.ETag))
+	}
+	if s := getString(t, s3, &GetBlobInput{Key: "big file"}); s != string(expected) {
+		t.Errorf("committed %v bytes, expecting %v", len(s), len(expected))
+	}
+	head, err := s3.HeadBlob(&HeadBlobInput{Key: "big file"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(head.Metadata["mode"]) != "600" {
+		t.Errorf("metadata = %v", head.Metadata)
+	}
+
+	// a failed part isn't counted
+	commit, err = s3.MultipartBlobBegin(&MultipartBlobBeginInput{Key: "aborted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s3.MultipartBlobCopy(&MultipartBlobCopyInput{
+		Commit:     commit,
+		PartNumber: 1,
+		Source:     "missing",
+		Size:       1,
+	})
+	if err != syscall.ENOENT || commit.NumParts != 0 || commit.Parts[0] != nil {
+		t.Errorf("copy of a missing part = %v, %v parts", err, commit.NumParts)
+	}
+	if _, err = s3.MultipartBlobAbort(commit); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s3.MultipartBlobAbort(commit); err != syscall.ENOENT {
+		t.Errorf("second abort = %v", err)
+	}
+	if n := f.count("AbortMultipartUpload"); n != 2 {
+		t.Errorf("%v aborts", n)
+	}
+}
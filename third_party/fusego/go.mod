@@ -0,0 +1,5 @@
+module github.com/jacobsa/fuse
+
+go 1.17
+
+require golang.org/x/sys v0.0.0-20220114195835-da31bd327af9
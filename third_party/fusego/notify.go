@@ -0,0 +1,91 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// InvalidateInode tells the kernel to forget the attributes it cached for
+// the inode, and the cached pages from off for length bytes. A length of zero
+// or less means to the end of the file, an off less than zero leaves the
+// pages alone.
+//
+// The kernel returns ENOENT if it doesn't know the inode. The call must
+// not be made while handling an op that holds the kernel's lock on the
+// same inode, it would deadlock.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) InvalidateInode(inode fuseops.InodeID, off int64, length int64) error {
+	if !c.protocol.HasInvalidate() {
+		return syscall.ENOSYS
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalInodeOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))))
+	out.Ino = uint64(inode)
+	out.Off = off
+	out.Len = length
+
+	if c.debugLogger != nil {
+		c.debugLog(0, 1, "-> notify InvalidateInode (inode %v, off %v, len %v)", inode, off, length)
+	}
+	return c.notify(m, fusekernel.NotifyCodeInvalInode)
+}
+
+// InvalidateEntry tells the kernel to forget that name in parent resolves
+// to an inode, and the attributes of parent. The same restrictions as for
+// InvalidateInode apply, for the lock of parent.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) InvalidateEntry(parent fuseops.InodeID, name string) error {
+	if !c.protocol.HasInvalidate() {
+		return syscall.ENOSYS
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalEntryOut)(m.Grow(int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))))
+	out.Parent = uint64(parent)
+	out.Namelen = uint32(len(name))
+	m.AppendString(name)
+	// the kernel wants the name nul terminated
+	m.Append([]byte{0})
+
+	if c.debugLogger != nil {
+		c.debugLog(0, 1, "-> notify InvalidateEntry (parent %v, name %q)", parent, name)
+	}
+	return c.notify(m, fusekernel.NotifyCodeInvalEntry)
+}
+
+// notify sends a message that isn't the reply to an op, the kernel tells
+// them apart by the zero unique ID and takes the error field as the
+// notification code
+func (c *Connection) notify(m *buffer.OutMessage, code int32) error {
+	h := m.OutHeader()
+	h.Unique = 0
+	h.Error = code
+	h.Len = uint32(m.Len())
+
+	return c.writeMessage(m.Bytes())
+}